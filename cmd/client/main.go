@@ -1,7 +1,8 @@
 package main
 
 import (
-	"bytes"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -51,23 +52,51 @@ var (
 	ntlmProxyCreds string
 
 	versionString string
+
+	enrolmentToken string
+
+	strict string
+
+	tlsVerify string
+	tlsPins   string
+
+	// durations, e.g 10s
+	retryMin string
+	retryMax string
+	// base64 encoded PEM, as newlines cant be passed through the linker
+	tlsCA         string
+	tlsClientCert string
 )
 
 func printHelp() {
 	fmt.Println("usage: ", filepath.Base(os.Args[0]), "--[foreground|fingerprint|proxy|process_name] -d|--destination <server_address>")
-	fmt.Println("\t\t-d or --destination\tServer connect back address (can be baked in)")
-	fmt.Println("\t\t--destination-file\tRead server connect back address as file")
+	fmt.Println("\t\t--config\tPath to a YAML file of settings, keys are named after these flags. Overrides baked in values, flags override it")
+	fmt.Println("\t\t-d or --destination\tServer connect back address (can be baked in), can be repeated or comma separated to fail over in order. Append ?sni=name&proxy=url to override --sni and --proxy for one address")
+	fmt.Println("\t\t--destination-file\tRead server connect back addresses from file, one per line. The server can replace them with reconfigure --persist")
 	fmt.Println("\t\t--foreground\tCauses the client to run without forking to background")
-	fmt.Println("\t\t--fingerprint\tServer public key SHA256 hex fingerprint for auth")
-	fmt.Println("\t\t--fingerprint-file\tRead server public key SHA256 hex fingerprint from file path")
+	fmt.Println("\t\t--fingerprint\tServer public key SHA256 hex fingerprint for auth, can be repeated or comma separated")
+	fmt.Println("\t\t--fingerprint-file\tRead server public key SHA256 hex fingerprints from file path, one per line")
+	fmt.Println("\t\t--tofu\tTrust the first server key seen and pin it in this file, other keys are refused afterwards")
+	fmt.Println("\t\t--strict\tRefuse to run without a pinned server fingerprint (can be baked in with link --strict)")
 	fmt.Println("\t\t--proxy\tLocation of HTTP connect proxy to use")
 	fmt.Println("\t\t--ntlm-proxy-creds\tNTLM proxy credentials in format DOMAIN\\USER:PASS")
 	fmt.Println("\t\t--process_name\tProcess name shown in tasklist/process list")
 	fmt.Println("\t\t--sni\tWhen using TLS set the clients requested SNI to this value")
+	fmt.Println("\t\t--tls-verify\tVerify the servers TLS certificate against the system roots and any --tls-ca")
+	fmt.Println("\t\t--tls-ca\tPath to PEM CA certificates to trust for --tls-verify")
+	fmt.Println("\t\t--tls-pin\tSHA256 hex of a TLS public key that must appear in the servers certificate chain, can be repeated")
+	fmt.Println("\t\t--tls-client-cert\tPath to a PEM file holding the TLS client certificate and key to present to the server")
 	fmt.Println("\t\t--log-level\tChange logging output levels, [INFO,WARNING,ERROR,FATAL,DISABLED]")
 	fmt.Println("\t\t--version-string\tSSH version string to use, i.e SSH-VERSION, defaults to internal.Version-runtime.GOOS_runtime.GOARCH")
 	fmt.Println("\t\t--private-key-path\tOptional path to unencrypted SSH key to use for connecting")
+	fmt.Println("\t\t--enrol-token\tOne time token to register a freshly generated key with the server (can be baked in with link --enrol)")
+	fmt.Println("\t\t--enrolled-key-path\tWhere to keep the key generated during enrolment, defaults to the executable path with .key appended")
+	fmt.Println("\t\t--certificate-path\tOptional path to an OpenSSH certificate for the private key, signed by a CA in the servers trusted_controllee_ca_keys")
 	fmt.Println("\t\t--connect-timeout\tDuration to wait for initial connection seconds, default 180, set to 0 to wait indefinitely")
+	fmt.Println("\t\t--retry-min\tShortest wait before retrying a destination that failed, e.g 30s (default 10s, can be baked in)")
+	fmt.Println("\t\t--keepalive\tSend keepalives to the server at this interval, e.g 30s, and disconnect if they go unanswered (default off)")
+	fmt.Println("\t\t--retry-max\tLongest wait before retrying a destination, waits are random and double with each failure up to this (default 5m, can be baked in)")
+	fmt.Println("\t\t--diagnose\tTry each destination once in the foreground, reporting every step of connecting, then exit")
 
 	if runtime.GOOS == "windows" {
 		fmt.Println("\t\t--use-kerberos\tUse kerberos authentication on proxy server (if proxy server specified)")
@@ -75,14 +104,27 @@ func printHelp() {
 }
 
 func makeInitialSettings() (*client.Settings, error) {
+	fingerprints, err := client.ParseFingerprints(fingerprint)
+	if err != nil {
+		return nil, fmt.Errorf("embedded fingerprints are invalid: %w", err)
+	}
+
+	destinations, err := client.ParseDestinations(destination)
+	if err != nil {
+		return nil, fmt.Errorf("embedded destinations are invalid: %w", err)
+	}
+
 	// set the initial settings from the embedded values first
 	settings := &client.Settings{
-		Fingerprint:          fingerprint,
+		Destinations:         destinations,
+		Fingerprints:         fingerprints,
 		ProxyAddr:            proxy,
-		Addr:                 destination,
 		ProxyUseHostKerberos: useHostKerberos == "true",
 		SNI:                  customSNI,
 		VersionString:        versionString,
+		EnrolmentToken:       enrolmentToken,
+		Strict:               strict == "true",
+		ConnectTimeout:       180 * time.Second,
 	}
 
 	if ntlmProxyCreds != "" {
@@ -91,6 +133,48 @@ func makeInitialSettings() (*client.Settings, error) {
 		}
 	}
 
+	settings.TLSVerify = tlsVerify == "true"
+	settings.TLSPins, err = client.ParseFingerprints(tlsPins)
+	if err != nil {
+		return nil, fmt.Errorf("embedded tls pins are invalid: %w", err)
+	}
+
+	if retryMin != "" {
+		settings.RetryMin, err = time.ParseDuration(retryMin)
+		if err != nil {
+			return nil, fmt.Errorf("embedded retry minimum is invalid: %w", err)
+		}
+	}
+
+	if retryMax != "" {
+		settings.RetryMax, err = time.ParseDuration(retryMax)
+		if err != nil {
+			return nil, fmt.Errorf("embedded retry maximum is invalid: %w", err)
+		}
+	}
+
+	if tlsCA != "" {
+		caPem, err := base64.StdEncoding.DecodeString(tlsCA)
+		if err != nil {
+			return nil, fmt.Errorf("embedded tls ca is invalid: %w", err)
+		}
+
+		if err := settings.AddTLSRootCAs(caPem); err != nil {
+			return nil, fmt.Errorf("embedded tls ca is invalid: %w", err)
+		}
+	}
+
+	if tlsClientCert != "" {
+		bundle, err := base64.StdEncoding.DecodeString(tlsClientCert)
+		if err != nil {
+			return nil, fmt.Errorf("embedded tls client certificate is invalid: %w", err)
+		}
+
+		if err := settings.SetTLSClientCertificate(bundle); err != nil {
+			return nil, fmt.Errorf("embedded tls client certificate is invalid: %w", err)
+		}
+	}
+
 	return settings, nil
 }
 
@@ -117,6 +201,7 @@ func main() {
 	os.Unsetenv("F")
 
 	line := terminal.ParseLine(argv, 0)
+	settings.Argv = argv
 
 	if line.IsSet("h") || line.IsSet("help") {
 		printHelp()
@@ -125,32 +210,81 @@ func main() {
 
 	fg := line.IsSet("foreground")
 
+	// Applied before the rest of the flags, so they can override it
+	var config client.Config
+	configPath, err := line.GetArgString("config")
+	if err == nil {
+		config, err = client.LoadConfig(configPath)
+		if err != nil {
+			log.Fatalf("--config %q could not be read: %v", configPath, err)
+		}
+
+		if err = config.Apply(settings); err != nil {
+			log.Fatalf("--config %q was invalid: %v", configPath, err)
+		}
+	}
+
 	proxyaddress, _ := line.GetArgString("proxy")
 	if len(proxyaddress) > 0 {
 		settings.ProxyAddr = proxyaddress
 	}
 
-	userSpecifiedFingerprint, err := line.GetArgString("fingerprint")
+	userSpecifiedFingerprints, err := line.GetArgsString("fingerprint")
 	if err == nil {
-		settings.Fingerprint = userSpecifiedFingerprint
+		// Pins from the command line must not be saved over a --fingerprint-file given in the config file
+		settings.Fingerprints = nil
+		settings.FingerprintFile = ""
+		for _, f := range userSpecifiedFingerprints {
+			fingerprints, err := client.ParseFingerprints(f)
+			if err != nil {
+				log.Fatalf("--fingerprint %q was invalid: %v", f, err)
+			}
+
+			settings.Fingerprints = append(settings.Fingerprints, fingerprints...)
+		}
 	} else {
 		userSpecifiedFingerprintPath, err := line.GetArgString("fingerprint-file")
 		if err == nil {
-			fingerPrint, err := os.ReadFile(userSpecifiedFingerprintPath)
+			fingerprints, err := client.ReadFingerprintFile(userSpecifiedFingerprintPath)
 			if err != nil {
 				log.Fatalf("--fingerprint-file %q was invalid: %v", userSpecifiedFingerprintPath, err)
 			}
 
-			fingerPrint = bytes.TrimSpace(fingerPrint)
+			settings.Fingerprints = fingerprints
+			settings.FingerprintFile = userSpecifiedFingerprintPath
+		}
+	}
 
-			if len(fingerPrint) != 64 {
-				log.Fatalf("The fingerprint read from file %q was not the size of a hex sha256 hash (64 bytes), was: %d", userSpecifiedFingerprintPath, len(fingerPrint))
-			}
+	tofuPath, err := line.GetArgString("tofu")
+	if err == nil {
+		if line.IsSet("fingerprint-file") {
+			log.Fatal("--tofu and --fingerprint-file cannot be used together")
+		}
+
+		settings.FingerprintFile = tofuPath
+
+		pinned, err := os.ReadFile(tofuPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Fatalf("--tofu %q could not be read: %v", tofuPath, err)
+		}
 
-			settings.Fingerprint = string(fingerPrint)
+		fingerprints, err := client.ParseFingerprints(string(pinned))
+		if err != nil {
+			log.Fatalf("The fingerprints pinned in %q were invalid: %v", tofuPath, err)
+		}
+
+		if len(fingerprints) > 0 {
+			settings.Fingerprints = fingerprints
+		} else {
+			// Only takes effect when no fingerprint was baked in or supplied
+			settings.TrustOnFirstUse = true
 		}
 	}
 
+	if line.IsSet("strict") {
+		settings.Strict = true
+	}
+
 	privateKeyPath, err := line.GetArgString("private-key-path")
 	if err == nil {
 		keyBytes, err := os.ReadFile(privateKeyPath)
@@ -170,22 +304,103 @@ func main() {
 		log.Printf("authorized_controllee_key line: %q", strings.TrimSpace(authKeyLine))
 	}
 
+	userSpecifiedEnrolmentToken, err := line.GetArgString("enrol-token")
+	if err == nil {
+		settings.EnrolmentToken = userSpecifiedEnrolmentToken
+	}
+
+	enrolledKeyPath, err := line.GetArgString("enrolled-key-path")
+	if err == nil {
+		settings.EnrolledKeyPath = enrolledKeyPath
+	}
+
+	certificatePath, err := line.GetArgString("certificate-path")
+	if err == nil {
+		certBytes, err := os.ReadFile(certificatePath)
+		if err != nil {
+			log.Fatalf("certificate path was specified %q, but could not read: %s", certificatePath, err)
+		}
+
+		if err = keys.SetCertificate(string(certBytes)); err != nil {
+			log.Fatalf("invalid certificate %q: %s", certificatePath, err)
+		}
+	}
+
 	userSpecifiedSNI, err := line.GetArgString("sni")
 	if err == nil {
 		settings.SNI = userSpecifiedSNI
 	}
 
-	timeoutInt := 180
+	if line.IsSet("tls-verify") {
+		settings.TLSVerify = true
+	}
+
+	tlsCAPath, err := line.GetArgString("tls-ca")
+	if err == nil {
+		caPem, err := os.ReadFile(tlsCAPath)
+		if err != nil {
+			log.Fatalf("--tls-ca %q could not be read: %v", tlsCAPath, err)
+		}
+
+		if err = settings.AddTLSRootCAs(caPem); err != nil {
+			log.Fatalf("--tls-ca %q was invalid: %v", tlsCAPath, err)
+		}
+	}
+
+	userSpecifiedTLSPins, err := line.GetArgsString("tls-pin")
+	if err == nil {
+		settings.TLSPins = nil
+		for _, p := range userSpecifiedTLSPins {
+			pins, err := client.ParseFingerprints(p)
+			if err != nil {
+				log.Fatalf("--tls-pin %q was invalid: %v", p, err)
+			}
+
+			settings.TLSPins = append(settings.TLSPins, pins...)
+		}
+	}
+
+	tlsClientCertPath, err := line.GetArgString("tls-client-cert")
+	if err == nil {
+		bundle, err := os.ReadFile(tlsClientCertPath)
+		if err != nil {
+			log.Fatalf("--tls-client-cert %q could not be read: %v", tlsClientCertPath, err)
+		}
+
+		if err = settings.SetTLSClientCertificate(bundle); err != nil {
+			log.Fatalf("--tls-client-cert %q was invalid: %v", tlsClientCertPath, err)
+		}
+	}
+
 	timeout, err := line.GetArgString("connect-timeout")
 	if err == nil {
-		timeoutInt, err = strconv.Atoi(timeout)
+		timeoutInt, err := strconv.Atoi(timeout)
+		if err != nil {
+			log.Printf("could not parse --connect-timeout as number %v, leaving it at %s", err, settings.ConnectTimeout)
+		} else {
+			settings.ConnectTimeout = time.Duration(timeoutInt) * time.Second
+		}
+	}
+
+	for flag, setting := range map[string]*time.Duration{"retry-min": &settings.RetryMin, "retry-max": &settings.RetryMax} {
+		value, err := line.GetArgString(flag)
 		if err != nil {
-			log.Printf("could not parse --connect-timeout as number %v, setting default to 180", err)
-			timeoutInt = 180
+			continue
+		}
+
+		*setting, err = time.ParseDuration(value)
+		if err != nil || *setting <= 0 {
+			log.Fatalf("--%s %q was invalid, expected a duration e.g 30s", flag, value)
 		}
 	}
 
-	settings.ConnectTimeout = time.Duration(timeoutInt) * time.Second
+	userSpecifiedKeepalive, err := line.GetArgString("keepalive")
+	if err == nil {
+		settings.Keepalive, err = time.ParseDuration(userSpecifiedKeepalive)
+		if err != nil || settings.Keepalive < 0 {
+			log.Fatalf("--keepalive %q was invalid, expected a duration e.g 30s", userSpecifiedKeepalive)
+		}
+	}
 
 	userSpecifiedNTLMCreds, err := line.GetArgString("ntlm-proxy-creds")
 	if err == nil {
@@ -208,59 +423,88 @@ func main() {
 		settings.VersionString = versionString
 	}
 
-	tempDestination, err := line.GetArgString("d")
+	userSpecifiedDestinations, err := line.GetArgsString("d")
 	if err != nil {
-		tempDestination, err = line.GetArgString("destination")
+		userSpecifiedDestinations, err = line.GetArgsString("destination")
 		if err != nil {
 			destinationFile, err := line.GetArgString("destination-file")
 			if err == nil {
-				destinationFileBytes, err := os.ReadFile(destinationFile)
+				settings.Destinations, err = client.ReadDestinationFile(destinationFile)
 				if err != nil {
-					log.Fatalf("--destinationFile-file %q was invalid: %v", destinationFile, err)
+					log.Fatalf("--destination-file %q was invalid: %v", destinationFile, err)
 				}
 
-				tempDestination = string(bytes.TrimSpace(destinationFileBytes))
+				settings.DestinationFile = destinationFile
 			}
 		}
 	}
 
-	if len(tempDestination) > 0 {
-		settings.Addr = tempDestination
+	if len(userSpecifiedDestinations) > 0 {
+		var flagDestinations []client.Destination
+		for _, d := range userSpecifiedDestinations {
+			destinations, err := client.ParseDestinations(d)
+			if err != nil {
+				log.Fatalf("Destination %q was invalid: %v", d, err)
+			}
+
+			flagDestinations = append(flagDestinations, destinations...)
+		}
+
+		settings.OverrideDestinations(flagDestinations)
 	}
 
-	if len(settings.Addr) == 0 && len(line.Arguments) > 1 {
+	if len(settings.Destinations) == 0 && len(line.Arguments) > 1 {
 		// Basically take a guess at the arguments we have and take the last one
-		settings.Addr = line.Arguments[len(line.Arguments)-1].Value()
+		guessed, err := client.ParseDestination(line.Arguments[len(line.Arguments)-1].Value())
+		if err == nil {
+			settings.Destinations = []client.Destination{guessed}
+		}
 	}
 
 	var actualLogLevel logger.Urgency = logger.INFO
+	if logLevel != "" {
+		actualLogLevel, err = logger.StrToUrgency(logLevel)
+		if err != nil {
+			actualLogLevel = logger.INFO
+			log.Println("Default log level as invalid, setting to INFO: ", err)
+		}
+	}
+
+	if config.LogLevel != "" {
+		// Already checked by Apply
+		actualLogLevel, _ = logger.StrToUrgency(config.LogLevel)
+	}
+
 	userSpecifiedLogLevel, err := line.GetArgString("log-level")
 	if err == nil {
 		actualLogLevel, err = logger.StrToUrgency(userSpecifiedLogLevel)
 		if err != nil {
 			log.Fatalf("Invalid log level: %q, err: %s", userSpecifiedLogLevel, err)
 		}
-	} else if logLevel != "" {
-		actualLogLevel, err = logger.StrToUrgency(logLevel)
-		if err != nil {
-			actualLogLevel = logger.INFO
-			log.Println("Default log level as invalid, setting to INFO: ", err)
-		}
 	}
 	logger.SetLogLevel(actualLogLevel)
 
-	if len(settings.Addr) == 0 {
+	if len(settings.Destinations) == 0 {
 		fmt.Println("No destination specified")
 		printHelp()
 		return
 	}
 
+	if line.IsSet("diagnose") {
+		// The report covers everything the connection logging would say
+		log.SetOutput(io.Discard)
+		if !client.Diagnose(settings, os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	if fg || child {
 		Run(settings)
 		return
 	}
 
-	if strings.HasPrefix(destination, "stdio://") {
+	if strings.HasPrefix(settings.Destinations[0].Addr, "stdio://") {
 		// We cant fork off of an inetd style connection or stdin/out will be closed
 		log.SetOutput(io.Discard)
 		Run(settings)
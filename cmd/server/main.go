@@ -1,18 +1,28 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/NHAS/reverse_ssh/internal"
 	"github.com/NHAS/reverse_ssh/internal/server"
+	"github.com/NHAS/reverse_ssh/internal/server/bans"
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/mfa"
+	"github.com/NHAS/reverse_ssh/internal/server/multiplexer"
+	"github.com/NHAS/reverse_ssh/internal/server/tlsca"
 	"github.com/NHAS/reverse_ssh/internal/terminal"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"github.com/NHAS/reverse_ssh/pkg/mux"
 )
 
 func printHelp() {
@@ -24,16 +34,34 @@ func printHelp() {
 	fmt.Println("  Authorisation")
 	fmt.Println("\t--insecure\t\tIgnore authorized_controllee_keys file and allow any RSSH client to connect")
 	fmt.Println("\t--openproxy\t\tAllow any ssh client to do a dynamic remote forward (-R) and effectively allowing anyone to open a port on localhost on the server")
+	fmt.Println("\t--allow-admin-without-mfa\tLet administrators that have not enrolled a second factor log in with their key alone (by default they must enrol one, see --enrol-mfa)")
+	fmt.Println("\t--ban-threshold\t\tNumber of connections from one IP that fail to log in (however many keys they offer) within --ban-window before it is temporarily banned, 0 disables banning (defaults to 10)")
+	fmt.Println("\t--ban-window\t\tPeriod failed logins are counted over, e.g 5m (defaults to 5m)")
+	fmt.Println("\t--ban-duration\t\tHow long an IP is banned for, e.g 30m, 12h (defaults to 30m)")
 	fmt.Println("  Network")
 	fmt.Println("\t--tls\t\t\tEnable TLS on socket (ssh/http over TLS)")
-	fmt.Println("\t--tlscert\t\tTLS certificate path")
-	fmt.Println("\t--tlskey\t\tTLS key path")
+	fmt.Println("\t--tlscert\t\tTLS certificate path, can be repeated to serve several certificates by SNI (otherwise one is generated in the datadir)")
+	fmt.Println("\t--tlskey\t\tTLS key path, given in the same order as --tlscert")
+	fmt.Println("\t--tls-require-client-cert\tRefuse TLS connections without a client certificate from the rssh CA (see link --tls-client-cert)")
 	fmt.Println("\t--webserver\t\t(Depreciated) Enable webserver on the listen_address port")
 	fmt.Println("\t--enable-client-downloads\t\tEnable webserver and raw TCP to download clients")
+	fmt.Println("\t--proxy-protocol\tComma separated networks of load balancers that send PROXY protocol v1/v2 headers, e.g 10.0.0.0/8")
+	fmt.Println("\t--protocols\t\tOnly accept these protocols on the listen address, from ssh,tls,ws,http,download,raw (default all)")
+	fmt.Println("\t--logins\t\tOnly allow these logins on the listen address, from operators,controllees,proxies (default all)")
+	fmt.Println("\t--quic\t\t\tAlso accept clients over QUIC on this UDP address, e.g --quic 0.0.0.0:3232")
+	fmt.Println("\t--operator-socket\tAlso accept operator logins on this unix socket, relative paths are in the datadir, e.g --operator-socket rssh.sock")
 	fmt.Println("\t--external_address\tIf the external IP and port of the RSSH server is different from the listening address, set that here")
+	fmt.Println("\t--max-connections\tOpen connections allowed across all listeners, -1 for unlimited (default unlimited)")
+	fmt.Println("\t--max-connections-per-ip\tOpen connections allowed from one IP, -1 for unlimited (default unlimited)")
+	fmt.Println("\t--max-handshakes\tConnections allowed to be negotiating their protocol at once (default 1000)")
+	fmt.Println("\t--max-handshakes-per-ip\tConnections from one IP allowed to be negotiating their protocol at once (default 100)")
+	fmt.Println("\t--handshake-timeout\tTime a connection has to finish PROXY, TLS and websocket negotiation, e.g 10s (default 5s)")
+	fmt.Println("\t--max-polling-sessions\tHTTP polling sessions allowed at once (default 2000)")
+	fmt.Println("\t--max-polling-sessions-per-ip\tHTTP polling sessions allowed from one IP (default unlimited)")
 	fmt.Println("\t--timeout\t\tSet rssh client timeout (when a client is considered disconnected) defaults, in seconds, defaults to 5, if set to 0 timeout is disabled")
 	fmt.Println("  Utility")
 	fmt.Println("\t--fingerprint\t\tPrint fingerprint and exit. (Will generate server key if none exists)")
+	fmt.Println("\t--enrol-mfa\t\tEnrol a second factor for an administrator public key (or file holding one) or a username and exit, e.g --enrol-mfa ~/.ssh/id_ed25519.pub")
 	fmt.Println("\t--log-level\t\tChange logging output levels (will set default log level for generated clients), [INFO,WARNING,ERROR,FATAL,DISABLED]")
 	fmt.Println("\t--console-label\t\tChange console label.  (Default: catcher)")
 
@@ -42,21 +70,39 @@ func printHelp() {
 func main() {
 
 	options, err := terminal.ParseLineValidFlags(strings.Join(os.Args, " "), 0, map[string]bool{
-		"insecure":                true,
-		"tls":                     true,
-		"tlscert":                 true,
-		"tlskey":                  true,
-		"external_address":        true,
-		"fingerprint":             true,
-		"webserver":               true, // deprecated
-		"enable-client-downloads": true,
-		"datadir":                 true,
-		"h":                       true,
-		"help":                    true,
-		"timeout":                 true,
-		"openproxy":               true,
-		"log-level":               true,
-		"console-label":           true,
+		"insecure":                    true,
+		"tls":                         true,
+		"tlscert":                     true,
+		"tlskey":                      true,
+		"tls-require-client-cert":     true,
+		"external_address":            true,
+		"fingerprint":                 true,
+		"webserver":                   true, // deprecated
+		"enable-client-downloads":     true,
+		"datadir":                     true,
+		"h":                           true,
+		"help":                        true,
+		"timeout":                     true,
+		"openproxy":                   true,
+		"log-level":                   true,
+		"console-label":               true,
+		"allow-admin-without-mfa":     true,
+		"enrol-mfa":                   true,
+		"ban-threshold":               true,
+		"ban-window":                  true,
+		"ban-duration":                true,
+		"proxy-protocol":              true,
+		"protocols":                   true,
+		"logins":                      true,
+		"max-connections":             true,
+		"max-connections-per-ip":      true,
+		"max-handshakes":              true,
+		"max-handshakes-per-ip":       true,
+		"handshake-timeout":           true,
+		"max-polling-sessions":        true,
+		"max-polling-sessions-per-ip": true,
+		"operator-socket":             true,
+		"quic":                        true,
 	})
 
 	if err != nil {
@@ -120,6 +166,19 @@ func main() {
 		return
 	}
 
+	if identity, err := options.GetArgString("enrol-mfa"); err == nil {
+		if err := data.LoadDatabase(filepath.Join(dataDir, "data.db")); err != nil {
+			log.Fatal(err)
+		}
+
+		if err := mfa.EnrolInteractive(mfa.ParseIdentity(identity), os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Println("Second factor enrolled")
+		return
+	}
+
 	if len(options.Arguments) < 1 {
 		fmt.Println("Missing listening address")
 		printHelp()
@@ -161,9 +220,123 @@ func main() {
 		}
 	}
 
+	if options.IsSet("allow-admin-without-mfa") {
+		mfa.RequireForAdmins = false
+		log.Println("WARNING: --allow-admin-without-mfa is set, administrators without a second factor can log in with their key alone, so a stolen administrator key gives full control of the server")
+	}
+
+	if thresholdString, err := options.GetArgString("ban-threshold"); err == nil {
+		bans.Threshold, err = strconv.Atoi(thresholdString)
+		if err != nil || bans.Threshold < 0 {
+			fmt.Printf("Unable to convert %q to a positive int\n", thresholdString)
+			printHelp()
+			return
+		}
+	}
+
+	if windowString, err := options.GetArgString("ban-window"); err == nil {
+		bans.Window, err = time.ParseDuration(windowString)
+		if err != nil || bans.Window <= 0 {
+			fmt.Printf("Unable to parse ban window %q as a duration\n", windowString)
+			printHelp()
+			return
+		}
+	}
+
+	if durationString, err := options.GetArgString("ban-duration"); err == nil {
+		bans.Duration, err = time.ParseDuration(durationString)
+		if err != nil || bans.Duration <= 0 {
+			fmt.Printf("Unable to parse ban duration %q as a duration\n", durationString)
+			printHelp()
+			return
+		}
+	}
+
+	if trustedProxies, err := options.GetArgString("proxy-protocol"); err == nil {
+		multiplexer.TrustedProxies, err = mux.ParseCIDRs(trustedProxies)
+		if err != nil || len(multiplexer.TrustedProxies) == 0 {
+			fmt.Printf("Unable to parse --proxy-protocol %q as networks: %v\n", trustedProxies, err)
+			printHelp()
+			return
+		}
+	}
+
+	if allowed, err := options.GetArgString("protocols"); err == nil {
+		multiplexer.ListenerProtocols, err = mux.ParseProtocols(allowed)
+		if err != nil {
+			fmt.Println(err)
+			printHelp()
+			return
+		}
+	}
+
+	if logins, err := options.GetArgString("logins"); err == nil {
+		multiplexer.ListenerLogins, err = multiplexer.ParseLogins(logins)
+		if err != nil {
+			fmt.Println(err)
+			printHelp()
+			return
+		}
+	}
+
+	if socket, err := options.GetArgString("operator-socket"); err == nil {
+		if !filepath.IsAbs(socket) {
+			socket = filepath.Join(dataDir, socket)
+		}
+		server.OperatorSocket = socket
+	}
+
+	if quicAddress, err := options.GetArgString("quic"); err == nil {
+		multiplexer.QUICAddress = quicAddress
+	}
+
+	limits := map[string]*int{
+		"max-connections":             &multiplexer.Limits.MaxConnections,
+		"max-connections-per-ip":      &multiplexer.Limits.MaxConnectionsPerIP,
+		"max-handshakes":              &multiplexer.Limits.MaxHandshakes,
+		"max-handshakes-per-ip":       &multiplexer.Limits.MaxHandshakesPerIP,
+		"max-polling-sessions":        &multiplexer.Limits.MaxPollingSessions,
+		"max-polling-sessions-per-ip": &multiplexer.Limits.MaxPollingSessionsPerIP,
+	}
+
+	for flag, limit := range limits {
+		if limitString, err := options.GetArgString(flag); err == nil {
+			*limit, err = strconv.Atoi(limitString)
+			if err != nil || *limit == 0 || *limit < mux.Unlimited {
+				fmt.Printf("Unable to convert --%s %q to a positive int (or -1 for unlimited)\n", flag, limitString)
+				printHelp()
+				return
+			}
+		}
+	}
+
+	if timeoutString, err := options.GetArgString("handshake-timeout"); err == nil {
+		multiplexer.Limits.HandshakeTimeout, err = time.ParseDuration(timeoutString)
+		if err != nil || multiplexer.Limits.HandshakeTimeout <= 0 {
+			fmt.Printf("Unable to parse handshake timeout %q as a duration\n", timeoutString)
+			printHelp()
+			return
+		}
+	}
+
 	tls := options.IsSet("tls")
-	tlscert, _ := options.GetArgString("tlscert")
-	tlskey, _ := options.GetArgString("tlskey")
+	tlscerts, _ := options.GetArgsString("tlscert")
+	tlskeys, _ := options.GetArgsString("tlskey")
+	if len(tlscerts) != len(tlskeys) {
+		fmt.Println("Each --tlscert needs a matching --tlskey")
+		printHelp()
+		return
+	}
+
+	var tlsCertificates []mux.TLSKeyPair
+	for i := range tlscerts {
+		tlsCertificates = append(tlsCertificates, mux.TLSKeyPair{CertPath: tlscerts[i], KeyPath: tlskeys[i]})
+	}
+
+	tlsca.RequireClientCerts = options.IsSet("tls-require-client-cert")
+	if tlsca.RequireClientCerts && !tls {
+		log.Println("[WARNING] --tls-require-client-cert has no effect without --tls")
+	}
 
 	enabledDownloads := options.IsSet("webserver") || options.IsSet("enable-client-downloads")
 
@@ -211,5 +384,9 @@ func main() {
 
 	log.Println("connect back: ", connectBackAddress)
 
-	server.Run(listenAddress, dataDir, connectBackAddress, autogeneratedConnectBack, tlscert, tlskey, insecure, enabledDownloads, tls, openproxy, timeout)
+	// Run returns once interrupted, after closing its listeners and saving state
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server.Run(ctx, listenAddress, dataDir, connectBackAddress, autogeneratedConnectBack, tlsCertificates, insecure, enabledDownloads, tls, openproxy, timeout)
 }
@@ -145,7 +145,7 @@ func conditionExec(command, expectedOutput string, exitCode int, serverLogExpect
 }
 
 func runServer() func() {
-	cmd := exec.Command("./server", "--enable-client-downloads", listenAddr)
+	cmd := exec.Command("./server", "--enable-client-downloads", "--allow-admin-without-mfa", listenAddr)
 
 	r, w, err := os.Pipe()
 	if err != nil {
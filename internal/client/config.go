@@ -0,0 +1,204 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/client/keys"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the YAML file given with --config, its keys are named after the matching flags.
+// Anything it sets overrides what was baked in, and flags override it in turn
+type Config struct {
+	Destinations    []string `yaml:"destinations"`
+	DestinationFile string   `yaml:"destination-file"`
+
+	Fingerprints    []string `yaml:"fingerprints"`
+	FingerprintFile string   `yaml:"fingerprint-file"`
+	Strict          bool     `yaml:"strict"`
+
+	Proxy          string `yaml:"proxy"`
+	NTLMProxyCreds string `yaml:"ntlm-proxy-creds"`
+	UseKerberos    bool   `yaml:"use-kerberos"`
+	SNI            string `yaml:"sni"`
+
+	// Not part of Settings, so left for the caller to apply
+	LogLevel string `yaml:"log-level"`
+
+	// Durations such as 30s, the connect timeout also takes plain seconds as --connect-timeout does
+	ConnectTimeout string `yaml:"connect-timeout"`
+	Keepalive      string `yaml:"keepalive"`
+	RetryMin       string `yaml:"retry-min"`
+	RetryMax       string `yaml:"retry-max"`
+
+	PrivateKeyPath string `yaml:"private-key-path"`
+}
+
+// LoadConfig reads a config file, refusing keys it doesnt know so a typo isnt silently ignored
+func LoadConfig(path string) (Config, error) {
+	var c Config
+
+	f, err := os.Open(path)
+	if err != nil {
+		return c, err
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+
+	// An empty file is valid, it just doesnt change anything
+	if err := decoder.Decode(&c); err != nil && !errors.Is(err, io.EOF) {
+		return c, err
+	}
+
+	return c, nil
+}
+
+// Apply checks every value and copies those that are set onto settings
+func (c Config) Apply(settings *Settings) error {
+	if len(c.Destinations) > 0 && c.DestinationFile != "" {
+		return errors.New("destinations and destination-file cannot both be set")
+	}
+
+	if len(c.Fingerprints) > 0 && c.FingerprintFile != "" {
+		return errors.New("fingerprints and fingerprint-file cannot both be set")
+	}
+
+	if c.NTLMProxyCreds != "" && c.UseKerberos {
+		return errors.New("ntlm-proxy-creds and use-kerberos cannot both be set")
+	}
+
+	if len(c.Destinations) > 0 {
+		settings.Destinations = nil
+		for _, d := range c.Destinations {
+			destinations, err := ParseDestinations(d)
+			if err != nil {
+				return fmt.Errorf("destinations: %w", err)
+			}
+
+			settings.Destinations = append(settings.Destinations, destinations...)
+		}
+	}
+
+	if c.DestinationFile != "" {
+		destinations, err := ReadDestinationFile(c.DestinationFile)
+		if err != nil {
+			return fmt.Errorf("destination-file: %w", err)
+		}
+
+		settings.Destinations = destinations
+		settings.DestinationFile = c.DestinationFile
+	}
+
+	if len(c.Fingerprints) > 0 {
+		settings.Fingerprints = nil
+		for _, f := range c.Fingerprints {
+			fingerprints, err := ParseFingerprints(f)
+			if err != nil {
+				return fmt.Errorf("fingerprints: %w", err)
+			}
+
+			settings.Fingerprints = append(settings.Fingerprints, fingerprints...)
+		}
+	}
+
+	if c.FingerprintFile != "" {
+		fingerprints, err := ReadFingerprintFile(c.FingerprintFile)
+		if err != nil {
+			return fmt.Errorf("fingerprint-file: %w", err)
+		}
+
+		settings.Fingerprints = fingerprints
+		settings.FingerprintFile = c.FingerprintFile
+	}
+
+	if c.Strict {
+		settings.Strict = true
+	}
+
+	if c.Proxy != "" {
+		if _, err := GetProxyDetails(c.Proxy); err != nil {
+			return fmt.Errorf("proxy: %w", err)
+		}
+
+		settings.ProxyAddr = c.Proxy
+	}
+
+	if c.NTLMProxyCreds != "" {
+		if err := settings.SetNTLMProxyCreds(c.NTLMProxyCreds); err != nil {
+			return fmt.Errorf("ntlm-proxy-creds: %w", err)
+		}
+	}
+
+	if c.UseKerberos {
+		settings.ProxyUseHostKerberos = true
+	}
+
+	if c.SNI != "" {
+		settings.SNI = c.SNI
+	}
+
+	if c.LogLevel != "" {
+		if _, err := logger.StrToUrgency(c.LogLevel); err != nil {
+			return fmt.Errorf("log-level: %w", err)
+		}
+	}
+
+	if c.ConnectTimeout != "" {
+		timeout, err := time.ParseDuration(c.ConnectTimeout)
+		if err != nil {
+			seconds, atoiErr := strconv.Atoi(c.ConnectTimeout)
+			if atoiErr != nil {
+				return fmt.Errorf("connect-timeout: %w", err)
+			}
+
+			timeout = time.Duration(seconds) * time.Second
+		}
+
+		if timeout < 0 {
+			return fmt.Errorf("connect-timeout: %q is negative", c.ConnectTimeout)
+		}
+
+		settings.ConnectTimeout = timeout
+	}
+
+	for key, duration := range map[string]struct {
+		value   string
+		setting *time.Duration
+	}{
+		"keepalive": {c.Keepalive, &settings.Keepalive},
+		"retry-min": {c.RetryMin, &settings.RetryMin},
+		"retry-max": {c.RetryMax, &settings.RetryMax},
+	} {
+		if duration.value == "" {
+			continue
+		}
+
+		d, err := time.ParseDuration(duration.value)
+		if err != nil || d < 0 || (d == 0 && key != "keepalive") {
+			return fmt.Errorf("%s: %q is not a valid duration, e.g 30s", key, duration.value)
+		}
+
+		*duration.setting = d
+	}
+
+	if c.PrivateKeyPath != "" {
+		keyBytes, err := os.ReadFile(c.PrivateKeyPath)
+		if err != nil {
+			return fmt.Errorf("private-key-path: %w", err)
+		}
+
+		if err := keys.SetPrivateKey(string(keyBytes)); err != nil {
+			return fmt.Errorf("private-key-path: %w", err)
+		}
+	}
+
+	return nil
+}
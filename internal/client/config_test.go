@@ -0,0 +1,120 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+)
+
+func TestConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "client.yaml")
+
+	fingerprint := strings.Repeat("ab", 32)
+	err := os.WriteFile(path, []byte(`
+destinations:
+  - tls://one.example:443
+  - two.example:22?sni=front.example
+fingerprints: [`+fingerprint+`]
+proxy: proxy.internal:3128
+log-level: WARNING
+connect-timeout: 30
+retry-max: 2m
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// As if baked in, anything the file sets should replace it
+	settings := &Settings{
+		Destinations:   []Destination{{Addr: "baked.example:22"}},
+		SNI:            "baked.example",
+		ConnectTimeout: 180 * time.Second,
+		RetryMin:       time.Minute,
+	}
+
+	if err := c.Apply(settings); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(settings.Destinations) != 2 || settings.Destinations[1].SNI != "front.example" {
+		t.Fatalf("destinations were not replaced: %v", settings.Destinations)
+	}
+
+	if len(settings.Fingerprints) != 1 || settings.Fingerprints[0] != fingerprint {
+		t.Fatalf("fingerprints were not set: %v", settings.Fingerprints)
+	}
+
+	if settings.ProxyAddr != "proxy.internal:3128" || settings.SNI != "baked.example" {
+		t.Fatalf("got proxy %q sni %q", settings.ProxyAddr, settings.SNI)
+	}
+
+	if settings.ConnectTimeout != 30*time.Second || settings.RetryMin != time.Minute || settings.RetryMax != 2*time.Minute {
+		t.Fatalf("got connect timeout %s retry %s-%s", settings.ConnectTimeout, settings.RetryMin, settings.RetryMax)
+	}
+
+	if c.LogLevel != "WARNING" {
+		t.Fatalf("log level was %q", c.LogLevel)
+	}
+
+	if err := os.WriteFile(path, []byte("destination: typo.example:22\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("unknown key was accepted")
+	}
+
+	for _, invalid := range []Config{
+		{Destinations: []string{"a:22"}, DestinationFile: filepath.Join(dir, "destinations")},
+		{RetryMin: "soon"},
+		{LogLevel: "LOUD"},
+		{Fingerprints: []string{"not hex"}},
+	} {
+		if err := invalid.Apply(&Settings{}); err == nil {
+			t.Fatalf("invalid config was applied: %+v", invalid)
+		}
+	}
+}
+
+func TestConfigDestinationFileOverriddenByFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "destinations")
+	if err := os.WriteFile(path, []byte("shared.example:22\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	settings := &Settings{}
+	if err := (Config{DestinationFile: path}).Apply(settings); err != nil {
+		t.Fatal(err)
+	}
+
+	// As main does for -d, flags take precedence over the config file
+	settings.OverrideDestinations([]Destination{{Addr: "flag.example:22"}})
+
+	if settings.DestinationFile != "" {
+		t.Fatal("destination file from the config was kept after -d replaced its destinations")
+	}
+
+	pool := newDestinationPool(settings.destinations(), 0, 0)
+	if _, err := settings.reconfigure(internal.Reconfiguration{Destinations: "new.example:22", Persist: true}, pool); err == nil {
+		t.Fatal("persisting was allowed without a destination file of the clients own")
+	}
+
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(saved) != "shared.example:22\n" {
+		t.Fatalf("destination file named by the config was overwritten: %q", saved)
+	}
+}
@@ -0,0 +1,262 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bounds on how long a destination is skipped after failing, used when the settings dont give their own
+const (
+	DefaultRetryMin = 10 * time.Second
+	DefaultRetryMax = 5 * time.Minute
+)
+
+// backoff picks a random delay between retryMin and a ceiling that doubles with each failure in a row, so clients that lost the same server dont all come back at once
+func backoff(failures int, retryMin, retryMax time.Duration) time.Duration {
+	ceiling := retryMin << min(failures+1, 20)
+	if ceiling > retryMax || ceiling <= 0 {
+		ceiling = retryMax
+	}
+
+	if ceiling <= retryMin {
+		return retryMin
+	}
+
+	return retryMin + rand.N(ceiling-retryMin)
+}
+
+// Destination is one server address the client can call back to, with its own SNI and proxy
+type Destination struct {
+	Addr      string
+	SNI       string
+	ProxyAddr string
+}
+
+func (d Destination) String() string {
+	var options []string
+	if d.SNI != "" {
+		options = append(options, "sni="+url.QueryEscape(d.SNI))
+	}
+
+	if d.ProxyAddr != "" {
+		options = append(options, "proxy="+url.QueryEscape(d.ProxyAddr))
+	}
+
+	if len(options) == 0 {
+		return d.Addr
+	}
+
+	return d.Addr + "?" + strings.Join(options, "&")
+}
+
+// ParseDestination takes an address as given to -d, optionally followed by ?sni=name&proxy=url to override the clients SNI and proxy for just this address
+func ParseDestination(s string) (Destination, error) {
+	s = strings.TrimSpace(s)
+
+	addr, options, hasOptions := strings.Cut(s, "?")
+	d := Destination{Addr: addr}
+	if d.Addr == "" {
+		return d, errors.New("destination has no address")
+	}
+
+	if !hasOptions {
+		return d, nil
+	}
+
+	values, err := url.ParseQuery(options)
+	if err != nil {
+		return d, fmt.Errorf("destination %q has invalid options: %w", s, err)
+	}
+
+	for k := range values {
+		switch k {
+		case "sni":
+			d.SNI = values.Get(k)
+		case "proxy":
+			d.ProxyAddr, err = GetProxyDetails(values.Get(k))
+			if err != nil {
+				return d, err
+			}
+		default:
+			return d, fmt.Errorf("destination %q has unknown option %q, valid options are sni and proxy", s, k)
+		}
+	}
+
+	return d, nil
+}
+
+// ParseDestinations takes a comma or newline separated list of destinations in priority order
+func ParseDestinations(s string) ([]Destination, error) {
+	var result []Destination
+	for _, part := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+
+		d, err := ParseDestination(part)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, d)
+	}
+
+	return result, nil
+}
+
+// OverrideDestinations replaces the destinations with ones given on the command line, they did not come from any destination file
+// so reconfigure --persist must not write them over one a config file named
+func (s *Settings) OverrideDestinations(destinations []Destination) {
+	s.Destinations = destinations
+	s.DestinationFile = ""
+}
+
+// ReadDestinationFile reads destinations one per line, as reconfigure --persist saves them
+func ReadDestinationFile(path string) ([]Destination, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseDestinations(string(contents))
+}
+
+type destinationState struct {
+	Destination
+
+	failures int
+	retryAt  time.Time
+}
+
+// destinationPool picks which destination to try next, the one that last worked first and then the rest in priority order
+type destinationPool struct {
+	sync.Mutex
+
+	destinations []*destinationState
+	lastGood     *destinationState
+
+	retryMin, retryMax time.Duration
+
+	// Set when the server asks to be left alone for a while before it disconnects, every destination waits as they are often the same server
+	pendingRetryAfter time.Duration
+}
+
+func newDestinationPool(destinations []Destination, retryMin, retryMax time.Duration) *destinationPool {
+	p := &destinationPool{}
+	p.update(destinations, retryMin, retryMax)
+
+	return p
+}
+
+// update replaces the destinations and retry bounds, destinations that are unchanged keep their backoff
+func (p *destinationPool) update(destinations []Destination, retryMin, retryMax time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+
+	if retryMin <= 0 {
+		retryMin = DefaultRetryMin
+	}
+
+	if retryMax <= 0 {
+		retryMax = DefaultRetryMax
+	}
+
+	p.retryMin, p.retryMax = retryMin, max(retryMin, retryMax)
+
+	existing := map[Destination]*destinationState{}
+	for _, d := range p.destinations {
+		existing[d.Destination] = d
+	}
+
+	p.destinations = nil
+	for _, d := range destinations {
+		state, ok := existing[d]
+		if !ok {
+			state = &destinationState{Destination: d}
+		}
+
+		p.destinations = append(p.destinations, state)
+	}
+
+	if p.lastGood != nil && !slices.Contains(p.destinations, p.lastGood) {
+		p.lastGood = nil
+	}
+}
+
+// next blocks until a destination is no longer backing off
+func (p *destinationPool) next() *destinationState {
+	for {
+		p.Lock()
+
+		order := p.destinations
+		if p.lastGood != nil {
+			order = append([]*destinationState{p.lastGood}, p.destinations...)
+		}
+
+		now := time.Now()
+		var soonest time.Time
+		for _, d := range order {
+			if !now.Before(d.retryAt) {
+				p.Unlock()
+				return d
+			}
+
+			if soonest.IsZero() || d.retryAt.Before(soonest) {
+				soonest = d.retryAt
+			}
+		}
+
+		p.Unlock()
+
+		<-time.After(time.Until(soonest))
+	}
+}
+
+func (p *destinationPool) failed(d *destinationState) {
+	p.Lock()
+	defer p.Unlock()
+
+	d.failures++
+
+	if p.pendingRetryAfter > 0 {
+		// Spread over the same again, so a fleet told to come back later doesnt arrive all at once
+		retryAt := time.Now().Add(p.pendingRetryAfter + rand.N(p.pendingRetryAfter))
+		p.pendingRetryAfter = 0
+
+		for _, other := range p.destinations {
+			if other.retryAt.Before(retryAt) {
+				other.retryAt = retryAt
+			}
+		}
+
+		// d may have been removed by a reconfiguration while connected
+		d.retryAt = retryAt
+		return
+	}
+
+	d.retryAt = time.Now().Add(backoff(d.failures-1, p.retryMin, p.retryMax))
+}
+
+func (p *destinationPool) succeeded(d *destinationState) {
+	p.Lock()
+	defer p.Unlock()
+
+	d.failures = 0
+	d.retryAt = time.Time{}
+	p.lastGood = d
+}
+
+// retryAfter records the servers request to wait before trying any destination again, applied when the connection drops
+func (p *destinationPool) retryAfter(after time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.pendingRetryAfter = after
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDestinations(t *testing.T) {
+	destinations, err := ParseDestinations("tls://a.example:443?sni=cdn.example&proxy=10.0.0.1:3128, b.example:22\nws://c.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Destination{
+		{Addr: "tls://a.example:443", SNI: "cdn.example", ProxyAddr: "http://10.0.0.1:3128"},
+		{Addr: "b.example:22"},
+		{Addr: "ws://c.example"},
+	}
+
+	if len(destinations) != len(expected) {
+		t.Fatalf("expected %d destinations, got %d: %v", len(expected), len(destinations), destinations)
+	}
+
+	for i := range expected {
+		if destinations[i] != expected[i] {
+			t.Fatalf("destination %d was %+v, expected %+v", i, destinations[i], expected[i])
+		}
+
+		reparsed, err := ParseDestination(destinations[i].String())
+		if err != nil || reparsed != destinations[i] {
+			t.Fatalf("destination %d did not survive a round trip: %+v %v", i, reparsed, err)
+		}
+	}
+
+	if _, err := ParseDestination("a.example:22?nope=1"); err == nil {
+		t.Fatal("unknown option was accepted")
+	}
+}
+
+func TestDestinationFailover(t *testing.T) {
+	p := newDestinationPool([]Destination{{Addr: "primary:22"}, {Addr: "backup:22"}}, 0, 0)
+
+	first := p.next()
+	if first.Addr != "primary:22" {
+		t.Fatalf("expected the primary to be tried first, got %s", first.Addr)
+	}
+
+	p.failed(first)
+
+	second := p.next()
+	if second.Addr != "backup:22" {
+		t.Fatalf("expected to fail over to the backup, got %s", second.Addr)
+	}
+
+	p.succeeded(second)
+
+	// The primary is usable again, but the backup last worked so it is preferred
+	first.retryAt = time.Time{}
+	if d := p.next(); d.Addr != "backup:22" {
+		t.Fatalf("expected the destination that last worked, got %s", d.Addr)
+	}
+
+	p.failed(second)
+	if d := p.next(); d.Addr != "primary:22" {
+		t.Fatalf("expected the primary once the backup failed, got %s", d.Addr)
+	}
+
+	p.retryAfter(time.Hour)
+	p.failed(first)
+	if wait := time.Until(first.retryAt); wait < 59*time.Minute || wait > 2*time.Hour {
+		t.Fatalf("the servers retry after was not used: %s", wait)
+	}
+
+	if wait := time.Until(second.retryAt); wait < 59*time.Minute {
+		t.Fatalf("the servers retry after was not applied to the other destinations: %s", wait)
+	}
+
+	p.failed(first)
+	if wait := time.Until(first.retryAt); wait > DefaultRetryMax {
+		t.Fatalf("retry after applied to more than one disconnect: %s", wait)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	retryMin, retryMax := time.Second, 10*time.Second
+
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		d := backoff(0, retryMin, retryMax)
+		if d < retryMin || d > 2*retryMin {
+			t.Fatalf("first retry should be between the minimum and twice it, got %s", d)
+		}
+		seen[d] = true
+
+		if d := backoff(30, retryMin, retryMax); d < retryMin || d > retryMax {
+			t.Fatalf("retry should never go past the maximum, got %s", d)
+		}
+	}
+
+	if len(seen) < 10 {
+		t.Fatal("retries are not jittered")
+	}
+}
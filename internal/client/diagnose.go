@@ -0,0 +1,522 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/client/keys"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	diagnoseOK   = "ok"
+	diagnoseWarn = "warn"
+	diagnoseFail = "FAIL"
+	diagnoseSkip = "skip"
+)
+
+type diagnosis struct {
+	w        io.Writer
+	settings *Settings
+}
+
+// step writes one line of the report, detail may run over several lines which are indented to match
+func (d diagnosis) step(status, name, format string, args ...any) {
+	detail := strings.ReplaceAll(fmt.Sprintf(format, args...), "\n", "\n"+strings.Repeat(" ", 20))
+	fmt.Fprintf(d.w, "  %-4s  %-10s  %s\n", status, name, detail)
+}
+
+func elapsed(start time.Time) time.Duration {
+	d := time.Since(start)
+	if d < time.Millisecond {
+		return d.Round(time.Microsecond)
+	}
+
+	return d.Round(time.Millisecond)
+}
+
+// Diagnose takes each destination through the steps Run uses to connect, once and without retrying, writing the outcome of every step to w.
+// It reports whether any destination got as far as the server accepting the clients key
+func Diagnose(settings *Settings, w io.Writer) bool {
+	d := diagnosis{w: w, settings: settings}
+
+	var err error
+	settings.ProxyAddr, err = GetProxyDetails(settings.ProxyAddr)
+	if err != nil {
+		fmt.Fprintf(w, "Invalid proxy %q: %s\n", settings.ProxyAddr, err)
+		return false
+	}
+
+	// Only held in memory, so diagnosing a client that has not enrolled yet doesnt use up its token
+	var enrolmentKey []byte
+	if settings.EnrolmentToken != "" {
+		enrolmentKey, err = prepareEnrolment(settings)
+		if err != nil {
+			fmt.Fprintf(w, "Preparing key for enrolment failed: %s\n", err)
+			return false
+		}
+	}
+
+	sshPriv, err := keys.GetPrivateKey()
+	if err != nil {
+		fmt.Fprintf(w, "Getting private key failed: %s\n", err)
+		return false
+	}
+
+	config := ssh.ClientConfig{
+		Timeout:       settings.ConnectTimeout,
+		User:          sshUser(logger.NewLog("client")),
+		Auth:          []ssh.AuthMethod{ssh.PublicKeys(sshPriv)},
+		ClientVersion: settings.clientVersion(),
+	}
+
+	timeout := "none"
+	if settings.ConnectTimeout > 0 {
+		timeout = settings.ConnectTimeout.String()
+	}
+
+	fmt.Fprintf(w, "Client %s on %s_%s, connecting as %s\n", config.ClientVersion, runtime.GOOS, runtime.GOARCH, config.User)
+	fmt.Fprintf(w, "Client key %s, %d pinned server fingerprints, connect timeout %s\n", ssh.FingerprintSHA256(sshPriv.PublicKey()), len(settings.Fingerprints), timeout)
+
+	destinations := settings.destinations()
+	reachable := 0
+	for i, dest := range destinations {
+		fmt.Fprintf(w, "\n[%d/%d] %s\n", i+1, len(destinations), dest)
+
+		if d.destination(dest, config, enrolmentKey == nil) {
+			reachable++
+		}
+	}
+
+	fmt.Fprintf(w, "\n%d of %d destinations reachable\n", reachable, len(destinations))
+
+	return reachable > 0
+}
+
+func (d diagnosis) destination(dest Destination, config ssh.ClientConfig, enrolled bool) bool {
+	realAddr, scheme := determineConnectionType(dest.Addr)
+
+	switch scheme {
+	case "stdio":
+		d.step(diagnoseSkip, "parse", "stdio destinations are connected by whatever started the client, there is nothing to diagnose")
+		return false
+	case "ssh", "tls", "ws", "wss", "http", "https", "quic":
+	default:
+		d.step(diagnoseWarn, "parse", "unknown transport %q, it is treated as plain ssh", scheme)
+		scheme = "ssh"
+	}
+
+	host, _, err := net.SplitHostPort(realAddr)
+	if err != nil {
+		d.step(diagnoseFail, "parse", "%s: %s", realAddr, err)
+		return false
+	}
+
+	serverName := sniServerName(dest.SNI, realAddr)
+	switch scheme {
+	case "tls", "wss", "https", "quic":
+		d.step(diagnoseOK, "parse", "%s transport to %s, sni %s", scheme, realAddr, serverName)
+	default:
+		d.step(diagnoseOK, "parse", "%s transport to %s", scheme, realAddr)
+	}
+
+	d.dns(host, dest.ProxyAddr != "")
+
+	tlsConfig := d.settings.tlsConfig(serverName)
+
+	var conn net.Conn
+	if scheme == "quic" {
+		start := time.Now()
+		conn, err = connectQUIC(d.settings, realAddr, tlsConfig)
+		if err != nil {
+			d.step(diagnoseFail, "quic", "%s", err)
+			return false
+		}
+
+		d.step(diagnoseOK, "quic", "%s -> %s in %s", conn.LocalAddr(), conn.RemoteAddr(), elapsed(start))
+	} else {
+		var proxyAddr string
+		conn, proxyAddr = d.tcp(dest, realAddr)
+		if conn == nil {
+			return false
+		}
+
+		if d.settings.ConnectTimeout > 0 {
+			conn.SetDeadline(time.Now().Add(d.settings.ConnectTimeout))
+		}
+
+		conn, err = d.transports(conn, scheme, realAddr, proxyAddr, tlsConfig)
+		if err != nil {
+			return false
+		}
+	}
+
+	return d.ssh(conn, dest.Addr, config, enrolled)
+}
+
+func (d diagnosis) dns(host string, proxied bool) {
+	if net.ParseIP(host) != nil {
+		d.step(diagnoseOK, "dns", "%s is an address, nothing to resolve", host)
+		return
+	}
+
+	ctx := context.Background()
+	if d.settings.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.settings.ConnectTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		if proxied {
+			d.step(diagnoseWarn, "dns", "%s, the proxy may still be able to resolve it", err)
+			return
+		}
+
+		d.step(diagnoseFail, "dns", "%s", err)
+		return
+	}
+
+	d.step(diagnoseOK, "dns", "%s is %s (%s)", host, strings.Join(addrs, ", "), elapsed(start))
+}
+
+// tcp tries the same candidates as connectTCP, the destinations proxy or a direct connection then each proxy from the environment.
+// All of them are tried so each gets reported, the first that worked is used for the rest of the steps and failures after it are only warnings
+func (d diagnosis) tcp(dest Destination, realAddr string) (net.Conn, string) {
+	type candidate struct {
+		proxy, source string
+	}
+
+	candidates := []candidate{{dest.ProxyAddr, "configured"}}
+	for _, proxy := range getCaseInsensitiveEnv("http_proxy", "https_proxy") {
+		candidates = append(candidates, candidate{proxy, "from environment"})
+	}
+
+	var (
+		conn      net.Conn
+		proxyAddr string
+	)
+	for _, c := range candidates {
+		var (
+			result net.Conn
+			err    error
+		)
+
+		failed := diagnoseFail
+		if conn != nil {
+			failed = diagnoseWarn
+		}
+
+		start := time.Now()
+		if c.proxy == "" {
+			result, err = Connect(realAddr, "", d.settings.ConnectTimeout, false, nil)
+			if err != nil {
+				d.step(failed, "tcp", "direct: %s", err)
+				continue
+			}
+
+			d.step(diagnoseOK, "tcp", "direct: %s -> %s in %s", result.LocalAddr(), result.RemoteAddr(), elapsed(start))
+		} else {
+			var addr string
+			addr, err = GetProxyDetails(c.proxy)
+			if err != nil {
+				d.step(failed, "proxy", "%s (%s): %s", c.proxy, c.source, err)
+				continue
+			}
+
+			result = d.proxy(addr, c.source, realAddr, failed)
+			if result == nil {
+				continue
+			}
+
+			c.proxy = addr
+		}
+
+		if conn != nil {
+			result.Close()
+			continue
+		}
+
+		conn, proxyAddr = result, c.proxy
+	}
+
+	return conn, proxyAddr
+}
+
+// proxy finds out what the proxy asks for before connecting through it the way Connect does, so a refusal can be explained
+func (d diagnosis) proxy(proxyAddr, source, realAddr, failed string) net.Conn {
+	label := proxyAddr + " (" + source + ")"
+
+	proxyURL, _ := url.Parse(proxyAddr) // Already parsed
+	status := diagnoseOK
+	auth := "socks proxies are used without authentication"
+	switch proxyURL.Scheme {
+	case "http", "https":
+		response, schemes, err := probeProxy(proxyURL, realAddr, d.settings.ConnectTimeout)
+		if err != nil {
+			d.step(failed, "proxy", "%s: %s", label, err)
+			return nil
+		}
+
+		auth = d.proxyAuth(response, schemes)
+	case "socks4":
+		status = diagnoseWarn
+		auth = "socks4 is not supported, the client connects directly instead"
+	}
+
+	start := time.Now()
+	conn, err := Connect(realAddr, proxyAddr, d.settings.ConnectTimeout, d.settings.ProxyUseHostKerberos, d.settings.ntlm)
+	if err != nil {
+		d.step(failed, "proxy", "%s: %s\n%s", label, auth, err)
+		return nil
+	}
+
+	d.step(status, "proxy", "%s: %s\nconnected to %s in %s", label, auth, realAddr, elapsed(start))
+
+	return conn
+}
+
+// proxyAuth explains what Connect will do with the response to an unauthenticated CONNECT
+func (d diagnosis) proxyAuth(status string, schemes []string) string {
+	if strings.HasPrefix(status, "200") {
+		return "no authentication needed"
+	}
+
+	if !strings.HasPrefix(status, "407") {
+		return fmt.Sprintf("answered %q without asking for authentication", status)
+	}
+
+	required := "requires " + strings.Join(schemes, ", ") + " authentication"
+	if !slices.ContainsFunc(schemes, func(s string) bool { return strings.EqualFold(s, strings.TrimSpace(NTLM)) }) {
+		return required + ", the client can only authenticate to proxies that offer NTLM"
+	}
+
+	switch {
+	case d.settings.ntlm != nil:
+		return required + ", using --ntlm-proxy-creds"
+	case d.settings.ProxyUseHostKerberos && runtime.GOOS == "windows":
+		return required + ", using host kerberos"
+	case d.settings.ProxyUseHostKerberos:
+		return required + ", host kerberos is only supported on windows"
+	}
+
+	return required + ", no credentials are configured (--ntlm-proxy-creds or --use-kerberos)"
+}
+
+// probeProxy sends a CONNECT without credentials, returning the status and the authentication schemes the proxy offers
+func probeProxy(proxyURL *url.URL, addr string, timeout time.Duration) (string, []string, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if proxyURL.Scheme == "https" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", proxyURL.Host, &tls.Config{InsecureSkipVerify: true})
+	} else {
+		conn, err = dialer.Dial("tcp", proxyURL.Host)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	defer conn.Close()
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	err = WriteHTTPReq([]string{
+		fmt.Sprintf("CONNECT %s HTTP/1.1", addr),
+		fmt.Sprintf("Host: %s", addr),
+	}, conn)
+	if err != nil {
+		return "", nil, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return "", nil, fmt.Errorf("reading from proxy failed: %w", err)
+	}
+	resp.Body.Close()
+
+	var schemes []string
+	for _, challenge := range resp.Header.Values("Proxy-Authenticate") {
+		scheme, _, _ := strings.Cut(challenge, " ")
+		schemes = append(schemes, scheme)
+	}
+
+	return resp.Status, schemes, nil
+}
+
+// transports adds TLS, websockets or HTTP polling on top of conn as connect does
+func (d diagnosis) transports(conn net.Conn, scheme, realAddr, proxyAddr string, tlsConfig *tls.Config) (net.Conn, error) {
+	if scheme == "tls" || scheme == "wss" || scheme == "https" {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			d.step(diagnoseFail, "tls", "%s", err)
+			return nil, err
+		}
+
+		d.step(diagnoseOK, "tls", "%s", d.describeTLS(tlsConn.ConnectionState()))
+		conn = tlsConn
+	}
+
+	switch scheme {
+	case "wss", "ws":
+		c, err := websocket.NewConfig("ws://"+realAddr+"/ws", "ws://"+realAddr)
+		if err == nil {
+			var wsConn *websocket.Conn
+			wsConn, err = websocket.NewClient(c, conn)
+			if err == nil {
+				wsConn.PayloadType = websocket.BinaryFrame
+				d.step(diagnoseOK, "websocket", "upgraded at %s", c.Location)
+				return wsConn, nil
+			}
+		}
+
+		conn.Close()
+		d.step(diagnoseFail, "websocket", "%s", err)
+		return nil, err
+	case "http", "https":
+		conn.Close()
+
+		httpConn, err := NewHTTPConn(scheme+"://"+realAddr, tlsConfig, func() (net.Conn, error) {
+			return Connect(realAddr, proxyAddr, d.settings.ConnectTimeout, d.settings.ProxyUseHostKerberos, d.settings.ntlm)
+		})
+		if err != nil {
+			d.step(diagnoseFail, "http", "%s", err)
+			return nil, err
+		}
+
+		mode := "short polling"
+		if httpConn.longPoll {
+			mode = "long polling"
+		}
+
+		d.step(diagnoseOK, "http", "session %s opened, %s", httpConn.ID, mode)
+		return httpConn, nil
+	}
+
+	return conn, nil
+}
+
+func (d diagnosis) describeTLS(cs tls.ConnectionState) string {
+	checked := "certificate not checked, the ssh host key authenticates the server (--tls-verify, --tls-pin)"
+	switch {
+	case d.settings.TLSVerify && len(d.settings.TLSPins) > 0:
+		checked = "certificate verified and matched a pinned key"
+	case d.settings.TLSVerify:
+		checked = "certificate verified"
+	case len(d.settings.TLSPins) > 0:
+		checked = "certificate chain matched a pinned key"
+	}
+
+	summary := fmt.Sprintf("%s %s, %s", tls.VersionName(cs.Version), tls.CipherSuiteName(cs.CipherSuite), checked)
+	if len(cs.PeerCertificates) == 0 {
+		return summary
+	}
+
+	leaf := cs.PeerCertificates[0]
+
+	expiry := "expires " + leaf.NotAfter.Format(time.DateOnly)
+	if time.Now().After(leaf.NotAfter) {
+		expiry = "EXPIRED " + leaf.NotAfter.Format(time.DateOnly)
+	}
+
+	return fmt.Sprintf("%s\nsubject %q, issuer %q, %s\nkey pin %s", summary, leaf.Subject, leaf.Issuer, expiry, internal.TLSPublicKeyPinHex(leaf))
+}
+
+// ssh does the handshake, checking the host key and whether the server accepts the clients key, then disconnects straight away
+func (d diagnosis) ssh(conn net.Conn, addr string, config ssh.ClientConfig, enrolled bool) bool {
+	var (
+		presented bool
+		status    string
+		detail    string
+	)
+	config.HostKeyCallback = func(_ string, _ net.Addr, key ssh.PublicKey) error {
+		presented = true
+		status, detail = hostKeyVerdict(d.settings, key)
+		if status == diagnoseFail {
+			return fmt.Errorf("%s", detail)
+		}
+
+		return nil
+	}
+
+	// The token is single use, so when the server asks for it the diagnosis stops there rather than enrolling
+	var askedForToken bool
+	if !enrolled {
+		config.Auth = append(config.Auth, ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+			askedForToken = true
+			return nil, errors.New("enrolment token withheld while diagnosing")
+		}))
+	}
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(&internal.TimeoutConn{Conn: conn, Timeout: d.settings.ConnectTimeout}, addr, &config)
+	if !presented {
+		conn.Close()
+		d.step(diagnoseFail, "ssh", "handshake failed before the server presented its key: %s", err)
+		return false
+	}
+
+	d.step(status, "host key", "%s", detail)
+	if status == diagnoseFail {
+		conn.Close()
+		return false
+	}
+
+	if askedForToken {
+		conn.Close()
+		d.step(diagnoseOK, "auth", "server asked for the enrolment token, which the client will present on its first real connection")
+		return true
+	}
+
+	if err != nil {
+		conn.Close()
+		d.step(diagnoseFail, "auth", "%s", err)
+		return false
+	}
+	defer sshConn.Close()
+
+	go ssh.DiscardRequests(reqs)
+	go internal.DiscardChannels(sshConn, chans)
+
+	d.step(diagnoseOK, "auth", "server %s accepted the client key", sshConn.ServerVersion())
+
+	return true
+}
+
+// hostKeyVerdict decides as checkHostKey does, but without pinning anything on first use
+func hostKeyVerdict(settings *Settings, key ssh.PublicKey) (status, detail string) {
+	fingerprint := internal.FingerprintSHA256Hex(key)
+
+	switch {
+	case slices.Contains(settings.Fingerprints, fingerprint):
+		return diagnoseOK, fingerprint + " matches a pinned fingerprint"
+	case len(settings.Fingerprints) > 0:
+		return diagnoseFail, fmt.Sprintf("%s does not match the pinned fingerprints: %s", fingerprint, strings.Join(settings.Fingerprints, ", "))
+	case settings.TrustOnFirstUse:
+		return diagnoseOK, fmt.Sprintf("%s would be pinned to %q on first use", fingerprint, settings.FingerprintFile)
+	case settings.Strict:
+		return diagnoseFail, fingerprint + " refused, strict mode is on and no fingerprint is pinned"
+	}
+
+	return diagnoseWarn, fingerprint + " accepted, but no fingerprint is pinned (--fingerprint)"
+}
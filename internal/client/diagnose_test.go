@@ -0,0 +1,52 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbeProxy(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect || r.Host != "server.internal:443" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Add("Proxy-Authenticate", "Negotiate")
+		w.Header().Add("Proxy-Authenticate", "NTLM")
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	status, schemes, err := probeProxy(proxyURL, "server.internal:443", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(status, "407") || strings.Join(schemes, ",") != "Negotiate,NTLM" {
+		t.Fatalf("got status %q schemes %v", status, schemes)
+	}
+
+	d := diagnosis{settings: &Settings{}}
+	if auth := d.proxyAuth(status, schemes); !strings.Contains(auth, "no credentials") {
+		t.Fatalf("proxy asking for NTLM without credentials configured was reported as %q", auth)
+	}
+
+	if err := d.settings.SetNTLMProxyCreds("DOMAIN\\user:pass"); err != nil {
+		t.Fatal(err)
+	}
+
+	if auth := d.proxyAuth(status, schemes); !strings.Contains(auth, "--ntlm-proxy-creds") {
+		t.Fatalf("proxy asking for NTLM with credentials configured was reported as %q", auth)
+	}
+
+	if auth := d.proxyAuth(status, []string{"Basic"}); !strings.Contains(auth, "only authenticate to proxies that offer NTLM") {
+		t.Fatalf("proxy asking for Basic was reported as %q", auth)
+	}
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/client/keys"
+	"golang.org/x/crypto/ssh"
+)
+
+var errEnrolmentRefused = errors.New("server refused enrolment")
+
+func enrolledKeyPath(settings *Settings) (string, error) {
+	if settings.EnrolledKeyPath != "" {
+		return settings.EnrolledKeyPath, nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("unable to find executable path, set --enrolled-key-path: %w", err)
+	}
+
+	return exe + ".key", nil
+}
+
+// prepareEnrolment loads the key saved by a previous enrolment, or generates a new one.
+// If the returned key is non-nil it has not been enrolled yet and must be before it can be used
+func prepareEnrolment(settings *Settings) ([]byte, error) {
+	path, err := enrolledKeyPath(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	if saved, err := os.ReadFile(path); err == nil {
+		if err := keys.SetPrivateKey(string(saved)); err == nil {
+			return nil, nil
+		}
+
+		log.Printf("Saved key %q is invalid, generating a new one: %s", path, err)
+	}
+
+	newKey, err := internal.GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return newKey, keys.SetPrivateKey(string(newKey))
+}
+
+// enrolmentAuth answers the servers keyboard-interactive request for an enrolment token, asked is set once it has been, so a failed
+// login afterwards means the token was refused rather than the server being unreachable
+func enrolmentAuth(settings *Settings, asked *bool) ssh.AuthMethod {
+	return ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		if len(questions) != 1 {
+			return nil, fmt.Errorf("expected the server to ask for an enrolment token, got %d questions", len(questions))
+		}
+
+		*asked = true
+
+		return []string{settings.EnrolmentToken}, nil
+	})
+}
+
+// saveEnrolledKey keeps the key that is enrolled with the token, so restarts dont need a new token
+func saveEnrolledKey(settings *Settings, key []byte) {
+	path, err := enrolledKeyPath(settings)
+	if err == nil {
+		err = os.WriteFile(path, key, 0600)
+	}
+
+	if err != nil {
+		log.Printf("Unable to save key for enrolment, a new token will be needed after restart: %s", err)
+	}
+}
@@ -3,7 +3,9 @@ package handlers
 import (
 	"fmt"
 	"io"
+	"maps"
 	"net"
+	"slices"
 
 	"github.com/NHAS/reverse_ssh/internal"
 	"github.com/NHAS/reverse_ssh/internal/client/connection"
@@ -11,6 +13,19 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+func jumpChannels(session *connection.Session) map[string]func(newChannel ssh.NewChannel, log logger.Logger) {
+	return map[string]func(newChannel ssh.NewChannel, log logger.Logger){
+		"session":         Session(session),
+		"direct-tcpip":    LocalForward,
+		"tun@openssh.com": Tun,
+	}
+}
+
+// JumpChannels lists the channel types users can open through the jump host
+func JumpChannels() []string {
+	return slices.Sorted(maps.Keys(jumpChannels(nil)))
+}
+
 func JumpHandler(sshPriv ssh.Signer, serverConn ssh.Conn) func(newChannel ssh.NewChannel, log logger.Logger) {
 
 	return func(newChannel ssh.NewChannel, log logger.Logger) {
@@ -84,11 +99,7 @@ func JumpHandler(sshPriv ssh.Signer, serverConn ssh.Conn) func(newChannel ssh.Ne
 			}
 		}(reqs)
 
-		err = connection.RegisterChannelCallbacks(chans, clientLog, map[string]func(newChannel ssh.NewChannel, log logger.Logger){
-			"session":         Session(session),
-			"direct-tcpip":    LocalForward,
-			"tun@openssh.com": Tun,
-		})
+		err = connection.RegisterChannelCallbacks(chans, clientLog, jumpChannels(session))
 
 		if err != nil {
 			log.Error("Channel call back error: %s", err)
@@ -2,6 +2,8 @@ package subsystems
 
 import (
 	"fmt"
+	"maps"
+	"slices"
 
 	"github.com/NHAS/reverse_ssh/internal/terminal"
 	"golang.org/x/crypto/ssh"
@@ -13,6 +15,11 @@ var subsystems = map[string]subsystem{
 	"list": new(list),
 }
 
+// Names lists the subsystems this client supports
+func Names() []string {
+	return slices.Sorted(maps.Keys(subsystems))
+}
+
 type subsystem interface {
 	Execute(arguments terminal.ParsedLine, connection ssh.Channel, subsystemReq *ssh.Request) error
 }
@@ -0,0 +1,263 @@
+package client
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	announcedLck sync.Mutex
+	// Fingerprints of keys the server has said it will rotate to, mapped to the pinned key that signed the announcement
+	announced = map[string]string{}
+)
+
+// ParseFingerprints reads hex sha256 fingerprints separated by commas or newlines, blank lines and lines starting with # are ignored
+func ParseFingerprints(s string) ([]string, error) {
+	var fingerprints []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		for _, fingerprint := range strings.Split(line, ",") {
+			fingerprint = strings.ToLower(strings.TrimSpace(fingerprint))
+			if fingerprint == "" {
+				continue
+			}
+
+			if _, err := hex.DecodeString(fingerprint); err != nil || len(fingerprint) != 64 {
+				return nil, fmt.Errorf("%q is not a hex sha256 fingerprint (64 characters)", fingerprint)
+			}
+
+			if !slices.Contains(fingerprints, fingerprint) {
+				fingerprints = append(fingerprints, fingerprint)
+			}
+		}
+	}
+
+	return fingerprints, nil
+}
+
+// ReadFingerprintFile reads fingerprints as ParseFingerprints does, a file without any is an error as nothing would be pinned
+func ReadFingerprintFile(path string) ([]string, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprints, err := ParseFingerprints(string(contents))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fingerprints) == 0 {
+		return nil, errors.New("file did not contain any fingerprints")
+	}
+
+	return fingerprints, nil
+}
+
+// checkHostKey decides whether the key presented by the server is trusted, pinning it if trust on first use is enabled
+func checkHostKey(settings *Settings, key ssh.PublicKey) error {
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+
+	l := logger.NewLog("client")
+
+	fingerprint := internal.FingerprintSHA256Hex(key)
+
+	if len(settings.Fingerprints) == 0 {
+		if settings.TrustOnFirstUse {
+			settings.Fingerprints = []string{fingerprint}
+			settings.TrustOnFirstUse = false
+
+			if err := saveFingerprints(settings); err != nil {
+				l.Warning("Unable to save server fingerprint to %q: %s", settings.FingerprintFile, err)
+			}
+
+			l.Info("Trusting server key %s on first use", fingerprint)
+			return nil
+		}
+
+		if settings.Strict {
+			return fmt.Errorf("refusing server key %s, no fingerprint is pinned", fingerprint)
+		}
+
+		// If a server key isnt supplied, fail open. Use Strict for more paranoid people
+		l.Warning("No server key specified, allowing connection to server with key %s", fingerprint)
+		return nil
+	}
+
+	if slices.Contains(settings.Fingerprints, fingerprint) {
+		return nil
+	}
+
+	if !switchToAnnounced(settings, fingerprint) {
+		return fmt.Errorf("server public key invalid, expected one of: %s, got: %s", strings.Join(settings.Fingerprints, ", "), fingerprint)
+	}
+
+	l.Info("Server has rotated its host key, now expecting %s", fingerprint)
+
+	return nil
+}
+
+func saveFingerprints(settings *Settings) error {
+	if settings.FingerprintFile == "" {
+		return nil
+	}
+
+	return os.WriteFile(settings.FingerprintFile, []byte(strings.Join(settings.Fingerprints, "\n")+"\n"), 0600)
+}
+
+func rotationsPath(settings *Settings) (string, error) {
+	if settings.RotationsFile != "" {
+		return settings.RotationsFile, nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("unable to find executable path: %w", err)
+	}
+
+	return exe + ".rotations", nil
+}
+
+// saveRotation records that old was replaced by fingerprint. Pins that did not come from FingerprintFile are compiled in or given
+// on the command line, so the rotation is kept separately and applied to them by loadRotations when the client restarts
+func saveRotation(settings *Settings, old, fingerprint string) error {
+	if settings.FingerprintFile != "" {
+		return saveFingerprints(settings)
+	}
+
+	path, err := rotationsPath(settings)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "%s %s\n", old, fingerprint)
+	return err
+}
+
+// loadRotations replaces pins with the keys the server rotated them to before the client last stopped
+func loadRotations(settings *Settings) error {
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+
+	if settings.FingerprintFile != "" || len(settings.Fingerprints) == 0 {
+		return nil
+	}
+
+	path, err := rotationsPath(settings)
+	if err != nil {
+		return err
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	rotations := map[string]string{}
+	for _, line := range strings.Split(string(contents), "\n") {
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			continue
+		}
+
+		rotations[parts[0]] = parts[1]
+	}
+
+	for i, fingerprint := range settings.Fingerprints {
+		// Follow every rotation since, each key is only rotated to once so this ends unless the file was edited into a loop
+		for range len(rotations) {
+			replacement, ok := rotations[fingerprint]
+			if !ok {
+				break
+			}
+			fingerprint = replacement
+		}
+
+		if fingerprint != settings.Fingerprints[i] {
+			log.Printf("Server rotated its host key from %s, now expecting %s", settings.Fingerprints[i], fingerprint)
+			settings.Fingerprints[i] = fingerprint
+		}
+	}
+
+	return nil
+}
+
+// acceptHostKeyAnnouncement verifies the announcement was signed by serverKey for this session, and remembers the new key
+func acceptHostKeyAnnouncement(serverKey ssh.PublicKey, sessionID, payload []byte) (string, error) {
+	var a internal.HostKeyAnnouncement
+	if err := ssh.Unmarshal(payload, &a); err != nil {
+		return "", fmt.Errorf("malformed announcement: %w", err)
+	}
+
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(a.Signature, &sig); err != nil {
+		return "", fmt.Errorf("malformed signature: %w", err)
+	}
+
+	if err := serverKey.Verify(append(append([]byte{}, sessionID...), a.NewKey...), &sig); err != nil {
+		return "", fmt.Errorf("signature did not verify: %w", err)
+	}
+
+	newKey, err := ssh.ParsePublicKey(a.NewKey)
+	if err != nil {
+		return "", err
+	}
+
+	fingerprint := internal.FingerprintSHA256Hex(newKey)
+
+	announcedLck.Lock()
+	announced[fingerprint] = internal.FingerprintSHA256Hex(serverKey)
+	announcedLck.Unlock()
+
+	return fingerprint, nil
+}
+
+// switchToAnnounced replaces the pin that announced fingerprint with it, the old key is no longer accepted afterwards.
+// Must be called with settings.mu held
+func switchToAnnounced(settings *Settings, fingerprint string) bool {
+	announcedLck.Lock()
+	defer announcedLck.Unlock()
+
+	old, ok := announced[fingerprint]
+	if !ok {
+		return false
+	}
+
+	i := slices.Index(settings.Fingerprints, old)
+	if i == -1 {
+		return false
+	}
+
+	settings.Fingerprints[i] = fingerprint
+	delete(announced, fingerprint)
+
+	if err := saveRotation(settings, old, fingerprint); err != nil {
+		log.Printf("Unable to save new server fingerprint, it will be forgotten after restart: %s", err)
+	}
+
+	return true
+}
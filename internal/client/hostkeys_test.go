@@ -0,0 +1,147 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"golang.org/x/crypto/ssh"
+)
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestParseFingerprints(t *testing.T) {
+	a := strings.Repeat("a", 64)
+	b := strings.Repeat("B", 64)
+
+	fingerprints, err := ParseFingerprints("# pinned keys\n" + a + "\n\n" + b + "," + a + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fingerprints) != 2 || fingerprints[0] != a || fingerprints[1] != strings.ToLower(b) {
+		t.Fatalf("unexpected fingerprints: %v", fingerprints)
+	}
+
+	if fingerprints, err := ParseFingerprints(""); err != nil || len(fingerprints) != 0 {
+		t.Fatalf("empty input should have no fingerprints: %v %v", fingerprints, err)
+	}
+
+	for _, bad := range []string{"abcd", strings.Repeat("z", 64)} {
+		if _, err := ParseFingerprints(bad); err == nil {
+			t.Fatalf("%q should not parse", bad)
+		}
+	}
+}
+
+func TestCheckHostKeyPinned(t *testing.T) {
+	pinned, other := newHostKey(t), newHostKey(t)
+
+	settings := &Settings{Fingerprints: []string{strings.Repeat("0", 64), internal.FingerprintSHA256Hex(pinned)}}
+
+	if err := checkHostKey(settings, pinned); err != nil {
+		t.Fatal("pinned key was refused: ", err)
+	}
+
+	if err := checkHostKey(settings, other); err == nil {
+		t.Fatal("unpinned key was accepted")
+	}
+}
+
+func TestCheckHostKeyTrustOnFirstUse(t *testing.T) {
+	first, second := newHostKey(t), newHostKey(t)
+
+	path := filepath.Join(t.TempDir(), "known_server")
+	settings := &Settings{TrustOnFirstUse: true, FingerprintFile: path}
+
+	if err := checkHostKey(settings, first); err != nil {
+		t.Fatal("first key was refused: ", err)
+	}
+
+	if err := checkHostKey(settings, second); err == nil {
+		t.Fatal("changed key was accepted after first use")
+	}
+
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fingerprints, err := ParseFingerprints(string(saved))
+	if err != nil || len(fingerprints) != 1 || fingerprints[0] != internal.FingerprintSHA256Hex(first) {
+		t.Fatalf("first key was not persisted: %q %v", saved, err)
+	}
+}
+
+func TestCheckHostKeyStrict(t *testing.T) {
+	if err := checkHostKey(&Settings{Strict: true}, newHostKey(t)); err == nil {
+		t.Fatal("strict mode accepted a key with nothing pinned")
+	}
+
+	if err := checkHostKey(&Settings{}, newHostKey(t)); err != nil {
+		t.Fatal("non-strict mode should fail open: ", err)
+	}
+}
+
+func TestHostKeyRotationSurvivesRestart(t *testing.T) {
+	_, oldPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldSigner, err := ssh.NewSignerFromKey(oldPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newKey := newHostKey(t)
+	sessionID := []byte("session")
+
+	sig, err := oldSigner.Sign(rand.Reader, append(append([]byte{}, sessionID...), newKey.Marshal()...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	announcement := ssh.Marshal(internal.HostKeyAnnouncement{NewKey: newKey.Marshal(), Signature: ssh.Marshal(sig)})
+	if _, err := acceptHostKeyAnnouncement(oldSigner.PublicKey(), sessionID, announcement); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old pin is compiled in, so without a fingerprint file the rotation has to be saved elsewhere
+	rotations := filepath.Join(t.TempDir(), "client.rotations")
+	baked := []string{internal.FingerprintSHA256Hex(oldSigner.PublicKey())}
+
+	settings := &Settings{Fingerprints: append([]string{}, baked...), RotationsFile: rotations}
+	if err := checkHostKey(settings, newKey); err != nil {
+		t.Fatal("announced key was refused: ", err)
+	}
+
+	restarted := &Settings{Fingerprints: append([]string{}, baked...), RotationsFile: rotations}
+	if err := loadRotations(restarted); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkHostKey(restarted, newKey); err != nil {
+		t.Fatal("rotated key was refused after restart: ", err)
+	}
+
+	if err := checkHostKey(restarted, oldSigner.PublicKey()); err == nil {
+		t.Fatal("retired key was accepted after restart")
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/NHAS/reverse_ssh/internal/client/keys"
@@ -26,29 +27,59 @@ type HTTPConn struct {
 
 	readBuffer *mux.SyncBuffer
 
+	// Server holds GETs open until it has data, negotiated when the session is opened
+	longPoll bool
+
+	// Requests carry byte offsets so failed ones can be retried, negotiated when the session is opened
+	resume bool
+	// Bytes read from the server, only touched by the read loop
+	received int64
+	// Bytes the server has accepted from us, only touched by the write loop
+	sentOffset int64
+
+	// Small writes are collected and sent in one POST
+	writeLock    sync.Mutex
+	writeWait    *sync.Cond
+	pending      bytes.Buffer
+	writeErr     error
+	flushPending chan struct{}
+
 	// Cache buster for middleware proxies
 	start int
 
 	client *http.Client
 }
 
-func NewHTTPConn(address string, connector func() (net.Conn, error)) (*HTTPConn, error) {
+const (
+	// How long to wait for more writes before sending a POST
+	writeBatchDelay = 2 * time.Millisecond
+	// Writes block once this much is waiting to be sent
+	maxPendingWrites = 64 * 1024
+
+	// How long failed requests of a resumable session are retried for
+	resumeGrace   = 30 * time.Second
+	minRetryDelay = 50 * time.Millisecond
+	maxRetryDelay = 2 * time.Second
+)
+
+func NewHTTPConn(address string, tlsConfig *tls.Config, connector func() (net.Conn, error)) (*HTTPConn, error) {
 
 	result := &HTTPConn{
 		done:       make(chan interface{}),
 		readBuffer: mux.NewSyncBuffer(8096),
 		address:    address,
 		start:      mathrand.Int(),
+
+		flushPending: make(chan struct{}, 1),
 	}
+	result.writeWait = sync.NewCond(&result.writeLock)
 
 	result.client = &http.Client{
 		Transport: &http.Transport{
 			Dial: func(network, addr string) (net.Conn, error) {
 				return connector()
 			},
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
+			TLSClientConfig: tlsConfig,
 		},
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
@@ -62,7 +93,7 @@ func NewHTTPConn(address string, connector func() (net.Conn, error)) (*HTTPConn,
 
 	publicKeyBytes := s.PublicKey().Marshal()
 
-	resp, err := result.client.Head(address + "/push?key=" + hex.EncodeToString(publicKeyBytes))
+	resp, err := result.client.Head(address + "/push?key=" + hex.EncodeToString(publicKeyBytes) + "&mode=longpoll&resume=1")
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to %s/push?key=%s, err: %s", address, hex.EncodeToString(publicKeyBytes), err)
 	}
@@ -74,10 +105,14 @@ func NewHTTPConn(address string, connector func() (net.Conn, error)) (*HTTPConn,
 
 	found := false
 	for _, cookie := range resp.Cookies() {
-		if cookie.Name == "NID" {
+		switch cookie.Name {
+		case "NID":
 			result.ID = cookie.Value
 			found = true
-			break
+		case "MODE":
+			result.longPoll = cookie.Value == "longpoll"
+		case "RESUME":
+			result.resume = cookie.Value == "1"
 		}
 	}
 
@@ -86,6 +121,7 @@ func NewHTTPConn(address string, connector func() (net.Conn, error)) (*HTTPConn,
 	}
 
 	go result.startReadLoop()
+	go result.startWriteLoop()
 
 	return result, nil
 }
@@ -99,28 +135,146 @@ func (c *HTTPConn) startReadLoop() {
 		default:
 		}
 
-		resp, err := c.client.Get(c.address + "/push/" + strconv.Itoa(c.start) + "?id=" + c.ID)
+		err := c.retry(func() error {
+			url := c.address + "/push/" + strconv.Itoa(c.start) + "?id=" + c.ID
+			if c.resume {
+				url += "&ack=" + strconv.FormatInt(c.received, 10)
+			}
+
+			// Cache buster for middleware proxies
+			c.start++
+
+			resp, err := c.client.Get(url)
+			if err != nil {
+				return fmt.Errorf("error getting data: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if c.resume {
+				if err := checkStatus(resp.StatusCode); err != nil {
+					return err
+				}
+			}
+
+			// Whatever arrived before a failure is kept, the server resends from the new acknowledgement
+			n, err := io.Copy(c.readBuffer, resp.Body)
+			c.received += n
+			if err != nil {
+				return fmt.Errorf("error copying data: %w", err)
+			}
+
+			return nil
+		})
 		if err != nil {
-			log.Println("error getting data: ", err)
+			log.Println(err)
 			c.Close()
 			return
 		}
 
-		_, err = io.Copy(c.readBuffer, resp.Body)
+		// Long polls only come back once there is data or the server gave up waiting, so can be reissued immediately
+		if !c.longPoll {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func (c *HTTPConn) startWriteLoop() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.flushPending:
+		}
+
+		// Give interactive sessions a moment to produce more, so keystrokes and their echoes share requests
+		time.Sleep(writeBatchDelay)
+
+		c.writeLock.Lock()
+		data := bytes.Clone(c.pending.Bytes())
+		c.pending.Reset()
+		c.writeWait.Broadcast()
+		c.writeLock.Unlock()
+
+		if len(data) == 0 {
+			continue
+		}
+
+		err := c.retry(func() error {
+			url := c.address + "/push?id=" + c.ID
+			if c.resume {
+				url += "&off=" + strconv.FormatInt(c.sentOffset, 10)
+			}
+
+			resp, err := c.client.Post(url, "application/octet-stream", bytes.NewReader(data))
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+
+			if c.resume {
+				return checkStatus(resp.StatusCode)
+			}
+
+			return nil
+		})
 		if err != nil {
-			log.Println("error copying data: ", err)
+			c.writeLock.Lock()
+			c.writeErr = err
+			c.writeLock.Unlock()
+
 			c.Close()
 			return
 		}
 
-		resp.Body.Close()
+		c.sentOffset += int64(len(data))
+	}
+}
+
+// retry runs a request until it works. Sessions that cant resume give up straight away, others keep trying for resumeGrace
+func (c *HTTPConn) retry(request func() error) error {
+	var (
+		firstFailure time.Time
+		delay        = minRetryDelay
+	)
+
+	for {
+		err := request()
+		if err == nil {
+			return nil
+		}
+
+		if !c.resume || errors.Is(err, errSessionGone) {
+			return err
+		}
+
+		if firstFailure.IsZero() {
+			firstFailure = time.Now()
+		} else if time.Since(firstFailure) > resumeGrace {
+			return fmt.Errorf("gave up resuming after %s: %w", resumeGrace, err)
+		}
+
+		select {
+		case <-c.done:
+			return io.EOF
+		case <-time.After(delay):
+		}
 
-		// Cache buster for middleware proxies
-		c.start++
+		delay = min(delay*2, maxRetryDelay)
+	}
+}
 
-		time.Sleep(10 * time.Millisecond)
+// Returned when the server no longer has the session, or cant continue it, so retrying is pointless
+var errSessionGone = errors.New("server refused the polling session")
 
+func checkStatus(code int) error {
+	switch {
+	case code >= 200 && code < 300:
+		return nil
+	case code >= 400 && code < 500:
+		return fmt.Errorf("%w: %d", errSessionGone, code)
 	}
+
+	return fmt.Errorf("server returned %d", code)
 }
 
 func (c *HTTPConn) Read(b []byte) (n int, err error) {
@@ -135,26 +289,49 @@ func (c *HTTPConn) Read(b []byte) (n int, err error) {
 	return
 }
 
-func (c *HTTPConn) Write(b []byte) (n int, err error) {
+func (c *HTTPConn) isClosed() bool {
 	select {
 	case <-c.done:
-		return 0, io.EOF
+		return true
 	default:
+		return false
 	}
+}
 
-	resp, err := c.client.Post(c.address+"/push?id="+c.ID, "application/octet-stream", bytes.NewBuffer(b))
-	if err != nil {
-		c.Close()
-		return 0, err
+// Write queues b to be sent by the write loop, errors from sending are returned by later writes
+func (c *HTTPConn) Write(b []byte) (n int, err error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	for c.pending.Len() >= maxPendingWrites && c.writeErr == nil && !c.isClosed() {
+		c.writeWait.Wait()
+	}
+
+	if c.writeErr != nil {
+		return 0, c.writeErr
+	}
+
+	if c.isClosed() {
+		return 0, io.EOF
+	}
+
+	c.pending.Write(b)
+
+	select {
+	case c.flushPending <- struct{}{}:
+	default:
 	}
-	resp.Body.Close()
 
 	return len(b), nil
 }
+
 func (c *HTTPConn) Close() error {
 
 	c.readBuffer.Close()
 
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
 	select {
 	case <-c.done:
 		return nil
@@ -162,6 +339,8 @@ func (c *HTTPConn) Close() error {
 		close(c.done)
 	}
 
+	c.writeWait.Broadcast()
+
 	return nil
 }
 
@@ -12,6 +12,9 @@ import (
 //go:embed private_key
 var privateKey string
 
+// Optional OpenSSH certificate for privateKey, presented instead of the raw key when set
+var certificate *ssh.Certificate
+
 func GetPrivateKey() (ssh.Signer, error) {
 	sshPriv, err := ssh.ParsePrivateKey([]byte(privateKey))
 	if err != nil {
@@ -27,6 +30,10 @@ func GetPrivateKey() (ssh.Signer, error) {
 		}
 	}
 
+	if certificate != nil {
+		return ssh.NewCertSigner(certificate, sshPriv)
+	}
+
 	return sshPriv, nil
 }
 
@@ -40,6 +47,30 @@ func SetPrivateKey(key string) error {
 	return nil
 }
 
+func SetCertificate(cert string) error {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(cert))
+	if err != nil {
+		return fmt.Errorf("certificate invalid: %w", err)
+	}
+
+	c, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return fmt.Errorf("not a certificate, got %s key", pub.Type())
+	}
+
+	priv, err := ssh.ParsePrivateKey([]byte(privateKey))
+	if err != nil {
+		return fmt.Errorf("private key invalid: %w", err)
+	}
+
+	if string(c.Key.Marshal()) != string(priv.PublicKey().Marshal()) {
+		return fmt.Errorf("certificate was not issued for the current private key")
+	}
+
+	certificate = c
+	return nil
+}
+
 func AuthorisedKeysLine() (string, error) {
 	priv, err := ssh.ParsePrivateKey([]byte(privateKey))
 	if err != nil {
@@ -0,0 +1,216 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+// reconfigure checks everything the server sent before changing anything, so one bad value leaves the client as it was. It returns a summary of what changed for the server to show
+func (s *Settings) reconfigure(r internal.Reconfiguration, pool *destinationPool) (string, error) {
+	var (
+		changed []string
+		err     error
+
+		destinations []Destination
+		proxy, sni   string
+		keepalive    time.Duration
+		retryMin     time.Duration
+		retryMax     time.Duration
+		urgency      logger.Urgency
+	)
+
+	if r.Destinations != "" {
+		destinations, err = ParseDestinations(r.Destinations)
+		if err != nil {
+			return "", err
+		}
+
+		if len(destinations) == 0 {
+			return "", errors.New("no destinations given")
+		}
+
+		for _, d := range destinations {
+			if strings.HasPrefix(d.Addr, "stdio://") {
+				return "", errors.New("cannot switch to a stdio destination")
+			}
+		}
+
+		changed = append(changed, "destinations")
+	}
+
+	if r.Proxy != "" && r.Proxy != "none" {
+		proxy, err = GetProxyDetails(r.Proxy)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if r.Proxy != "" {
+		changed = append(changed, "proxy")
+	}
+
+	if r.SNI != "" {
+		if r.SNI != "none" {
+			sni = r.SNI
+		}
+
+		changed = append(changed, "sni")
+	}
+
+	if r.Keepalive != "" {
+		keepalive, err = time.ParseDuration(r.Keepalive)
+		if err != nil || keepalive < 0 {
+			return "", fmt.Errorf("keepalive %q is not a duration, e.g 30s", r.Keepalive)
+		}
+
+		changed = append(changed, "keepalive")
+	}
+
+	for _, setting := range []struct {
+		name  string
+		value string
+		d     *time.Duration
+	}{{"retry-min", r.RetryMin, &retryMin}, {"retry-max", r.RetryMax, &retryMax}} {
+		if setting.value == "" {
+			continue
+		}
+
+		*setting.d, err = time.ParseDuration(setting.value)
+		if err != nil || *setting.d <= 0 {
+			return "", fmt.Errorf("%s %q is not a duration, e.g 30s", setting.name, setting.value)
+		}
+
+		changed = append(changed, setting.name)
+	}
+
+	if r.LogLevel != "" {
+		urgency, err = logger.StrToUrgency(r.LogLevel)
+		if err != nil {
+			return "", fmt.Errorf("invalid log level %q", r.LogLevel)
+		}
+
+		changed = append(changed, "log-level")
+	}
+
+	if r.Persist && s.DestinationFile == "" {
+		return "", errors.New("cannot persist, the client was not started with --destination-file")
+	}
+
+	s.mu.Lock()
+	if destinations != nil {
+		s.Destinations = destinations
+	}
+
+	if r.Proxy != "" {
+		s.ProxyAddr = proxy
+	}
+
+	if r.SNI != "" {
+		s.SNI = sni
+	}
+
+	if r.Keepalive != "" {
+		s.Keepalive = keepalive
+	}
+
+	if r.RetryMin != "" {
+		s.RetryMin = retryMin
+	}
+
+	if r.RetryMax != "" {
+		s.RetryMax = retryMax
+	}
+
+	current := s.Destinations
+	retryMin, retryMax = s.RetryMin, s.RetryMax
+	s.mu.Unlock()
+
+	if r.LogLevel != "" {
+		logger.SetLogLevel(urgency)
+	}
+
+	pool.update(s.destinations(), retryMin, retryMax)
+
+	summary := "no changes"
+	if len(changed) > 0 {
+		summary = "changed " + strings.Join(changed, ", ")
+	}
+
+	if r.Persist {
+		if err := saveDestinations(s.DestinationFile, current); err != nil {
+			// The new settings are in use, so this is reported rather than refusing the request
+			return summary + ", but could not save destinations: " + err.Error(), nil
+		}
+
+		summary += ", saved destinations to " + s.DestinationFile
+	}
+
+	return summary, nil
+}
+
+func saveDestinations(path string, destinations []Destination) error {
+	var lines []string
+	for _, d := range destinations {
+		lines = append(lines, d.String())
+	}
+
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
+
+func (s *Settings) keepaliveInterval() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.Keepalive
+}
+
+// keepalive sends requests to the server at the interval from the settings, so proxies and NAT dont drop a quiet connection, and a server that stops answering is noticed
+func keepalive(conn ssh.Conn, settings *Settings, done <-chan struct{}) {
+	for {
+		interval := settings.keepaliveInterval()
+
+		wait := interval
+		if wait <= 0 {
+			// Turned off, but check again in a while as the server may turn it on
+			wait = 10 * time.Second
+		}
+
+		select {
+		case <-done:
+			return
+		case <-time.After(wait):
+		}
+
+		if interval <= 0 {
+			continue
+		}
+
+		reply := make(chan error, 1)
+		go func() {
+			// The server refuses requests it doesnt know, which is still an answer
+			_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+
+		select {
+		case <-done:
+			return
+		case err := <-reply:
+			if err != nil {
+				return
+			}
+		case <-time.After(interval):
+			log.Println("Server did not answer a keepalive within", interval, "disconnecting")
+			conn.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+)
+
+func TestReconfigure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "destinations")
+
+	settings := &Settings{
+		Destinations:    []Destination{{Addr: "old.example:22"}, {Addr: "backup.example:22"}},
+		DestinationFile: path,
+		ProxyAddr:       "http://10.0.0.1:3128",
+	}
+
+	pool := newDestinationPool(settings.destinations(), 0, 0)
+	backup := pool.destinations[1]
+	pool.failed(backup)
+
+	// A bad value anywhere means nothing is changed
+	if _, err := settings.reconfigure(internal.Reconfiguration{Destinations: "new.example:22", RetryMin: "soon"}, pool); err == nil {
+		t.Fatal("invalid retry minimum was accepted")
+	}
+
+	if settings.Destinations[0].Addr != "old.example:22" {
+		t.Fatal("destinations were changed by a refused reconfiguration")
+	}
+
+	_, err := settings.reconfigure(internal.Reconfiguration{
+		Destinations: "new.example:22,backup.example:22",
+		Keepalive:    "30s",
+		Persist:      true,
+	}, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if settings.Keepalive != 30*time.Second {
+		t.Fatalf("keepalive was not applied: %s", settings.Keepalive)
+	}
+
+	if d := pool.next(); d.Addr != "new.example:22" {
+		t.Fatalf("expected the new destination to be tried first, got %s", d.Addr)
+	}
+
+	if pool.destinations[1] != backup || backup.failures != 1 {
+		t.Fatal("an unchanged destination lost its backoff")
+	}
+
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(saved) != "new.example:22\nbackup.example:22\n" {
+		t.Fatalf("unexpected saved destinations %q", saved)
+	}
+
+	if _, err := settings.reconfigure(internal.Reconfiguration{Proxy: "none"}, pool); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := pool.next(); settings.ProxyAddr != "" || d.ProxyAddr != "" {
+		t.Fatalf("proxy was not removed: %q %q", settings.ProxyAddr, d.ProxyAddr)
+	}
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/NHAS/reverse_ssh/internal"
+)
+
+// AddTLSRootCAs trusts the PEM encoded certificates when verifying the server, in addition to the system roots
+func (s *Settings) AddTLSRootCAs(pemCerts []byte) error {
+	found := false
+	for len(pemCerts) > 0 {
+		var block *pem.Block
+		block, pemCerts = pem.Decode(pemCerts)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+
+		s.tlsRootCAs = append(s.tlsRootCAs, cert)
+		found = true
+	}
+
+	if !found {
+		return errors.New("no certificates found")
+	}
+
+	return nil
+}
+
+// SetTLSClientCertificate takes a PEM bundle containing both the certificate and its private key
+func (s *Settings) SetTLSClientCertificate(pemBundle []byte) error {
+	cert, err := tls.X509KeyPair(pemBundle, pemBundle)
+	if err != nil {
+		return err
+	}
+
+	s.tlsClientCert = &cert
+
+	return nil
+}
+
+func (s *Settings) tlsConfig(serverName string) *tls.Config {
+	config := &tls.Config{
+		// Verification is done in VerifyConnection, as pinning needs to work for certificates that wont chain to anything
+		InsecureSkipVerify: true,
+		ServerName:         serverName,
+	}
+
+	if s.tlsClientCert != nil {
+		config.Certificates = []tls.Certificate{*s.tlsClientCert}
+	}
+
+	if !s.TLSVerify && len(s.TLSPins) == 0 {
+		return config
+	}
+
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("server did not present a certificate")
+		}
+
+		if s.TLSVerify {
+			roots, err := x509.SystemCertPool()
+			if err != nil || roots == nil {
+				roots = x509.NewCertPool()
+			}
+
+			for _, ca := range s.tlsRootCAs {
+				roots.AddCert(ca)
+			}
+
+			intermediates := x509.NewCertPool()
+			for _, cert := range cs.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+
+			_, err = cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+				DNSName:       cs.ServerName,
+				Roots:         roots,
+				Intermediates: intermediates,
+			})
+			if err != nil {
+				return fmt.Errorf("tls verification failed: %w", err)
+			}
+		}
+
+		if len(s.TLSPins) > 0 {
+			for _, cert := range cs.PeerCertificates {
+				if slices.Contains(s.TLSPins, internal.TLSPublicKeyPinHex(cert)) {
+					return nil
+				}
+			}
+
+			return fmt.Errorf("no certificate presented by the server matched the pinned keys, leaf was: %s", internal.TLSPublicKeyPinHex(cs.PeerCertificates[0]))
+		}
+
+		return nil
+	}
+
+	return config
+}
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/NHAS/reverse_ssh/internal"
+)
+
+func handshake(t *testing.T, addr string, config *tls.Config) error {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+func TestTLSConfig(t *testing.T) {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	addr := ts.Listener.Addr().String()
+	pin := internal.TLSPublicKeyPinHex(ts.Certificate())
+
+	if err := handshake(t, addr, (&Settings{}).tlsConfig("127.0.0.1")); err != nil {
+		t.Fatal("unverified tls should accept any certificate: ", err)
+	}
+
+	if err := handshake(t, addr, (&Settings{TLSPins: []string{pin}}).tlsConfig("127.0.0.1")); err != nil {
+		t.Fatal("pinned key was refused: ", err)
+	}
+
+	if err := handshake(t, addr, (&Settings{TLSPins: []string{strings.Repeat("0", 64)}}).tlsConfig("127.0.0.1")); err == nil {
+		t.Fatal("certificate not matching the pin was accepted")
+	}
+
+	if err := handshake(t, addr, (&Settings{TLSVerify: true}).tlsConfig("127.0.0.1")); err == nil {
+		t.Fatal("untrusted certificate was accepted when verifying")
+	}
+
+	settings := &Settings{TLSVerify: true}
+	if err := settings.AddTLSRootCAs(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := handshake(t, addr, settings.tlsConfig("127.0.0.1")); err != nil {
+		t.Fatal("certificate signed by an added ca was refused: ", err)
+	}
+}
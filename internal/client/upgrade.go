@@ -0,0 +1,111 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+// upgrade receives a new executable from the server, swaps it in for the running one and restarts with the same arguments
+func upgrade(settings *Settings, sshConn ssh.Conn) func(newChannel ssh.NewChannel, l logger.Logger) {
+	return func(newChannel ssh.NewChannel, l logger.Logger) {
+		if settings.Argv == "" {
+			newChannel.Reject(ssh.Prohibited, "client is not running as an executable, so cannot upgrade")
+			return
+		}
+
+		var u internal.Upgrade
+		if err := ssh.Unmarshal(newChannel.ExtraData(), &u); err != nil {
+			newChannel.Reject(ssh.Prohibited, "malformed upgrade: "+err.Error())
+			return
+		}
+
+		path, err := os.Executable()
+		if err == nil {
+			path, err = filepath.EvalSymlinks(path)
+		}
+
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, "cannot find own executable: "+err.Error())
+			return
+		}
+
+		c, reqs, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+
+		if err := replaceExecutable(path, c, u); err != nil {
+			l.Warning("Upgrade failed: %s", err)
+			c.Write([]byte(err.Error()))
+			c.Close()
+			return
+		}
+
+		c.Write([]byte(internal.UpgradeOK))
+		c.Close()
+		sshConn.Close()
+
+		l.Info("Upgraded to version %q, restarting", u.Version)
+
+		if err := restart(path, settings.Argv); err != nil {
+			// The executable has already been replaced, so the next start will be the new version. Until then the
+			// connection closed above makes Run reconnect, keeping the client reachable on the old version
+			l.Error("Unable to restart after upgrading, carrying on with the old version: %s", err)
+		}
+	}
+}
+
+// replaceExecutable writes the new executable next to path, so it can be renamed over it once its size and hash check out
+func replaceExecutable(path string, r io.Reader, u internal.Upgrade) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return fmt.Errorf("cannot write next to executable: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(r, int64(u.Size)+1))
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	if uint64(n) != u.Size {
+		return fmt.Errorf("expected %d bytes, got %d", u.Size, n)
+	}
+
+	if hash := hex.EncodeToString(h.Sum(nil)); hash != u.Hash {
+		return fmt.Errorf("hash %s did not match expected %s", hash, u.Hash)
+	}
+
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()|0700); err != nil {
+		return err
+	}
+
+	return swapExecutable(tmp.Name(), path)
+}
+
+// restartArgs is what the restarted process shows as its arguments, main quotes the program name while parsing them
+func restartArgs() []string {
+	args := append([]string{}, os.Args...)
+	if unquoted, err := strconv.Unquote(args[0]); err == nil {
+		args[0] = unquoted
+	}
+
+	return args
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package client
+
+import (
+	"os"
+	"syscall"
+)
+
+func swapExecutable(newPath, path string) error {
+	return os.Rename(newPath, path)
+}
+
+// restart replaces this process, passing argv the same way a forked child gets it so the new one doesnt fork again
+func restart(path, argv string) error {
+	return syscall.Exec(path, restartArgs(), append(os.Environ(), "F="+argv))
+}
@@ -0,0 +1,51 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/NHAS/reverse_ssh/internal"
+)
+
+func TestReplaceExecutable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client")
+	if err := os.WriteFile(path, []byte("old"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	replacement := []byte("new executable")
+	hash := sha256.Sum256(replacement)
+	u := internal.Upgrade{Size: uint64(len(replacement)), Hash: hex.EncodeToString(hash[:])}
+
+	if err := replaceExecutable(path, bytes.NewReader(replacement[:5]), u); err == nil {
+		t.Fatal("truncated executable was accepted")
+	}
+
+	tampered := append([]byte{}, replacement...)
+	tampered[0] = 'N'
+	if err := replaceExecutable(path, bytes.NewReader(tampered), u); err == nil {
+		t.Fatal("executable with the wrong hash was accepted")
+	}
+
+	if current, _ := os.ReadFile(path); string(current) != "old" {
+		t.Fatalf("failed upgrade changed the executable: %q", current)
+	}
+
+	if err := replaceExecutable(path, bytes.NewReader(replacement), u); err != nil {
+		t.Fatal(err)
+	}
+
+	if current, _ := os.ReadFile(path); !bytes.Equal(current, replacement) {
+		t.Fatalf("executable was not replaced: %q", current)
+	}
+
+	// Windows keeps the replaced executable as .old, as it may still be running
+	os.Remove(path + ".old")
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Fatalf("temporary files were left behind: %v", entries)
+	}
+}
@@ -0,0 +1,50 @@
+//go:build windows
+
+package client
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// swapExecutable moves the running executable aside first, as windows wont replace a file that is in use but will rename it
+func swapExecutable(newPath, path string) error {
+	old := path + ".old"
+
+	// Left behind by the last upgrade, which is no longer running
+	os.Remove(old)
+
+	if err := os.Rename(path, old); err != nil {
+		return err
+	}
+
+	if err := os.Rename(newPath, path); err != nil {
+		os.Rename(old, path)
+		return err
+	}
+
+	return nil
+}
+
+// restart starts the new executable detached, passing argv the same way a forked child gets it, then exits
+func restart(path, argv string) error {
+	cmd := exec.Command(path)
+	cmd.Args = restartArgs()
+	cmd.Env = append(os.Environ(), "F="+argv)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		HideWindow:    true,
+		CreationFlags: windows.CREATE_NEW_PROCESS_GROUP | windows.DETACHED_PROCESS,
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	cmd.Process.Release()
+	os.Exit(0)
+
+	return nil
+}
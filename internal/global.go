@@ -12,6 +12,8 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"slices"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -30,6 +32,63 @@ type RemoteForwardRequest struct {
 	BindPort uint32
 }
 
+// Sent by the server with hostkey-rotate-rssh@golang.org to tell clients which key it will switch to
+type HostKeyAnnouncement struct {
+	// Wire format public key
+	NewKey     []byte
+	ActivateAt uint64
+	// Signature by the current host key over the session id followed by NewKey, so it cannot be replayed to other sessions
+	Signature []byte
+}
+
+// Sent by the server with reconfigure-rssh@golang.org to change how a client calls back, empty fields leave that setting as it is
+type Reconfiguration struct {
+	// Comma separated, in the same form as the clients -d
+	Destinations string
+	// "none" removes the setting
+	Proxy string
+	SNI   string
+	// Durations, e.g 30s, a keepalive of 0 stops them
+	Keepalive string
+	RetryMin  string
+	RetryMax  string
+	LogLevel  string
+	// Save the new destinations to the file they were read from
+	Persist bool
+}
+
+// Sent by the server when opening an rssh-upgrade channel, the new executable follows on the channel.
+// The client answers with UpgradeOK before restarting, or with why it could not upgrade
+type Upgrade struct {
+	Size uint64
+	// Hex sha256 of the executable
+	Hash    string
+	Version string
+}
+
+const UpgradeOK = "ok"
+
+// Longest wait a server can ask for with retry-after-rssh@golang.org, so a bad value cant strand a client for good
+const MaxRetryAfter = 24 * time.Hour
+
+// Sent by clients with capabilities-rssh@golang.org straight after connecting, so the server can tell what a client supports before asking it
+type Capabilities struct {
+	Version string
+	// runtime.GOOS and runtime.GOARCH, e.g linux_amd64
+	Platform string
+	// Channels the server can open on the client connection
+	Channels       []string
+	GlobalRequests []string
+	// Channels users can open through the clients jump host, tun@openssh.com among them if the client supports TUN
+	JumpChannels []string
+	Subsystems   []string
+}
+
+// Supports reports whether the client handles the global request or channel type
+func (c Capabilities) Supports(name string) bool {
+	return slices.Contains(c.GlobalRequests, name) || slices.Contains(c.Channels, name)
+}
+
 func (r *RemoteForwardRequest) String() string {
 	return net.JoinHostPort(r.BindAddr, fmt.Sprintf("%d", r.BindPort))
 }
@@ -76,6 +135,12 @@ func FingerprintSHA256Hex(pubKey ssh.PublicKey) string {
 	return fingerPrint
 }
 
+// TLSPublicKeyPinHex hashes the certificates public key rather than the certificate, so the pin survives reissuing with the same key
+func TLSPublicKeyPinHex(cert *x509.Certificate) string {
+	shasum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(shasum[:])
+}
+
 func SendRequest(req ssh.Request, sshChan ssh.Channel) (bool, error) {
 	return sshChan.SendRequest(req.Type, req.WantReply, req.Payload)
 }
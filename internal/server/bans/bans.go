@@ -0,0 +1,238 @@
+package bans
+
+import (
+	"net"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/observers"
+)
+
+var (
+	// Number of failed authentications from a single IP within Window before it is banned, 0 disables banning
+	Threshold = 10
+	Window    = 5 * time.Minute
+	Duration  = 30 * time.Minute
+)
+
+type failures struct {
+	attempts  []time.Time
+	usernames map[string]int
+}
+
+type Ban struct {
+	IP        string
+	Usernames []string
+	Failures  int
+	Since     time.Time
+	Until     time.Time
+}
+
+var (
+	lck sync.Mutex
+
+	// ip to recent failures
+	tracked = map[string]*failures{}
+	banned  = map[string]Ban{}
+)
+
+// Non-threadsafe, must hold lock
+func _prune(f *failures, now time.Time) {
+	i := 0
+	for ; i < len(f.attempts); i++ {
+		if now.Sub(f.attempts[i]) < Window {
+			break
+		}
+	}
+
+	f.attempts = f.attempts[i:]
+}
+
+// RecordFailure notes a failed authentication, returns true if this failure caused the ip to be banned
+func RecordFailure(ip net.IP, username string) bool {
+	if Threshold <= 0 || ip == nil {
+		return false
+	}
+
+	lck.Lock()
+
+	now := time.Now()
+	key := ip.String()
+
+	if b, ok := banned[key]; ok && now.Before(b.Until) {
+		lck.Unlock()
+		return false
+	}
+
+	f, ok := tracked[key]
+	if !ok {
+		f = &failures{usernames: map[string]int{}}
+		tracked[key] = f
+	}
+
+	_prune(f, now)
+
+	f.attempts = append(f.attempts, now)
+	f.usernames[username]++
+
+	if len(f.attempts) < Threshold {
+		lck.Unlock()
+		return false
+	}
+
+	ban := Ban{
+		IP:       key,
+		Failures: len(f.attempts),
+		Since:    now,
+		Until:    now.Add(Duration),
+	}
+
+	for u := range f.usernames {
+		ban.Usernames = append(ban.Usernames, u)
+	}
+	sort.Strings(ban.Usernames)
+
+	banned[key] = ban
+	delete(tracked, key)
+
+	event := observers.BanEvent{
+		IP:        ban.IP,
+		Usernames: ban.Usernames,
+		Failures:  ban.Failures,
+		Until:     ban.Until,
+		Timestamp: now,
+	}
+	lck.Unlock()
+
+	// Observers may call back into this package, so they are notified once the lock is released
+	observers.Bans.Notify(event)
+
+	return true
+}
+
+// sweep drops ips whose failures have all left the window and bans that have ended, otherwise failures spread thinly over
+// many ips would be tracked forever
+func sweep(now time.Time) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	for ip, f := range tracked {
+		_prune(f, now)
+		if len(f.attempts) == 0 {
+			delete(tracked, ip)
+		}
+	}
+
+	for ip, b := range banned {
+		if now.After(b.Until) {
+			delete(banned, ip)
+		}
+	}
+}
+
+// Start periodically sweeps expired failures and bans
+func Start() {
+	for range time.Tick(time.Minute) {
+		sweep(time.Now())
+	}
+}
+
+// RecordSuccess clears the failure history of an ip, so a user cycling through several keys isnt banned over time
+func RecordSuccess(ip net.IP) {
+	if ip == nil {
+		return
+	}
+
+	lck.Lock()
+	defer lck.Unlock()
+
+	delete(tracked, ip.String())
+}
+
+func IsBanned(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	lck.Lock()
+	defer lck.Unlock()
+
+	key := ip.String()
+	b, ok := banned[key]
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(b.Until) {
+		delete(banned, key)
+		return false
+	}
+
+	return true
+}
+
+// IsBannedAddr is IsBanned for a net.Addr, anything that isnt an ip based address is never banned
+func IsBannedAddr(addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return IsBanned(a.IP)
+	case *net.UDPAddr:
+		return IsBanned(a.IP)
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+
+	return IsBanned(net.ParseIP(host))
+}
+
+// List returns all active bans sorted by ip
+func List() []Ban {
+	lck.Lock()
+	defer lck.Unlock()
+
+	now := time.Now()
+
+	var out []Ban
+	for ip, b := range banned {
+		if now.After(b.Until) {
+			delete(banned, ip)
+			continue
+		}
+
+		out = append(out, b)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].IP < out[j].IP
+	})
+
+	return out
+}
+
+// Clear removes bans matching the glob pattern, returning the ips that were unbanned
+func Clear(pattern string) ([]string, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	lck.Lock()
+	defer lck.Unlock()
+
+	var cleared []string
+	for ip := range banned {
+		if match, _ := filepath.Match(pattern, ip); match {
+			delete(banned, ip)
+			delete(tracked, ip)
+			cleared = append(cleared, ip)
+		}
+	}
+
+	sort.Strings(cleared)
+
+	return cleared, nil
+}
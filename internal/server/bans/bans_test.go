@@ -0,0 +1,60 @@
+package bans
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBanAfterThreshold(t *testing.T) {
+	Threshold, Window, Duration = 3, time.Minute, time.Minute
+
+	ip := net.ParseIP("192.0.2.1")
+
+	RecordFailure(ip, "root")
+	RecordFailure(ip, "admin")
+	RecordSuccess(ip)
+
+	if RecordFailure(ip, "root") || RecordFailure(ip, "root") {
+		t.Fatal("success should have reset the failure count")
+	}
+
+	if !RecordFailure(ip, "test") {
+		t.Fatal("expected ip to be banned on the third failure")
+	}
+
+	if !IsBannedAddr(&net.TCPAddr{IP: ip, Port: 2222}) {
+		t.Fatal("expected address to be banned")
+	}
+
+	if IsBanned(net.ParseIP("192.0.2.2")) {
+		t.Fatal("unrelated ip should not be banned")
+	}
+
+	l := List()
+	if len(l) != 1 || len(l[0].Usernames) != 2 {
+		t.Fatalf("unexpected ban list %+v", l)
+	}
+
+	if cleared, _ := Clear("192.0.2.*"); len(cleared) != 1 || IsBanned(ip) {
+		t.Fatal("expected ban to be lifted")
+	}
+}
+
+func TestSweepExpiredFailures(t *testing.T) {
+	Threshold, Window, Duration = 3, time.Minute, time.Minute
+
+	for i := range 100 {
+		RecordFailure(net.IPv4(198, 51, 100, byte(i)), "root")
+	}
+
+	sweep(time.Now())
+	if len(tracked) != 100 {
+		t.Fatalf("failures still within the window were swept, %d left", len(tracked))
+	}
+
+	sweep(time.Now().Add(Window))
+	if len(tracked) != 0 {
+		t.Fatalf("expected failures outside the window to be swept, %d left", len(tracked))
+	}
+}
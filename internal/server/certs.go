@@ -0,0 +1,130 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"golang.org/x/crypto/ssh"
+)
+
+// CheckCertificate validates an OpenSSH user certificate against the certificate authorities listed in caKeysPath.
+// Returns ErrKeyNotInList if the key is not a certificate, or was not signed by a listed authority, so the caller can fall through to other methods.
+// Validity windows, principals and the source-address critical option are enforced by ssh.CertChecker.
+func CheckCertificate(caKeysPath string, conn ssh.ConnMetadata, publicKey ssh.PublicKey, src net.IP) (*ssh.Permissions, Options, error) {
+	cert, ok := publicKey.(*ssh.Certificate)
+	if !ok {
+		return nil, Options{}, ErrKeyNotInList
+	}
+
+	authorities, err := readPubKeys(caKeysPath)
+	if err != nil {
+		return nil, Options{}, ErrKeyNotInList
+	}
+
+	opt, ok := authorities[string(ssh.MarshalAuthorizedKey(cert.SignatureKey))]
+	if !ok {
+		return nil, Options{}, ErrKeyNotInList
+	}
+
+	checker := ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			_, ok := authorities[string(ssh.MarshalAuthorizedKey(auth))]
+			return ok
+		},
+	}
+
+	if _, err := checker.Authenticate(conn, cert); err != nil {
+		return nil, Options{}, fmt.Errorf("certificate %s rejected: %s", strconv.QuoteToGraphic(cert.KeyId), err)
+	}
+
+	for _, deny := range opt.DenyList {
+		if deny.Contains(src) {
+			return nil, Options{}, errors.New("not authorized ip on certificate authority deny list")
+		}
+	}
+
+	safe := len(opt.AllowList) == 0
+	for _, allow := range opt.AllowList {
+		if allow.Contains(src) {
+			safe = true
+			break
+		}
+	}
+
+	if !safe {
+		return nil, Options{}, errors.New("not authorized not on certificate authority allow list")
+	}
+
+	comment := cert.KeyId
+	if comment == "" {
+		comment = opt.Comment
+	}
+
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			"comment":   comment,
+			"pubkey-fp": internal.FingerprintSHA1Hex(cert.Key),
+			"owners":    strings.Join(opt.Owners, ","),
+		},
+	}, opt, nil
+}
+
+// checkUserCertificate maps an operator certificate to an rssh user, the login name must be one of the certificates principals
+func checkUserCertificate(caKeysPath string, conn ssh.ConnMetadata, publicKey ssh.PublicKey, src net.IP) (*ssh.Permissions, error) {
+	perms, opt, err := CheckCertificate(caKeysPath, conn, publicKey, src)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only checked once a user authority signed it, so certificates from other authorities still fall through
+	cert := publicKey.(*ssh.Certificate)
+	if len(cert.ValidPrincipals) == 0 {
+		// Unlike clients, a certificate with no principals would let the holder log in as anyone
+		return nil, fmt.Errorf("certificate %s has no principals", strconv.QuoteToGraphic(cert.KeyId))
+	}
+
+	perms.Extensions["type"] = "user"
+	perms.Extensions["privilege"] = "0"
+
+	for _, principal := range cert.ValidPrincipals {
+		if slices.Contains(opt.AdminPrincipals, principal) {
+			perms.Extensions["privilege"] = "5"
+			break
+		}
+	}
+
+	return perms, nil
+}
+
+// IsTrustedCertificate checks a certificate was signed by an authority in caKeysPath and is currently valid, without a connection to check principals against.
+// Used to gate HTTP polling sessions, the full check still happens during the ssh handshake
+func IsTrustedCertificate(caKeysPath string, publicKey ssh.PublicKey) bool {
+	cert, ok := publicKey.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.UserCert {
+		return false
+	}
+
+	authorities, err := readPubKeys(caKeysPath)
+	if err != nil {
+		return false
+	}
+
+	checker := ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			_, ok := authorities[string(ssh.MarshalAuthorizedKey(auth))]
+			return ok
+		},
+	}
+
+	principal := ""
+	if len(cert.ValidPrincipals) > 0 {
+		principal = cert.ValidPrincipals[0]
+	}
+
+	return checker.CheckCert(principal, cert) == nil
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type fakeConn struct {
+	ssh.ConnMetadata
+	user string
+}
+
+func (f fakeConn) User() string {
+	return f.user
+}
+
+func (f fakeConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 2222}
+}
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func newCert(t *testing.T, ca ssh.Signer, validFor time.Duration, principals ...string) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             newSigner(t).PublicKey(),
+		KeyId:           "test",
+		CertType:        ssh.UserCert,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(time.Now().Add(validFor).Unix()),
+	}
+
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func TestUserCertificates(t *testing.T) {
+	ca := newSigner(t)
+
+	caPath := filepath.Join(t.TempDir(), "trusted_user_ca_keys")
+	if err := os.WriteFile(caPath, append([]byte(`admin-principals="ops" `), ssh.MarshalAuthorizedKey(ca.PublicKey())...), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	src := net.ParseIP("192.0.2.1")
+
+	perms, err := checkUserCertificate(caPath, fakeConn{user: "alice"}, newCert(t, ca, time.Hour, "alice", "ops"), src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if perms.Extensions["privilege"] != "5" {
+		t.Fatalf("expected ops principal to map to admin, got privilege %q", perms.Extensions["privilege"])
+	}
+
+	perms, err = checkUserCertificate(caPath, fakeConn{user: "bob"}, newCert(t, ca, time.Hour, "bob"), src)
+	if err != nil || perms.Extensions["privilege"] != "0" {
+		t.Fatalf("expected bob to be a normal user: %v", err)
+	}
+
+	if _, err := checkUserCertificate(caPath, fakeConn{user: "alice"}, newCert(t, ca, time.Hour, "bob"), src); err == nil {
+		t.Fatal("login name outside of the principals should be rejected")
+	}
+
+	if _, err := checkUserCertificate(caPath, fakeConn{user: "alice"}, newCert(t, ca, -time.Second, "alice"), src); err == nil || err == ErrKeyNotInList {
+		t.Fatal("expired certificate should be rejected")
+	}
+
+	if _, err := checkUserCertificate(caPath, fakeConn{user: "alice"}, newCert(t, ca, time.Hour), src); err == nil {
+		t.Fatal("certificate without principals should be rejected for users")
+	}
+
+	if _, err := checkUserCertificate(caPath, fakeConn{user: "alice"}, newCert(t, newSigner(t), time.Hour, "alice"), src); err != ErrKeyNotInList {
+		t.Fatalf("certificate from unknown authority should fall through, got %v", err)
+	}
+
+	if !IsTrustedCertificate(caPath, newCert(t, ca, time.Hour)) {
+		t.Fatal("expected certificate to be trusted for polling")
+	}
+}
+
+func TestControlleeCertificateWithoutPrincipals(t *testing.T) {
+	userCA, controlleeCA := newSigner(t), newSigner(t)
+
+	dir := t.TempDir()
+	userCAPath := filepath.Join(dir, "trusted_user_ca_keys")
+	if err := os.WriteFile(userCAPath, ssh.MarshalAuthorizedKey(userCA.PublicKey()), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	controlleeCAPath := filepath.Join(dir, "trusted_controllee_ca_keys")
+	if err := os.WriteFile(controlleeCAPath, ssh.MarshalAuthorizedKey(controlleeCA.PublicKey()), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	src := net.ParseIP("192.0.2.1")
+	cert := newCert(t, controlleeCA, time.Hour)
+
+	// Clients are checked after users, so the user check must fall through for certificates it did not sign
+	if _, err := checkUserCertificate(userCAPath, fakeConn{user: "anything"}, cert, src); err != ErrKeyNotInList {
+		t.Fatalf("controllee certificate without principals should fall through the user check, got %v", err)
+	}
+
+	if _, _, err := CheckCertificate(controlleeCAPath, fakeConn{user: "anything"}, cert, src); err != nil {
+		t.Fatal("controllee certificate without principals should be accepted for clients: ", err)
+	}
+}
@@ -0,0 +1,94 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/bans"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+)
+
+type bansCommand struct {
+}
+
+func (b *bansCommand) ValidArgs() map[string]string {
+	r := map[string]string{}
+
+	addDuplicateFlags("Lift bans on ips matching a glob, e.g --clear 10.0.0.*, --clear * (admin only)", r, "c", "clear")
+
+	return r
+}
+
+func (b *bansCommand) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+
+	if line.IsSet("c") || line.IsSet("clear") {
+		if user.Privilege() != users.AdminPermissions {
+			return errors.New("only administrators can lift bans")
+		}
+
+		pattern, err := line.GetArgString("clear")
+		if err != nil {
+			pattern, err = line.GetArgString("c")
+			if err != nil {
+				return err
+			}
+		}
+
+		cleared, err := bans.Clear(pattern)
+		if err != nil {
+			return err
+		}
+
+		if len(cleared) == 0 {
+			return fmt.Errorf("no bans match %q", pattern)
+		}
+
+		fmt.Fprintf(tty, "lifted ban on %s\n", strings.Join(cleared, ", "))
+		return nil
+	}
+
+	active := bans.List()
+	if len(active) == 0 {
+		if bans.Threshold == 0 {
+			fmt.Fprintln(tty, "No IPs are banned, banning is disabled (--ban-threshold 0)")
+			return nil
+		}
+
+		fmt.Fprintln(tty, "No IPs are banned")
+		return nil
+	}
+
+	tab, err := table.NewTable("Banned IPs", "IP", "Failures", "Usernames", "Banned At", "Remaining")
+	if err != nil {
+		return err
+	}
+
+	for _, b := range active {
+		tab.AddValues(b.IP, fmt.Sprintf("%d", b.Failures), strings.Join(b.Usernames, "\n"), b.Since.Format("2006/01/02 15:04:05"), time.Until(b.Until).Round(time.Second).String())
+	}
+
+	tab.Fprint(tty)
+
+	return nil
+}
+
+func (b *bansCommand) Expect(line terminal.ParsedLine) []string {
+	return nil
+}
+
+func (b *bansCommand) Help(explain bool) string {
+	if explain {
+		return "List or lift temporary bans on IPs with repeated failed logins"
+	}
+
+	return terminal.MakeHelpText(b.ValidArgs(),
+		"bans [OPTIONS]",
+		fmt.Sprintf("IPs are banned for %s after %d failed logins within %s, banned IPs are dropped before any protocol is negotiated", bans.Duration, bans.Threshold, bans.Window),
+		"Bans only last until the server is restarted",
+	)
+}
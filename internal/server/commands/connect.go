@@ -6,6 +6,7 @@ import (
 	"sync"
 
 	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/traffic"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/internal/terminal"
 	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
@@ -64,10 +65,14 @@ func (c *connect) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedL
 		return fmt.Errorf("%q matches multiple clients please choose a more specific identifier", client)
 	}
 
-	var target ssh.Conn
+	var (
+		target   ssh.Conn
+		targetId string
+	)
 	//Horrible way of getting the first element of a map in go
 	for k := range foundClients {
 		target = foundClients[k]
+		targetId = k
 		break
 	}
 
@@ -88,7 +93,7 @@ func (c *connect) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedL
 	c.log.Info("Connected to %s", target.RemoteAddr().String())
 
 	term.EnableRaw()
-	err = attachSession(newSession, term, sess.ShellRequests)
+	err = attachSession(newSession, term, sess.ShellRequests, traffic.GetClient(targetId), traffic.Operator(c.user.Username()))
 	if err != nil {
 
 		c.log.Error("Client tried to attach session and failed: %s", err)
@@ -152,7 +157,7 @@ func createSession(sshConn ssh.Conn, ptyReq internal.PtyReq, shell string) (sc s
 	return splice, nil
 }
 
-func attachSession(newSession ssh.Channel, currentClientSession io.ReadWriter, currentClientRequests <-chan *ssh.Request) error {
+func attachSession(newSession ssh.Channel, currentClientSession io.ReadWriter, currentClientRequests <-chan *ssh.Request, clientCounter, operatorCounter *traffic.Counter) error {
 
 	finished := make(chan bool)
 
@@ -169,15 +174,16 @@ func attachSession(newSession ssh.Channel, currentClientSession io.ReadWriter, c
 
 	go func() {
 		//dst <- src
-		io.Copy(newSession, currentClientSession)
+		traffic.Copy(newSession, currentClientSession, traffic.ToClient, clientCounter, operatorCounter)
 		once.Do(close)
 
 	}()
 
 	//newSession being the remote host being controlled
 	go func() {
-		io.Copy(currentClientSession, newSession) // Potentially be more verbose about errors here
-		once.Do(close)                            // Only close the newSession connection once
+		// Potentially be more verbose about errors here
+		traffic.Copy(currentClientSession, newSession, traffic.FromClient, clientCounter, operatorCounter)
+		once.Do(close) // Only close the newSession connection once
 
 	}()
 
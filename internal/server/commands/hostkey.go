@@ -0,0 +1,134 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/hostkeys"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+)
+
+type hostkey struct {
+}
+
+func (h *hostkey) ValidArgs() map[string]string {
+	return map[string]string{
+		"overlap": "How long clients are given to learn the new key before it replaces the current one, e.g 12h, 30d (default 7d)",
+	}
+}
+
+func (h *hostkey) list(tty io.ReadWriter) error {
+	tab, err := table.NewTable("Host Keys", "State", "Fingerprint", "Activates")
+	if err != nil {
+		return err
+	}
+
+	for _, k := range hostkeys.List() {
+		activates := ""
+		if !k.ActivateAt.IsZero() {
+			activates = fmt.Sprintf("%s (in %s)", k.ActivateAt.Format("2006/01/02 15:04:05"), time.Until(k.ActivateAt).Round(time.Minute))
+		}
+
+		tab.AddValues(k.State, k.Fingerprint, activates)
+	}
+
+	tab.Fprint(tty)
+
+	return nil
+}
+
+func (h *hostkey) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+
+	args := line.ArgumentsAsStrings()
+	if len(args) == 0 || args[0] == "list" {
+		return h.list(tty)
+	}
+
+	if user.Privilege() != users.AdminPermissions {
+		return errors.New("only administrators can change the server host key")
+	}
+
+	switch args[0] {
+	case "rotate":
+		overlap := 7 * 24 * time.Hour
+		if o, err := line.GetArgString("overlap"); err == nil {
+			overlap, err = parseLifetime(o)
+			if err != nil {
+				return err
+			}
+		} else if err != terminal.ErrFlagNotSet {
+			return err
+		}
+
+		newKey, err := hostkeys.Rotate(overlap)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(tty, "New host key %s will replace the current key in %s\n", internal.FingerprintSHA256Hex(newKey), overlap)
+
+		// Admins can see every client
+		clients, err := user.SearchClients("")
+		if err != nil {
+			return err
+		}
+
+		accepted := 0
+		for id, c := range clients {
+			ok, err := hostkeys.Announce(c)
+			if err != nil {
+				fmt.Fprintf(tty, "%s: %s\n", id, err)
+				continue
+			}
+
+			if ok {
+				accepted++
+			}
+		}
+
+		fmt.Fprintf(tty, "%d of %d connected clients accepted the new key, clients that connect during the overlap will be told on connection\n", accepted, len(clients))
+
+	case "activate":
+		if err := hostkeys.Activate(); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(tty, "Now using %s, clients that did not learn the new key will be unable to reconnect\n", internal.FingerprintSHA256Hex(hostkeys.Current().PublicKey()))
+
+	case "cancel":
+		if err := hostkeys.Cancel(); err != nil {
+			return err
+		}
+
+		fmt.Fprintln(tty, "Rotation cancelled, clients will continue to accept the current key")
+
+	default:
+		return fmt.Errorf("unknown action %q, expected list, rotate, activate or cancel", args[0])
+	}
+
+	return nil
+}
+
+func (h *hostkey) Expect(line terminal.ParsedLine) []string {
+	return nil
+}
+
+func (h *hostkey) Help(explain bool) string {
+	if explain {
+		return "View and rotate the server host key"
+	}
+
+	return terminal.MakeHelpText(h.ValidArgs(),
+		"hostkey [list|rotate|activate|cancel] [OPTIONS]",
+		"rotate generates a new key and sends it to connected clients, signed by the current key. The current key is still used until the overlap ends",
+		"activate ends the overlap early, cancel discards the new key. Old keys are kept in the datadir as id_ed25519.retired.<time>",
+		"Clients only learn the new key by connecting during the overlap, so pick an overlap longer than your clients go without connecting",
+		"Only one key is presented at a time, so pinned clients that were offline for the whole overlap refuse the new key and must be redeployed",
+		"(or the retired key moved back to id_ed25519 and the server restarted)",
+	)
+}
@@ -26,6 +26,14 @@ var allCommands = map[string]terminal.Command{
 	"autocomplete": &shellAutocomplete{},
 	"log":          &logCommand{},
 	"clear":        &clear{},
+	"traffic":      &trafficCommand{},
+	"throttle":     &throttle{},
+	"reconfigure":  &reconfigure{},
+	"upgrade":      &upgrade{},
+	"bans":         &bansCommand{},
+	"mfa":          &mfaCommand{},
+	"hostkey":      &hostkey{},
+	"tls":          &tlsCommand{},
 }
 
 func CreateCommands(session string, user *users.User, log logger.Logger, datadir string) map[string]terminal.Command {
@@ -48,6 +56,14 @@ func CreateCommands(session string, user *users.User, log logger.Logger, datadir
 		"autocomplete": &shellAutocomplete{},
 		"log":          Log(log),
 		"clear":        &clear{},
+		"traffic":      &trafficCommand{},
+		"throttle":     &throttle{},
+		"reconfigure":  &reconfigure{},
+		"upgrade":      &upgrade{},
+		"bans":         &bansCommand{},
+		"mfa":          MFA(session),
+		"hostkey":      &hostkey{},
+		"tls":          &tlsCommand{},
 	}
 
 	return o
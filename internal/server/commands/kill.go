@@ -4,7 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strconv"
+	"time"
 
+	"github.com/NHAS/reverse_ssh/internal"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/internal/terminal"
 	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
@@ -16,27 +19,63 @@ type kill struct {
 }
 
 func (k *kill) ValidArgs() map[string]string {
-	return map[string]string{"y": "Do not prompt for confirmation before killing clients"}
+	return map[string]string{
+		"y":               "Do not prompt for confirmation before killing clients",
+		"reconnect-after": "Disconnect the clients rather than stopping them, and have them wait this long before reconnecting, e.g 10m (at most 24h)",
+	}
 }
 
 func (k *kill) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
 
-	if len(line.Arguments) != 1 {
+	arguments := line.Arguments
+
+	var reconnectAfter time.Duration
+	if flag, ok := line.Flags["reconnect-after"]; ok {
+		if len(flag.Args) == 0 {
+			return errors.New("--reconnect-after needs a duration, e.g 10m")
+		}
+
+		var err error
+		reconnectAfter, err = time.ParseDuration(flag.Args[0].Value())
+		if err != nil || reconnectAfter < time.Second {
+			return fmt.Errorf("--reconnect-after %q is not a duration of at least 1s, e.g 10m", flag.Args[0].Value())
+		}
+
+		// Clients refuse anything longer, and would reconnect straight away instead
+		if reconnectAfter > internal.MaxRetryAfter {
+			return fmt.Errorf("--reconnect-after %q is longer than clients will wait, at most %s", flag.Args[0].Value(), internal.MaxRetryAfter)
+		}
+
+		// The duration is parsed as an argument as well, so leave it out when finding the filter
+		arguments = nil
+		for _, arg := range line.Arguments {
+			if arg.Start() != flag.Args[0].Start() {
+				arguments = append(arguments, arg)
+			}
+		}
+	}
+
+	if len(arguments) != 1 {
 		return errors.New(k.Help(false))
 	}
 
-	connections, err := user.SearchClients(line.Arguments[0].Value())
+	connections, err := user.SearchClients(arguments[0].Value())
 	if err != nil {
 		return err
 	}
 
 	if len(connections) == 0 {
-		return fmt.Errorf("No clients matched %q", line.Arguments[0].Value())
+		return fmt.Errorf("No clients matched %q", arguments[0].Value())
 	}
 
 	if !line.IsSet("y") {
 
-		fmt.Fprintf(tty, "Kill %d clients? [N/y] ", len(connections))
+		action := "Kill"
+		if reconnectAfter > 0 {
+			action = "Disconnect"
+		}
+
+		fmt.Fprintf(tty, "%s %d clients? [N/y] ", action, len(connections))
 
 		if term, ok := tty.(*terminal.Terminal); ok {
 			term.EnableRaw()
@@ -61,6 +100,27 @@ func (k *kill) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 		fmt.Fprint(tty, "\n")
 	}
 
+	if reconnectAfter > 0 {
+		advised := 0
+		for id, serverConn := range connections {
+			// Clients that dont understand the request still reconnect, just using their own backoff
+			if !users.Supports(serverConn, "retry-after-rssh@golang.org") {
+				fmt.Fprintf(tty, "%s does not support waiting before reconnecting, it will use its own backoff\n", id)
+				serverConn.Close()
+				continue
+			}
+
+			accepted, _, err := serverConn.SendRequest("retry-after-rssh@golang.org", true, []byte(strconv.Itoa(int(reconnectAfter.Seconds()))))
+			if err == nil && accepted {
+				advised++
+			}
+
+			serverConn.Close()
+		}
+
+		return fmt.Errorf("%d connections closed, %d will wait %s before reconnecting", len(connections), advised, reconnectAfter)
+	}
+
 	killedClients := 0
 	for id, serverConn := range connections {
 		serverConn.SendRequest("kill", false, nil)
@@ -89,7 +149,9 @@ func (k *kill) Help(explain bool) string {
 	return terminal.MakeHelpText(k.ValidArgs(),
 		"kill <remote_id>",
 		"kill <glob pattern>",
+		"kill --reconnect-after 10m <glob pattern>",
 		"Stop the execute of the rssh client.",
+		"With --reconnect-after clients are only disconnected, e.g for server maintenance, and wait a random time between the duration and twice it before reconnecting.",
 	)
 }
 
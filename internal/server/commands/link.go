@@ -1,13 +1,16 @@
 package commands
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"path"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/NHAS/reverse_ssh/internal/server/data"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
@@ -26,7 +29,7 @@ var spaceMatcher = regexp.MustCompile(`[\s]+`)
 func (l *link) ValidArgs() map[string]string {
 
 	r := map[string]string{
-		"s":                 "Set homeserver address, defaults to server --external_address if set, or server listen address if not",
+		"s":                 "Set homeserver address, defaults to server --external_address if set, or server listen address if not. Can be repeated, clients try each in order and fail over. Append ?sni=name&proxy=url to override --sni and --proxy for one address",
 		"l":                 "List currently active download links",
 		"r":                 "Remove download link",
 		"C":                 "Comment to add as the public key (acts as the name)",
@@ -41,9 +44,11 @@ func (l *link) ValidArgs() map[string]string {
 		"stdio":             "Use stdin and stdout as transport, will disable logging, destination after stdio:// is ignored",
 		"http":              "Use http polling as the underlying transport",
 		"https":             "Use https polling as the underlying transport",
+		"quic":              "Use QUIC as the underlying transport, the server must be started with --quic",
 		"use-host-header":   "Use HTTP Host header as callback address when generating download template (add .sh to your download urls and find out)",
 		"shared-object":     "Generate shared object file",
-		"fingerprint":       "Set RSSH server fingerprint will default to server public key",
+		"fingerprint":       "Set RSSH server fingerprint will default to server public key, can be repeated to trust several keys",
+		"strict":            "Client refuses to run without a pinned server fingerprint and never falls back to trusting any server key",
 		"garble":            "Use garble to obfuscate the binary (requires garble to be installed)",
 		"upx":               "Use upx to compress the final binary (requires upx to be installed)",
 		"lzma":              "Use lzma compression for smaller binary at the cost of overhead at execution (requires upx flag to be set)",
@@ -55,6 +60,13 @@ func (l *link) ValidArgs() map[string]string {
 		"log-level":         "Set default output logging levels, [INFO,WARNING,ERROR,FATAL,DISABLED]",
 		"ntlm-proxy-creds":  "Set NTLM proxy credentials in format DOMAIN\\USER:PASS",
 		"version-string":    "Set the SSH version string the client uses, will always be prefixed with SSH-",
+		"tls-verify":        "Client verifies the servers TLS certificate against the system roots and the rssh CA",
+		"tls-pin":           "SHA256 hex of a TLS public key the server must present in its chain, can be repeated (the rssh CA pin is logged at startup)",
+		"tls-client-cert":   "Bake a TLS client certificate issued by the rssh CA, required when the server runs with --tls-require-client-cert",
+		"enrol":             "Bake a one time enrolment token instead of a private key, the client generates its own key and registers it on first run",
+		"enrol-expiry":      "How long the enrolment token can be used for, e.g 1h, 7d (default 24h)",
+		"retry-min":         "Shortest wait before the client retries a destination that failed, e.g 30s (default 10s)",
+		"retry-max":         "Longest wait before the client retries a destination, waits are random and double with each failure up to this (default 5m)",
 	}
 
 	// Add duplicate flags for owners
@@ -129,6 +141,7 @@ func (l *link) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 		DisableLibC:     line.IsSet("no-lib-c"),
 		UseKerberosAuth: line.IsSet("use-kerberos"),
 		RawDownload:     line.IsSet("raw-download"),
+		Enrol:           line.IsSet("enrol"),
 	}
 
 	var err error
@@ -147,13 +160,13 @@ func (l *link) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 		return err
 	}
 
-	buildConfig.ConnectBackAdress, err = line.GetArgString("s")
+	connectBacks, err := line.GetArgsString("s")
 	if err != nil && err != terminal.ErrFlagNotSet {
 		return err
 	}
 
-	if buildConfig.ConnectBackAdress == "" {
-		buildConfig.ConnectBackAdress = webserver.DefaultConnectBack
+	if len(connectBacks) == 0 {
+		connectBacks = []string{webserver.DefaultConnectBack}
 	}
 
 	buildConfig.UseHostHeader = line.IsSet("use-host-header")
@@ -165,6 +178,7 @@ func (l *link) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 		"stdio": line.IsSet("stdio"),
 		"http":  line.IsSet("http"),
 		"https": line.IsSet("https"),
+		"quic":  line.IsSet("quic"),
 	}
 
 	numberTrue := 0
@@ -177,10 +191,32 @@ func (l *link) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 	}
 
 	if numberTrue > 1 {
-		return errors.New("cant use tls/wss/ws/std/http/https flags together (only supports one per client)")
+		return errors.New("cant use tls/wss/ws/std/http/https/quic flags together (only supports one per client)")
 	}
 
-	buildConfig.ConnectBackAdress = scheme + buildConfig.ConnectBackAdress
+	// Every address is baked into one comma separated value, in the order they should be tried
+	var destinations []string
+	for _, connectBack := range connectBacks {
+		for _, d := range strings.Split(connectBack, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+
+			if strings.ContainsAny(d, " \t") {
+				return fmt.Errorf("destination %q cannot contain whitespace", d)
+			}
+
+			// Addresses with their own scheme keep it, so a client can fall back to a different transport
+			if !strings.Contains(d, "://") {
+				d = scheme + d
+			}
+
+			destinations = append(destinations, d)
+		}
+	}
+
+	buildConfig.ConnectBackAdress = strings.Join(destinations, ",")
 
 	buildConfig.Name, err = line.GetArgString("name")
 	if err != nil && err != terminal.ErrFlagNotSet {
@@ -197,11 +233,50 @@ func (l *link) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 		return err
 	}
 
-	buildConfig.Fingerprint, err = line.GetArgString("fingerprint")
+	fingerprints, err := line.GetArgsString("fingerprint")
+	if err != nil && err != terminal.ErrFlagNotSet {
+		return err
+	}
+
+	for _, fingerprint := range fingerprints {
+		if _, err := hex.DecodeString(fingerprint); err != nil || len(fingerprint) != 64 {
+			return fmt.Errorf("fingerprint %q is not a hex sha256 fingerprint", fingerprint)
+		}
+	}
+	buildConfig.Fingerprint = strings.Join(fingerprints, ",")
+
+	buildConfig.Strict = line.IsSet("strict")
+
+	tlsPins, err := line.GetArgsString("tls-pin")
 	if err != nil && err != terminal.ErrFlagNotSet {
 		return err
 	}
 
+	for _, pin := range tlsPins {
+		if _, err := hex.DecodeString(pin); err != nil || len(pin) != 64 {
+			return fmt.Errorf("tls pin %q is not a hex sha256 hash", pin)
+		}
+	}
+	buildConfig.TLSPins = strings.Join(tlsPins, ",")
+
+	for flag, setting := range map[string]*string{"retry-min": &buildConfig.RetryMin, "retry-max": &buildConfig.RetryMax} {
+		*setting, err = line.GetArgString(flag)
+		if err != nil && err != terminal.ErrFlagNotSet {
+			return err
+		}
+
+		if *setting == "" {
+			continue
+		}
+
+		if d, err := time.ParseDuration(*setting); err != nil || d <= 0 {
+			return fmt.Errorf("--%s %q is not a duration, e.g 30s", flag, *setting)
+		}
+	}
+
+	buildConfig.TLSVerify = line.IsSet("tls-verify")
+	buildConfig.TLSClientCert = line.IsSet("tls-client-cert")
+
 	buildConfig.Proxy, err = line.GetArgString("proxy")
 	if err != nil && err != terminal.ErrFlagNotSet {
 		return err
@@ -249,6 +324,20 @@ func (l *link) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 		return err
 	}
 
+	buildConfig.EnrolmentLifetime = 24 * time.Hour
+	if expiry, err := line.GetArgString("enrol-expiry"); err == nil {
+		if !buildConfig.Enrol {
+			return errors.New("--enrol-expiry requires --enrol")
+		}
+
+		buildConfig.EnrolmentLifetime, err = parseLifetime(expiry)
+		if err != nil {
+			return err
+		}
+	} else if err != terminal.ErrFlagNotSet {
+		return err
+	}
+
 	if spaceMatcher.MatchString(buildConfig.Owners) {
 		return errors.New("owners flag cannot contain any whitespace")
 	}
@@ -263,6 +352,25 @@ func (l *link) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 	return nil
 }
 
+// parseLifetime is time.ParseDuration with d for days, as tokens often need to last longer than hours
+func parseLifetime(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid number of days %q", s)
+		}
+
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q, e.g 30m, 12h, 7d", s)
+	}
+
+	return d, nil
+}
+
 func (l *link) Expect(line terminal.ParsedLine) []string {
 	if line.Section != nil {
 		switch line.Section.Value() {
@@ -4,9 +4,14 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/traffic"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/internal/terminal"
 	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
@@ -19,13 +24,106 @@ type list struct {
 }
 
 type displayItem struct {
-	sc ssh.ServerConn
+	sc *ssh.ServerConn
 	id string
 }
 
+// Versions are from git describe, e.g v2.6.3, or v2.6.3-4-g1234abc for commits after a release. Links add _guess
+var versionPattern = regexp.MustCompile(`^v?(\d+)\.(\d+)\.(\d+)(?:-(\d+)-g[0-9a-f]+)?`)
+
+func parseVersion(version string) ([]int, bool) {
+	matches := versionPattern.FindStringSubmatch(version)
+	if matches == nil {
+		return nil, false
+	}
+
+	var parts []int
+	for _, m := range matches[1:] {
+		n, _ := strconv.Atoi(m)
+		parts = append(parts, n)
+	}
+
+	return parts, true
+}
+
+// clientVersion prefers the version the client advertised, as its ssh version string can be changed, SSH-<version>-<platform>
+func clientVersion(sc *ssh.ServerConn) string {
+	if c, ok := users.GetCapabilities(sc); ok {
+		return c.Version
+	}
+
+	version := strings.TrimPrefix(string(sc.ClientVersion()), "SSH-")
+	if i := strings.LastIndex(version, "-"); i != -1 {
+		version = version[:i]
+	}
+
+	return version
+}
+
+func outdated(sc *ssh.ServerConn) bool {
+	return outdatedVersion(clientVersion(sc), internal.Version)
+}
+
+// outdatedVersion is only true when both versions can be compared, development builds and custom version strings have none
+func outdatedVersion(clientVersion, serverVersion string) bool {
+	server, ok := parseVersion(serverVersion)
+	if !ok {
+		return false
+	}
+
+	client, ok := parseVersion(clientVersion)
+	if !ok {
+		return false
+	}
+
+	return slices.Compare(client, server) < 0
+}
+
+// wrapList joins items, starting a new line before one would go past width
+func wrapList(items []string, width int) string {
+	var (
+		lines []string
+		line  string
+	)
+
+	for _, item := range items {
+		if line != "" && len(line)+len(item)+2 > width {
+			lines = append(lines, line+",")
+			line = ""
+		}
+
+		if line != "" {
+			line += ", "
+		}
+		line += item
+	}
+
+	return strings.Join(append(lines, line), "\n")
+}
+
+func capabilitySummary(sc *ssh.ServerConn) string {
+	c, ok := users.GetCapabilities(sc)
+	if !ok {
+		return "unknown, client is\nolder than capability\nadvertisement"
+	}
+
+	tun := "no"
+	if slices.Contains(c.JumpChannels, "tun@openssh.com") {
+		tun = "yes"
+	}
+
+	return fmt.Sprintf("platform: %s\ntun: %s\nsubsystems:\n%s\nchannels:\n%s\nrequests:\n%s",
+		c.Platform,
+		tun,
+		wrapList(c.Subsystems, 40),
+		wrapList(c.Channels, 40),
+		wrapList(c.GlobalRequests, 40),
+	)
+}
+
 func fancyTable(tty io.ReadWriter, applicable []displayItem) {
 
-	t, _ := table.NewTable("Targets", "IDs", "Owners", "Version")
+	t, _ := table.NewTable("Targets", "IDs", "Owners", "Version", "Capabilities", "Traffic")
 	for _, a := range applicable {
 
 		keyId := a.sc.Permissions.Extensions["pubkey-fp"]
@@ -40,7 +138,15 @@ func fancyTable(tty io.ReadWriter, applicable []displayItem) {
 			owners = strings.Join(strings.Split(a.sc.Permissions.Extensions["owners"], ","), "\n")
 		}
 
-		if err := t.AddValues(fmt.Sprintf("%s\n%s\n%s\n%s\n", a.id, keyId, users.NormaliseHostname(a.sc.User()), a.sc.RemoteAddr().String()), owners, string(a.sc.ClientVersion())); err != nil {
+		stats := traffic.GetClient(a.id).Stats()
+		usage := fmt.Sprintf("in:  %s (%s/s)\nout: %s (%s/s)", traffic.FormatBytes(stats.In), traffic.FormatBytes(stats.RateIn), traffic.FormatBytes(stats.Out), traffic.FormatBytes(stats.RateOut))
+
+		version := string(a.sc.ClientVersion())
+		if outdated(a.sc) {
+			version += "\n(older than server)"
+		}
+
+		if err := t.AddValues(fmt.Sprintf("%s\n%s\n%s\n%s\n", a.id, keyId, users.NormaliseHostname(a.sc.User()), a.sc.RemoteAddr().String()), owners, version, capabilitySummary(a.sc), usage); err != nil {
 			log.Println("Error drawing pretty ls table (THIS IS A BUG): ", err)
 			return
 		}
@@ -79,7 +185,7 @@ func (l *list) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 			return fmt.Errorf("No RSSH clients connected")
 		}
 
-		return fmt.Errorf("Unable to find match for '" + filter + "'")
+		return fmt.Errorf("Unable to find match for '%s'", filter)
 	}
 
 	ids := []string{}
@@ -90,7 +196,7 @@ func (l *list) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 	sort.Strings(ids)
 
 	for _, id := range ids {
-		toReturn = append(toReturn, displayItem{id: id, sc: *matchingClients[id]})
+		toReturn = append(toReturn, displayItem{id: id, sc: matchingClients[id]})
 	}
 
 	if line.IsSet("t") {
@@ -112,7 +218,12 @@ func (l *list) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 			owners = "public"
 		}
 
-		fmt.Fprintf(tty, "%s %s %s %s, owners: %s, version: %s", color.YellowString(tr.id), keyId, color.BlueString(users.NormaliseHostname(tr.sc.User())), tr.sc.RemoteAddr().String(), owners, tr.sc.ClientVersion())
+		version := string(tr.sc.ClientVersion())
+		if outdated(tr.sc) {
+			version = color.RedString("%s (older than server)", version)
+		}
+
+		fmt.Fprintf(tty, "%s %s %s %s, owners: %s, version: %s", color.YellowString(tr.id), keyId, color.BlueString(users.NormaliseHostname(tr.sc.User())), tr.sc.RemoteAddr().String(), owners, version)
 
 		if i != len(toReturn)-1 {
 			fmt.Fprint(tty, sep)
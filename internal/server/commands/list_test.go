@@ -0,0 +1,71 @@
+package commands
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    []int
+	}{
+		{"v2.6.3", []int{2, 6, 3, 0}},
+		{"2.6.3", []int{2, 6, 3, 0}},
+		{"v2.6.3-4-g1234abc", []int{2, 6, 3, 4}},
+		{"v2.6.3_guess", []int{2, 6, 3, 0}},
+		{"v2.6.3-4-g1234abc_guess", []int{2, 6, 3, 4}},
+		{"v2.6.3-dirty", []int{2, 6, 3, 0}},
+
+		// Development builds and custom --version-string values
+		{"", nil},
+		{"1234abc", nil},
+		{"unknown", nil},
+		{"2.0-OpenSSH_8.0", nil},
+		{"v2.6", nil},
+	}
+
+	for _, test := range tests {
+		got, ok := parseVersion(test.version)
+		if ok != (test.want != nil) || !slices.Equal(got, test.want) {
+			t.Errorf("parseVersion(%q) = %v, %v, want %v", test.version, got, ok, test.want)
+		}
+	}
+}
+
+func TestOutdatedVersion(t *testing.T) {
+	tests := []struct {
+		client, server string
+		want           bool
+	}{
+		{"v2.6.2", "v2.6.3", true},
+		{"v2.5.9", "v2.6.0", true},
+		{"v1.9.9", "v2.0.0", true},
+		{"v2.6.3", "v2.6.3", false},
+		{"v2.6.4", "v2.6.3", false},
+
+		// Commits after a release are newer than it, and older than the next
+		{"v2.6.3", "v2.6.3-4-g1234abc", true},
+		{"v2.6.3-2-gabcdef0", "v2.6.3-4-g1234abc", true},
+		{"v2.6.3-4-gabcdef0", "v2.6.3-4-g1234abc", false},
+		{"v2.6.3-4-g1234abc", "v2.6.3", false},
+		{"v2.6.3-40-g1234abc", "v2.6.4", true},
+
+		// Links guess at the version they were built from
+		{"v2.6.2_guess", "v2.6.3", true},
+		{"v2.6.3_guess", "v2.6.3", false},
+
+		// Anything that cannot be compared is never flagged
+		{"2.0-OpenSSH_8.0", "v2.6.3", false},
+		{"custom", "v2.6.3", false},
+		{"v2.6.2", "", false},
+		{"v2.6.2", "1234abc", false},
+		{"", "", false},
+	}
+
+	for _, test := range tests {
+		if got := outdatedVersion(test.client, test.server); got != test.want {
+			t.Errorf("outdatedVersion(%q, %q) = %v, want %v", test.client, test.server, got, test.want)
+		}
+	}
+}
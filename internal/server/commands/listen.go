@@ -5,16 +5,21 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"slices"
+	"sort"
 	"strconv"
 
 	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/data"
 	"github.com/NHAS/reverse_ssh/internal/server/multiplexer"
 	"github.com/NHAS/reverse_ssh/internal/server/observers"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/internal/terminal"
 	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"github.com/NHAS/reverse_ssh/pkg/table"
 	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
 )
 
 type autostartEntry struct {
@@ -28,35 +33,169 @@ type listen struct {
 	log logger.Logger
 }
 
-func (l *listen) server(tty io.ReadWriter, line terminal.ParsedLine, onAddrs, offAddrs []string) error {
-	if line.IsSet("l") {
-		listeners := multiplexer.ServerMultiplexer.GetListeners()
+func (l *listen) listServer(tty io.ReadWriter) error {
+	saved, err := data.ListListeners()
+	if err != nil {
+		return err
+	}
 
-		if len(listeners) == 0 {
-			fmt.Fprintln(tty, "No active listeners")
-			return nil
+	live := multiplexer.ServerMultiplexer.GetListeners()
+	if len(live) == 0 && len(saved) == 0 {
+		fmt.Fprintln(tty, "No listeners")
+		return nil
+	}
+
+	persisted := map[string]data.Listener{}
+	addresses := live
+	for _, s := range saved {
+		persisted[s.Address] = s
+		if !slices.Contains(addresses, s.Address) {
+			addresses = append(addresses, s.Address)
 		}
+	}
+	sort.Strings(addresses)
 
-		for _, listener := range listeners {
-			fmt.Fprintf(tty, "%s\n", listener)
+	tab, err := table.NewTable("Server Listeners", "Address", "State", "Saved", "Options")
+	if err != nil {
+		return err
+	}
+
+	for _, address := range addresses {
+		state := "not listening"
+		opts, listening := multiplexer.ServerMultiplexer.GetListenerOptions(address)
+		if listening {
+			state = "listening"
 		}
-		return nil
+
+		s, isSaved := persisted[address]
+		if !listening && isSaved {
+			opts, err = multiplexer.ParseListenerOptions(s.TrustedProxies, s.Protocols, s.Logins)
+			if err != nil {
+				state = "invalid options: " + err.Error()
+			}
+		}
+
+		tab.AddValues(address, state, fmt.Sprintf("%t", isSaved), opts.String())
+	}
+
+	tab.Fprint(tty)
+
+	return l.printStats(tty)
+}
+
+func formatLimit(current, limit int) string {
+	if limit < 0 {
+		return fmt.Sprintf("%d (unlimited)", current)
+	}
+	return fmt.Sprintf("%d/%d", current, limit)
+}
+
+func (l *listen) printStats(tty io.ReadWriter) error {
+	stats := multiplexer.ServerMultiplexer.Stats()
+
+	limits, err := table.NewTable("Connection Limits", "Limit", "In Use", "Per IP")
+	if err != nil {
+		return err
+	}
+
+	perIP := func(limit int) string {
+		if limit < 0 {
+			return "unlimited"
+		}
+		return fmt.Sprintf("%d", limit)
+	}
+
+	limits.AddValues("Connections", formatLimit(stats.Connections, stats.Limits.MaxConnections), perIP(stats.Limits.MaxConnectionsPerIP))
+	limits.AddValues("Handshakes", formatLimit(stats.Handshakes, stats.Limits.MaxHandshakes), perIP(stats.Limits.MaxHandshakesPerIP))
+	limits.AddValues("Polling Sessions", formatLimit(stats.PollingSessions, stats.Limits.MaxPollingSessions), perIP(stats.Limits.MaxPollingSessionsPerIP))
+
+	limits.Fprint(tty)
+
+	fmt.Fprintf(tty, "Handshake timeout %s, handoff timeout %s\n", stats.Limits.HandshakeTimeout, stats.Limits.HandoffTimeout)
+
+	drops, err := table.NewTable("Dropped Connections", "Reason", "Count")
+	if err != nil {
+		return err
+	}
+
+	d := stats.Drops
+	for _, row := range []struct {
+		reason string
+		count  uint64
+	}{
+		{"connection limit", d.ConnectionLimit},
+		{"connection limit per ip", d.ConnectionLimitPerIP},
+		{"handshake limit", d.HandshakeLimit},
+		{"handshake limit per ip", d.HandshakeLimitPerIP},
+		{"handshake timeout", d.HandshakeTimeout},
+		{"handoff timeout", d.HandoffTimeout},
+		{"polling session limit", d.PollingLimit},
+		{"polling session limit per ip", d.PollingLimitPerIP},
+		{"filtered (banned)", d.Filtered},
+		{"failed negotiation", d.Failed},
+	} {
+		drops.AddValues(row.reason, fmt.Sprintf("%d", row.count))
+	}
+
+	drops.Fprint(tty)
+
+	return nil
+}
+
+func (l *listen) server(tty io.ReadWriter, line terminal.ParsedLine, onAddrs, offAddrs []string) error {
+	if line.IsSet("l") {
+		return l.listServer(tty)
+	}
+
+	trustedProxies, _ := line.GetArgString("proxy-protocol")
+	allowed, _ := line.GetArgString("protocols")
+	logins, _ := line.GetArgString("logins")
+
+	opts, err := multiplexer.ParseListenerOptions(trustedProxies, allowed, logins)
+	if err != nil {
+		return err
+	}
+
+	if line.IsSet("proxy-protocol") && len(opts.TrustedProxies) == 0 {
+		return errors.New("--proxy-protocol requires the networks of your load balancers, e.g --proxy-protocol 10.0.0.0/8")
 	}
 
 	for _, addr := range onAddrs {
-		err := multiplexer.ServerMultiplexer.StartListener("tcp", addr)
+		err := multiplexer.ServerMultiplexer.StartListenerWithOptions("tcp", addr, opts)
 		if err != nil {
 			return err
 		}
 		fmt.Fprintln(tty, "started listening on: ", addr)
+
+		if line.IsSet("temporary") {
+			continue
+		}
+
+		err = data.SaveListener(data.Listener{
+			Address:        addr,
+			TrustedProxies: trustedProxies,
+			Protocols:      allowed,
+			Logins:         logins,
+		})
+		if err != nil {
+			fmt.Fprintf(tty, "unable to save listener %s, it will not be restored on restart: %s\n", addr, err)
+		}
 	}
 
 	for _, addr := range offAddrs {
-		err := multiplexer.ServerMultiplexer.StopListener(addr)
-		if err != nil {
+		stopErr := multiplexer.ServerMultiplexer.StopListener(addr)
+		if stopErr == nil {
+			fmt.Fprintln(tty, "stopped listening on: ", addr)
+		}
+
+		err := data.DeleteListener(addr)
+		if err == nil {
+			fmt.Fprintln(tty, "removed saved listener: ", addr)
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
 			return err
+		} else if stopErr != nil {
+			return stopErr
 		}
-		fmt.Fprintln(tty, "stopped listening on: ", addr)
 	}
 
 	return nil
@@ -92,6 +231,11 @@ func (l *listen) client(user *users.User, tty io.ReadWriter, line terminal.Parse
 	if line.IsSet("l") {
 
 		for id, cc := range foundClients {
+			if !users.Supports(cc, "query-tcpip-forwards") {
+				fmt.Fprintf(tty, "%s does not support querying server forwards\n", id)
+				continue
+			}
+
 			result, message, _ := cc.SendRequest("query-tcpip-forwards", true, nil)
 			if !result {
 				fmt.Fprintf(tty, "%s does not support querying server forwards\n", id)
@@ -144,6 +288,12 @@ func (l *listen) client(user *users.User, tty io.ReadWriter, line terminal.Parse
 
 		applied := len(foundClients)
 		for c, sc := range foundClients {
+			if !users.Supports(sc, "tcpip-forward") {
+				applied--
+				fmt.Fprintln(tty, "client does not support server ports: ", c)
+				continue
+			}
+
 			result, message, err := sc.SendRequest("tcpip-forward", true, b)
 			if !result {
 				applied--
@@ -247,10 +397,15 @@ func (l *listen) client(user *users.User, tty io.ReadWriter, line terminal.Parse
 func (w *listen) ValidArgs() map[string]string {
 
 	r := map[string]string{
-		"on":   "Turn on port, e.g --on :8080 127.0.0.1:4444",
+		"on":   "Turn on port, e.g --on :8080 127.0.0.1:4444, with --server prefix quic:// to listen for QUIC on UDP",
 		"auto": "Automatically turn on server control port on clients that match criteria, (use --off --auto to disable and --l --auto to view)",
 		"off":  "Turn off port, e.g --off :8080 127.0.0.1:4444",
 		"l":    "List all enabled addresses",
+
+		"proxy-protocol": "With --server --on, comma separated networks of load balancers that send PROXY protocol headers, e.g 10.0.0.0/8",
+		"protocols":      "With --server --on, only accept these protocols, from ssh,tls,ws,http,download,raw. wss needs tls,ws (default all)",
+		"logins":         "With --server --on, only allow these logins, from operators,controllees,proxies (default all)",
+		"temporary":      "With --server --on, do not save the listener so it is gone after a restart",
 	}
 
 	addDuplicateFlags("Open server port on client/s takes a pattern, e.g -c *, --client your.hostname.here", r, "client", "c")
@@ -313,6 +468,8 @@ func (w *listen) Help(explain bool) string {
 		"listen [OPTION] [PORT]",
 		"listen starts or stops listening control ports",
 		"it allows you to change the servers listening port, or open the servers control port on an rssh client, so that forwarding is easier",
+		"e.g a download only port: listen --server --on :8080 --protocols download,raw",
+		"e.g a QUIC port: listen --server --on quic://:4433",
 	)
 }
 
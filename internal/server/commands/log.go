@@ -1,6 +1,7 @@
 package commands
 
 import (
+	"errors"
 	"fmt"
 	"io"
 
@@ -44,12 +45,15 @@ func (l *logCommand) Run(user *users.User, tty io.ReadWriter, line terminal.Pars
 	if err != nil && err != terminal.ErrFlagNotSet {
 		return err
 	} else {
-
 		_, err := logger.StrToUrgency(logLevel)
 		if err != nil {
 			return fmt.Errorf("invalid log level %q", logLevel)
 		}
 
+		if !users.Supports(connection, "log-level") {
+			return errors.New("client does not support changing its log level")
+		}
+
 		_, _, err = connection.SendRequest("log-level", false, []byte(logLevel))
 		if err != nil {
 			return fmt.Errorf("failed to send log level request to client (may be outdated): %s", err)
@@ -57,6 +61,9 @@ func (l *logCommand) Run(user *users.User, tty io.ReadWriter, line terminal.Pars
 	}
 
 	if line.IsSet("to-console") {
+		if !users.Supports(connection, "log-to-console") {
+			return errors.New("client does not support sending its log to the console")
+		}
 
 		term, isTerm := tty.(*terminal.Terminal)
 		if isTerm {
@@ -93,6 +100,9 @@ func (l *logCommand) Run(user *users.User, tty io.ReadWriter, line terminal.Pars
 		}
 
 	} else if line.IsSet("to-file") {
+		if !users.Supports(connection, "log-to-file") {
+			return errors.New("client does not support logging to a file")
+		}
 
 		filepath, err := line.GetArgString("to-file")
 		if err != nil && err != terminal.ErrFlagNotSet {
@@ -0,0 +1,154 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/mfa"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+)
+
+type mfaCommand struct {
+	session string
+}
+
+func (m *mfaCommand) ValidArgs() map[string]string {
+	return map[string]string{
+		"enrol":   "Generate a new secret and show the provisioning URI for your authenticator app",
+		"confirm": "Finish enrolment with a code from your authenticator app, e.g --confirm 123456",
+		"disable": "Remove your second factor, administrators can remove another by username or key e.g --disable jim",
+		"l":       "List usernames and administrator keys with a second factor enrolled (admin only)",
+	}
+}
+
+func (m *mfaCommand) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+
+	connection, err := user.Session(m.session)
+	if err != nil {
+		return err
+	}
+
+	// Administrators second factors belong to the key they logged in with, not their username
+	identity := connection.MFAIdentity
+	if identity == "" {
+		return errors.New("this session has no second factor identity")
+	}
+
+	switch {
+	case line.IsSet("l"):
+		if user.Privilege() != users.AdminPermissions {
+			return errors.New("only administrators can list enrolled users")
+		}
+
+		enrolled, err := data.ListMFA()
+		if err != nil {
+			return err
+		}
+
+		if len(enrolled) == 0 {
+			fmt.Fprintln(tty, "No users have enrolled a second factor")
+			return nil
+		}
+
+		tab, err := table.NewTable("Second Factor", "Identity", "Enrolled")
+		if err != nil {
+			return err
+		}
+
+		for _, e := range enrolled {
+			tab.AddValues(e.Username, e.UpdatedAt.Format("2006/01/02 15:04:05"))
+		}
+
+		tab.Fprint(tty)
+
+		return nil
+
+	case line.IsSet("enrol"):
+		secret, uri, err := mfa.BeginEnrolment(identity)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(tty, "Add this to your authenticator app:\n\n%s\n\nOr enter the secret manually: %s\n\n", uri, secret)
+		fmt.Fprintln(tty, "Then run 'mfa --confirm <code>' within 10 minutes to finish enrolment, until then your login is unchanged")
+
+		return nil
+
+	case line.IsSet("confirm"):
+		code, err := line.GetArgString("confirm")
+		if err != nil {
+			return errors.New("no code specified, e.g --confirm 123456")
+		}
+
+		if err := mfa.ConfirmEnrolment(identity, code); err != nil {
+			return err
+		}
+
+		fmt.Fprintln(tty, "Second factor enrolled, you will be asked for a code on your next login")
+
+		return nil
+
+	case line.IsSet("disable"):
+		target, err := line.GetArgString("disable")
+		if err != nil {
+			target = identity
+		}
+
+		if target != identity && user.Privilege() != users.AdminPermissions {
+			return errors.New("only administrators can remove another users second factor")
+		}
+
+		if target == identity && user.Privilege() == users.AdminPermissions && mfa.RequireForAdmins {
+			return errors.New("second factors are required for administrators, use --enrol to replace yours instead")
+		}
+
+		if err := mfa.Disable(target); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(tty, "removed second factor for %q\n", target)
+
+		return nil
+	}
+
+	enrolled, err := mfa.Enrolled(identity)
+	if err != nil {
+		return err
+	}
+
+	if enrolled {
+		fmt.Fprintf(tty, "A second factor is enrolled for %s\n", identity)
+		return nil
+	}
+
+	fmt.Fprintf(tty, "No second factor is enrolled for %s, use 'mfa --enrol' to add one\n", identity)
+
+	return nil
+}
+
+func (m *mfaCommand) Expect(line terminal.ParsedLine) []string {
+	return nil
+}
+
+func (m *mfaCommand) Help(explain bool) string {
+	if explain {
+		return "Manage time based one time password (TOTP) second factors"
+	}
+
+	return terminal.MakeHelpText(m.ValidArgs(),
+		"mfa [OPTIONS]",
+		"Once enrolled, logging in requires a code from your authenticator app after your key is accepted",
+		"Administrators enrol the key they logged in with, as their keys can log in under any username",
+		"Administrators must have a second factor unless the server is started with --allow-admin-without-mfa, enrol the first with the server --enrol-mfa option",
+	)
+}
+
+func MFA(session string) *mfaCommand {
+	return &mfaCommand{
+		session: session,
+	}
+}
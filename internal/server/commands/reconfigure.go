@@ -0,0 +1,192 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+type reconfigure struct {
+}
+
+func (r *reconfigure) ValidArgs() map[string]string {
+	return map[string]string{
+		"destination": "Replace the clients callback addresses, can be repeated or comma separated and takes the same form as the clients -d",
+		"proxy":       "Proxy for destinations that dont set their own, 'none' to connect directly",
+		"sni":         "SNI for destinations that dont set their own, 'none' to use the destination host",
+		"keepalive":   "How often clients send keepalives, e.g 30s, 0 to stop",
+		"log-level":   "Client log level, [INFO,WARNING,ERROR,FATAL,DISABLED]",
+		"retry-min":   "Shortest wait before retrying a destination that failed, e.g 30s",
+		"retry-max":   "Longest wait before retrying a destination that failed, e.g 15m",
+		"persist":     "Have clients save the new destinations to their --destination-file, clients without one refuse",
+		"reconnect":   "Disconnect clients that accepted, so new destinations are used straight away",
+		"y":           "Do not prompt for confirmation",
+	}
+}
+
+func (r *reconfigure) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+
+	if len(line.Arguments) == 0 {
+		return errors.New(r.Help(false))
+	}
+
+	// Flags take every argument after them, so the filter has to come first
+	if len(line.FlagsOrdered) > 0 && line.Arguments[0].Start() > line.FlagsOrdered[0].Start() {
+		return errors.New("the remote id or filter must come before any options, e.g reconfigure * --keepalive 30s")
+	}
+
+	filter := line.Arguments[0].Value()
+
+	var config internal.Reconfiguration
+
+	destinations, err := line.GetArgsString("destination")
+	if err == nil {
+		for _, d := range destinations {
+			if strings.ContainsAny(d, " \t") {
+				return fmt.Errorf("destination %q cannot contain whitespace", d)
+			}
+		}
+
+		config.Destinations = strings.Join(destinations, ",")
+		if config.Destinations == "" {
+			return errors.New("--destination needs at least one address")
+		}
+	}
+
+	for flag, setting := range map[string]*string{
+		"proxy":     &config.Proxy,
+		"sni":       &config.SNI,
+		"keepalive": &config.Keepalive,
+		"log-level": &config.LogLevel,
+		"retry-min": &config.RetryMin,
+		"retry-max": &config.RetryMax,
+	} {
+		*setting, err = line.GetArgString(flag)
+		if err != nil && err != terminal.ErrFlagNotSet {
+			return err
+		}
+	}
+
+	if config.Keepalive != "" {
+		if d, err := time.ParseDuration(config.Keepalive); err != nil || d < 0 {
+			return fmt.Errorf("--keepalive %q is not a duration, e.g 30s", config.Keepalive)
+		}
+	}
+
+	for flag, setting := range map[string]string{"retry-min": config.RetryMin, "retry-max": config.RetryMax} {
+		if setting == "" {
+			continue
+		}
+
+		if d, err := time.ParseDuration(setting); err != nil || d <= 0 {
+			return fmt.Errorf("--%s %q is not a duration, e.g 30s", flag, setting)
+		}
+	}
+
+	if config.LogLevel != "" {
+		if _, err := logger.StrToUrgency(config.LogLevel); err != nil {
+			return fmt.Errorf("invalid log level %q", config.LogLevel)
+		}
+	}
+
+	config.Persist = line.IsSet("persist")
+	if config.Persist && config.Destinations == "" {
+		return errors.New("--persist only saves destinations, so needs --destination")
+	}
+
+	if config == (internal.Reconfiguration{}) {
+		return errors.New("nothing to change, see: help reconfigure")
+	}
+
+	connections, err := user.SearchClients(filter)
+	if err != nil {
+		return err
+	}
+
+	if len(connections) == 0 {
+		return fmt.Errorf("No clients matched %q", filter)
+	}
+
+	if !line.IsSet("y") {
+		fmt.Fprintf(tty, "Reconfigure %d clients? [N/y] ", len(connections))
+
+		if term, ok := tty.(*terminal.Terminal); ok {
+			term.EnableRaw()
+		}
+
+		b := make([]byte, 1)
+		_, err := tty.Read(b)
+		if term, ok := tty.(*terminal.Terminal); ok {
+			term.DisableRaw(false)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if !(b[0] == 'y' || b[0] == 'Y') {
+			return fmt.Errorf("\nUser did not enter y/Y, aborting")
+		}
+
+		fmt.Fprint(tty, "\n")
+	}
+
+	payload := ssh.Marshal(&config)
+
+	accepted := 0
+	for id, serverConn := range connections {
+		if !users.Supports(serverConn, "reconfigure-rssh@golang.org") {
+			fmt.Fprintf(tty, "%s skipped, client does not support reconfigure\n", id)
+			continue
+		}
+
+		ok, reply, err := serverConn.SendRequest("reconfigure-rssh@golang.org", true, payload)
+		switch {
+		case err != nil:
+			fmt.Fprintf(tty, "%s failed: %s\n", id, err)
+		case !ok && len(reply) == 0:
+			fmt.Fprintf(tty, "%s refused (client may be outdated)\n", id)
+		case !ok:
+			fmt.Fprintf(tty, "%s refused: %s\n", id, reply)
+		default:
+			accepted++
+			fmt.Fprintf(tty, "%s accepted: %s\n", id, reply)
+
+			if line.IsSet("reconnect") {
+				serverConn.Close()
+			}
+		}
+	}
+
+	return fmt.Errorf("%d of %d clients accepted", accepted, len(connections))
+}
+
+func (r *reconfigure) Expect(line terminal.ParsedLine) []string {
+	if len(line.Arguments) <= 1 && line.Section == nil {
+		return []string{autocomplete.RemoteId}
+	}
+	return nil
+}
+
+func (r *reconfigure) Help(explain bool) string {
+	const description = "Change the settings of connected clients without rebuilding them"
+	if explain {
+		return description
+	}
+
+	return terminal.MakeHelpText(r.ValidArgs(),
+		"reconfigure <remote_id|glob pattern> [OPTIONS]",
+		description,
+		"Settings are kept until the client restarts, except destinations saved with --persist.",
+		"e.g: reconfigure * --destination tls://new.example:443 --destination backup.example:3232 --persist --reconnect",
+	)
+}
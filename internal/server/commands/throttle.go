@@ -0,0 +1,209 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/NHAS/reverse_ssh/internal/server/traffic"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+)
+
+type throttle struct {
+}
+
+func (t *throttle) ValidArgs() map[string]string {
+	r := map[string]string{
+		"rate":    "Maximum throughput per second in each direction, e.g --rate 512KB, --rate 2MB",
+		"off":     "Remove the limit for the specified client filter, user or forward (only the user who set it or an admin can)",
+		"l":       "List all limits",
+		"forward": "Limit a port opened on the server by a proxy (ssh -R), takes a glob e.g --forward 127.0.0.1:8080 (admin only)",
+	}
+
+	addDuplicateFlags("Limit clients matching a filter, applies to current and future clients, e.g -c *.example.com (only clients you own unless admin)", r, "client", "c")
+	addDuplicateFlags("Limit all traffic of an rssh user (admin only unless it is yourself)", r, "user", "u")
+
+	return r
+}
+
+func (t *throttle) list(tty io.ReadWriter) error {
+	rules := traffic.Limits()
+	if len(rules) == 0 {
+		fmt.Fprintln(tty, "No limits set")
+		return nil
+	}
+
+	tab, err := table.NewTable("Limits", "Type", "Pattern", "Rate", "Set By", "Active On")
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rules {
+		active := 0
+		for _, s := range traffic.List(r.Kind) {
+			if s.Limit == r.Rate {
+				active++
+			}
+		}
+
+		tab.AddValues(r.Kind, r.Pattern, traffic.FormatBytes(r.Rate)+"/s", r.Owner, fmt.Sprintf("%d", active))
+	}
+
+	tab.Fprint(tty)
+
+	return nil
+}
+
+func (t *throttle) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+
+	if line.IsSet("l") {
+		return t.list(tty)
+	}
+
+	admin := user.Privilege() == users.AdminPermissions
+
+	var (
+		kind    string
+		pattern string
+		matches func(string) bool
+		err     error
+	)
+
+	switch {
+	case line.IsSet("client") || line.IsSet("c"):
+		kind = traffic.ClientKind
+
+		pattern, err = line.GetArgString("client")
+		if err != nil {
+			pattern, err = line.GetArgString("c")
+			if err != nil {
+				return err
+			}
+		}
+
+		if _, err := filepath.Match(pattern+"*", ""); err != nil {
+			return errors.New("filter is not well formed")
+		}
+
+		// A client limit slows the client for everyone using it, so users can only throttle clients they own rather than every client they can see
+		owner, filter := user.Username(), pattern+"*"
+		matches = func(id string) bool {
+			return users.OwnedMatch(owner, admin, filter, id)
+		}
+
+	case line.IsSet("user") || line.IsSet("u"):
+		kind = traffic.OperatorKind
+
+		pattern, err = line.GetArgString("user")
+		if err != nil {
+			pattern, err = line.GetArgString("u")
+			if err != nil {
+				return err
+			}
+		}
+
+		if pattern != user.Username() && !admin {
+			return errors.New("only administrators can limit other users")
+		}
+
+		matches = traffic.GlobMatcher(pattern)
+
+	case line.IsSet("forward"):
+		kind = traffic.ForwardKind
+
+		pattern, err = line.GetArgString("forward")
+		if err != nil {
+			return err
+		}
+
+		if !admin {
+			return errors.New("only administrators can limit server forwards")
+		}
+
+		matches = traffic.GlobMatcher(pattern)
+
+	default:
+		return errors.New("no target specified, please choose one of --client, --user or --forward")
+	}
+
+	// Users may tighten limits on themselves, but never lift them
+	var current uint64
+	for _, r := range traffic.Limits() {
+		if r.Kind == kind && r.Pattern == pattern {
+			current = r.Rate
+		}
+	}
+
+	if line.IsSet("off") {
+		if kind == traffic.OperatorKind && !admin {
+			return errors.New("only administrators can remove limits on users")
+		}
+
+		found, err := traffic.RemoveLimit(kind, pattern, user.Username(), admin)
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			return fmt.Errorf("no limit set for %s %q", kind, pattern)
+		}
+
+		fmt.Fprintf(tty, "removed limit on %s %q\n", kind, pattern)
+		return nil
+	}
+
+	rateString, err := line.GetArgString("rate")
+	if err != nil {
+		return errors.New("no rate specified, e.g --rate 1MB")
+	}
+
+	rate, err := traffic.ParseBytes(rateString)
+	if err != nil {
+		return err
+	}
+
+	if rate == 0 {
+		return errors.New("rate cannot be 0, use --off to remove a limit")
+	}
+
+	if kind == traffic.OperatorKind && !admin && current != 0 && rate > current {
+		return errors.New("only administrators can raise limits on users")
+	}
+
+	if err := traffic.SetLimit(kind, pattern, user.Username(), admin, rate, matches); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(tty, "limited %s %q to %s/s\n", kind, pattern, traffic.FormatBytes(rate))
+
+	return nil
+}
+
+func (t *throttle) Expect(line terminal.ParsedLine) []string {
+	if line.Section != nil {
+		switch line.Section.Value() {
+		case "c", "client":
+			return []string{autocomplete.RemoteId}
+		}
+	}
+
+	return nil
+}
+
+func (t *throttle) Help(explain bool) string {
+	if explain {
+		return "Limit the bandwidth used by clients, users or forwards"
+	}
+
+	return terminal.MakeHelpText(t.ValidArgs(),
+		"throttle [--client FILTER|--user NAME|--forward ADDRESS] --rate RATE",
+		"throttle --off [--client FILTER|--user NAME|--forward ADDRESS]",
+		"Limits apply live to jump channels (shells, sftp, forwards), server port forwards, proxy forwards and rssh:// downloads",
+		"Limits set by administrators override each other, newest first. Limits set by other users can only lower a limit further",
+		"Limits only last until the server is restarted. Use 'traffic' to see current throughput",
+	)
+}
@@ -0,0 +1,71 @@
+package commands
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/NHAS/reverse_ssh/internal/server/traffic"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"golang.org/x/crypto/ssh"
+)
+
+type fakeClientConn struct {
+	ssh.Conn
+	user string
+	addr net.Addr
+}
+
+func (f fakeClientConn) User() string {
+	return f.user
+}
+
+func (f fakeClientConn) RemoteAddr() net.Addr {
+	return f.addr
+}
+
+func connectClient(t *testing.T, hostname, owners string, port int) string {
+	conn := &ssh.ServerConn{
+		Conn:        fakeClientConn{user: hostname, addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: port}},
+		Permissions: &ssh.Permissions{Extensions: map[string]string{"owners": owners, "pubkey-fp": hostname}},
+	}
+
+	id, _, err := users.AssociateClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	traffic.RegisterClient(id, hostname)
+	t.Cleanup(func() {
+		traffic.RemoveClient(id)
+		users.DisassociateClient(id, conn)
+	})
+
+	return id
+}
+
+func TestThrottleSharedClient(t *testing.T) {
+	shared := connectClient(t, "shared", "", 1)
+	owned := connectClient(t, "owned", "jim", 2)
+
+	jim, _, err := users.CreateOrGetUser("jim", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := (&throttle{}).Run(jim, &out, terminal.ParseLine("throttle -c * --rate 1KB", 0)); err != nil {
+		t.Fatal(err)
+	}
+	defer traffic.RemoveLimit(traffic.ClientKind, "*", "jim", false)
+
+	// Every user goes through a shared client, so one user must not be able to slow it down for the rest
+	if limit := traffic.GetClient(shared).Limit(); limit != 0 {
+		t.Fatalf("non-admin throttled a shared client to %d bytes/s", limit)
+	}
+
+	if limit := traffic.GetClient(owned).Limit(); limit != 1024 {
+		t.Fatalf("non-admin could not throttle their own client, limit is %d bytes/s", limit)
+	}
+}
@@ -0,0 +1,88 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/multiplexer"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+)
+
+type tlsCommand struct {
+}
+
+func (t *tlsCommand) ValidArgs() map[string]string {
+	r := map[string]string{}
+
+	addDuplicateFlags("Reload certificates from disk now, rather than when the change is noticed (admin only)", r, "r", "reload")
+
+	return r
+}
+
+func (t *tlsCommand) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+
+	if line.IsSet("r") || line.IsSet("reload") {
+		if user.Privilege() != users.AdminPermissions {
+			return errors.New("only administrators can reload certificates")
+		}
+
+		if err := multiplexer.ServerMultiplexer.ReloadTLS(); err != nil {
+			return fmt.Errorf("reload failed, still using the previous certificates: %w", err)
+		}
+
+		fmt.Fprintln(tty, "Reloaded TLS certificates")
+	}
+
+	certs := multiplexer.ServerMultiplexer.TLSCertificates()
+	if len(certs) == 0 {
+		fmt.Fprintln(tty, "TLS is not enabled")
+		return nil
+	}
+
+	tab, err := table.NewTable("TLS Certificates", "Path", "Names", "Expires", "Public Key Pin")
+	if err != nil {
+		return err
+	}
+
+	for _, c := range certs {
+		path := c.CertPath
+		if c.Automatic {
+			path += " (automatic)"
+		}
+
+		names := append([]string{}, c.Leaf.DNSNames...)
+		for _, ip := range c.Leaf.IPAddresses {
+			names = append(names, ip.String())
+		}
+
+		if len(names) == 0 {
+			names = append(names, c.Leaf.Subject.CommonName)
+		}
+
+		tab.AddValues(path, strings.Join(names, "\n"), c.Leaf.NotAfter.Format("2006/01/02 15:04:05"), internal.TLSPublicKeyPinHex(c.Leaf))
+	}
+
+	tab.Fprint(tty)
+
+	return nil
+}
+
+func (t *tlsCommand) Expect(line terminal.ParsedLine) []string {
+	return nil
+}
+
+func (t *tlsCommand) Help(explain bool) string {
+	if explain {
+		return "List or reload the TLS certificates served by the multiplexer"
+	}
+
+	return terminal.MakeHelpText(t.ValidArgs(),
+		"tls [OPTIONS]",
+		"Certificate files are checked for changes every few seconds while clients connect, and the first certificate is used when no SNI matches",
+	)
+}
@@ -0,0 +1,198 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/traffic"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+)
+
+type trafficCommand struct {
+}
+
+func (t *trafficCommand) ValidArgs() map[string]string {
+	r := map[string]string{
+		"history": "Show persisted daily totals, optionally limited to the last n days, e.g --history 7 (admin only)",
+	}
+
+	addDuplicateFlags("Show traffic for rssh users, proxies and proxy forwards instead of clients", r, "u", "users")
+
+	return r
+}
+
+func rate(s traffic.Stats) string {
+	r := fmt.Sprintf("in:  %s/s\nout: %s/s", traffic.FormatBytes(s.RateIn), traffic.FormatBytes(s.RateOut))
+	if s.Limit != 0 {
+		r += fmt.Sprintf("\nlimit: %s/s", traffic.FormatBytes(s.Limit))
+	}
+
+	return r
+}
+
+func total(s traffic.Stats) string {
+	return fmt.Sprintf("in:  %s\nout: %s", traffic.FormatBytes(s.In), traffic.FormatBytes(s.Out))
+}
+
+// Busiest first, so a forward saturating a link is always at the top
+func sortByRate(stats []traffic.Stats) {
+	sort.SliceStable(stats, func(i, j int) bool {
+		return stats[i].RateIn+stats[i].RateOut > stats[j].RateIn+stats[j].RateOut
+	})
+}
+
+func (t *trafficCommand) history(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+	if user.Privilege() != users.AdminPermissions {
+		return errors.New("only administrators can view traffic history")
+	}
+
+	since := ""
+	if days, err := line.GetArgString("history"); err == nil {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid number of days %q", days)
+		}
+
+		since = time.Now().AddDate(0, 0, -(n - 1)).Format("2006-01-02")
+	}
+
+	records, err := data.ListTraffic(since)
+	if err != nil {
+		return err
+	}
+
+	if len(records) == 0 {
+		return errors.New("No traffic has been recorded")
+	}
+
+	tab, err := table.NewTable("Daily Traffic", "Day", "Type", "Name", "Description", "In", "Out")
+	if err != nil {
+		return err
+	}
+
+	var totalIn, totalOut uint64
+	for _, r := range records {
+		tab.AddValues(r.Day, r.Kind, r.Name, r.Description, traffic.FormatBytes(uint64(r.BytesIn)), traffic.FormatBytes(uint64(r.BytesOut)))
+
+		// Every byte a client moves is also counted against an operator or proxy, so only total the clients
+		if r.Kind == traffic.ClientKind {
+			totalIn += uint64(r.BytesIn)
+			totalOut += uint64(r.BytesOut)
+		}
+	}
+
+	tab.Fprint(tty)
+
+	fmt.Fprintf(tty, "Total client traffic, in: %s out: %s\n", traffic.FormatBytes(totalIn), traffic.FormatBytes(totalOut))
+
+	return nil
+}
+
+func (t *trafficCommand) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+
+	if line.IsSet("history") {
+		return t.history(user, tty, line)
+	}
+
+	if line.IsSet("u") || line.IsSet("users") {
+		var stats []traffic.Stats
+		all := append(traffic.List(traffic.OperatorKind), traffic.List(traffic.ProxyKind)...)
+		all = append(all, traffic.List(traffic.ForwardKind)...)
+
+		for _, s := range all {
+			if user.Privilege() == users.AdminPermissions || (s.Kind == traffic.OperatorKind && s.Name == user.Username()) {
+				stats = append(stats, s)
+			}
+		}
+
+		if len(stats) == 0 {
+			return errors.New("No user traffic recorded")
+		}
+
+		sortByRate(stats)
+
+		tab, err := table.NewTable("User Traffic", "Type", "Name", "Total", "Current")
+		if err != nil {
+			return err
+		}
+
+		for _, s := range stats {
+			tab.AddValues(s.Kind, s.Name, total(s), rate(s))
+		}
+
+		tab.Fprint(tty)
+
+		return nil
+	}
+
+	filter := strings.Join(line.ArgumentsAsStrings(), " ")
+
+	matchingClients, err := user.SearchClients(filter)
+	if err != nil {
+		return err
+	}
+
+	if len(matchingClients) == 0 {
+		if len(filter) == 0 {
+			return fmt.Errorf("No RSSH clients connected")
+		}
+
+		return fmt.Errorf("Unable to find match for %q", filter)
+	}
+
+	var stats []traffic.Stats
+	for id, sc := range matchingClients {
+		s := traffic.GetClient(id).Stats()
+		s.Name = id
+		s.Description = users.NormaliseHostname(sc.User())
+
+		stats = append(stats, s)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	sortByRate(stats)
+
+	tab, err := table.NewTable("Client Traffic", "ID", "Hostname", "Total", "Current")
+	if err != nil {
+		return err
+	}
+
+	for _, s := range stats {
+		tab.AddValues(s.Name, s.Description, total(s), rate(s))
+	}
+
+	tab.Fprint(tty)
+
+	return nil
+}
+
+func (t *trafficCommand) Expect(line terminal.ParsedLine) []string {
+	if len(line.Arguments) <= 1 {
+		return []string{autocomplete.RemoteId}
+	}
+	return nil
+}
+
+func (t *trafficCommand) Help(explain bool) string {
+	if explain {
+		return "Show data volumes and current throughput of clients and users"
+	}
+
+	return terminal.MakeHelpText(t.ValidArgs(),
+		"traffic [OPTIONS] [FILTER]",
+		"Shows bytes moved through the server since it started, busiest connections first",
+		"In and out are relative to the server, so client 'in' is upload from the client host",
+		"Filter uses glob matching against all attributes of a target (id, public key hash, hostname, ip)",
+	)
+}
@@ -0,0 +1,221 @@
+package commands
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/traffic"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
+	"golang.org/x/crypto/ssh"
+)
+
+type upgrade struct {
+}
+
+func (u *upgrade) ValidArgs() map[string]string {
+	return map[string]string{
+		"link":  "Name of the link to upgrade to, as shown by link -l",
+		"force": "Upgrade clients even if they cant be shown to be on the same platform as the link",
+		"y":     "Do not prompt for confirmation",
+	}
+}
+
+// clientPlatform uses the platform the client advertised, or takes it from the default client version, SSH-<version>-<goos>_<goarch>. Older clients with a custom version string dont have one
+func clientPlatform(sc ssh.Conn) (goos, goarch string, ok bool) {
+	platform := string(sc.ClientVersion())
+	if c, advertised := users.GetCapabilities(sc); advertised {
+		platform = c.Platform
+	} else if i := strings.LastIndex(platform, "-"); i != -1 {
+		platform = platform[i+1:]
+	}
+
+	return strings.Cut(platform, "_")
+}
+
+func (u *upgrade) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+
+	if len(line.Arguments) == 0 {
+		return errors.New(u.Help(false))
+	}
+
+	// Flags take every argument after them, so the filter has to come first
+	if len(line.FlagsOrdered) > 0 && line.Arguments[0].Start() > line.FlagsOrdered[0].Start() {
+		return errors.New("the remote id or filter must come before any options, e.g upgrade * --link name")
+	}
+
+	filter := line.Arguments[0].Value()
+
+	name, err := line.GetArgString("link")
+	if err != nil {
+		return errors.New("--link is required, " + u.Help(false))
+	}
+
+	links, err := data.ListDownloads(name)
+	if err != nil {
+		return err
+	}
+
+	download, ok := links[name]
+	if !ok {
+		return fmt.Errorf("no link named %q", name)
+	}
+
+	if download.FileType != "executable" {
+		return fmt.Errorf("link %q is a %s, clients can only upgrade to an executable", name, download.FileType)
+	}
+
+	f, err := os.Open(download.FilePath)
+	if err != nil {
+		return fmt.Errorf("unable to open link %q: %w", name, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return fmt.Errorf("unable to read link %q: %w", name, err)
+	}
+
+	payload := ssh.Marshal(&internal.Upgrade{
+		Size:    uint64(size),
+		Hash:    hex.EncodeToString(h.Sum(nil)),
+		Version: download.Version,
+	})
+
+	connections, err := user.SearchClients(filter)
+	if err != nil {
+		return err
+	}
+
+	if len(connections) == 0 {
+		return fmt.Errorf("No clients matched %q", filter)
+	}
+
+	if !line.IsSet("y") {
+		fmt.Fprintf(tty, "Upgrade %d clients to %s (%s/%s)? [N/y] ", len(connections), name, download.Goos, download.Goarch)
+
+		if term, ok := tty.(*terminal.Terminal); ok {
+			term.EnableRaw()
+		}
+
+		b := make([]byte, 1)
+		_, err := tty.Read(b)
+		if term, ok := tty.(*terminal.Terminal); ok {
+			term.DisableRaw(false)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if !(b[0] == 'y' || b[0] == 'Y') {
+			return fmt.Errorf("\nUser did not enter y/Y, aborting")
+		}
+
+		fmt.Fprint(tty, "\n")
+	}
+
+	upgraded := 0
+	for id, serverConn := range connections {
+		version := string(serverConn.ClientVersion())
+
+		if !users.Supports(serverConn, "rssh-upgrade") {
+			fmt.Fprintf(tty, "%s skipped, client does not support upgrading\n", id)
+			continue
+		}
+
+		if !line.IsSet("force") {
+			goos, goarch, ok := clientPlatform(serverConn)
+			if !ok {
+				fmt.Fprintf(tty, "%s skipped, cannot tell its platform from version %q (use --force)\n", id, version)
+				continue
+			}
+
+			if goos != download.Goos || goarch != download.Goarch {
+				fmt.Fprintf(tty, "%s skipped, it is %s/%s\n", id, goos, goarch)
+				continue
+			}
+		}
+
+		if err := sendUpgrade(serverConn, id, io.NewSectionReader(f, 0, size), payload); err != nil {
+			fmt.Fprintf(tty, "%s failed: %s\n", id, err)
+			continue
+		}
+
+		upgraded++
+		fmt.Fprintf(tty, "%s upgraded from %q, restarting\n", id, version)
+	}
+
+	return fmt.Errorf("%d of %d clients upgraded, they will show their new version when they reconnect", upgraded, len(connections))
+}
+
+func sendUpgrade(serverConn ssh.Conn, id string, executable io.Reader, payload []byte) error {
+	c, reqs, err := serverConn.OpenChannel("rssh-upgrade", payload)
+	if err != nil {
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) && openErr.Reason == ssh.UnknownChannelType {
+			return errors.New("client is outdated and cannot upgrade itself")
+		}
+
+		return err
+	}
+	defer c.Close()
+	go ssh.DiscardRequests(reqs)
+
+	_, err = traffic.Copy(c, executable, traffic.ToClient, traffic.GetClient(id), nil)
+	if err != nil {
+		return err
+	}
+
+	c.CloseWrite()
+
+	result, err := io.ReadAll(c)
+	if err != nil {
+		return err
+	}
+
+	switch string(result) {
+	case internal.UpgradeOK:
+		return nil
+	case "":
+		return errors.New("client disconnected before confirming the upgrade")
+	}
+
+	return errors.New(string(result))
+}
+
+func (u *upgrade) Expect(line terminal.ParsedLine) []string {
+	if line.Section != nil {
+		switch line.Section.Value() {
+		case "link":
+			return []string{autocomplete.WebServerFileIds}
+		}
+	}
+
+	if len(line.Arguments) <= 1 {
+		return []string{autocomplete.RemoteId}
+	}
+	return nil
+}
+
+func (u *upgrade) Help(explain bool) string {
+	const description = "Replace the executable of connected clients with a link, then restart them"
+	if explain {
+		return description
+	}
+
+	return terminal.MakeHelpText(u.ValidArgs(),
+		"upgrade <remote_id|glob pattern> --link <name>",
+		description,
+		"Clients check the size and sha256 of what they receive, then restart with the same arguments.",
+	)
+}
@@ -96,5 +96,9 @@ func DeleteDownload(key string) error {
 		return err
 	}
 
+	if err := RevokeEnrolmentTokens(key); err != nil {
+		return err
+	}
+
 	return os.Remove(download.FilePath)
 }
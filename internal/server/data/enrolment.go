@@ -0,0 +1,114 @@
+package data
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"gorm.io/gorm"
+)
+
+type EnrolmentToken struct {
+	gorm.Model
+
+	// Only the hash is stored, so reading the database does not give out usable tokens
+	TokenHash string `gorm:"uniqueIndex"`
+
+	// Download link the token was baked into
+	Name string
+
+	Owners  string
+	Comment string
+
+	ExpiresAt time.Time
+
+	UsedAt *time.Time
+	// Fingerprint of the key that was enrolled with this token
+	UsedBy string
+}
+
+var ErrInvalidEnrolmentToken = errors.New("invalid, expired or already used enrolment token")
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func CreateEnrolmentToken(name, owners, comment string, lifetime time.Duration) (string, error) {
+	token, err := internal.RandomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	t := EnrolmentToken{
+		TokenHash: hashToken(token),
+		Name:      name,
+		Owners:    owners,
+		Comment:   comment,
+		ExpiresAt: time.Now().Add(lifetime),
+	}
+
+	if err := db.Create(&t).Error; err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// ConsumeEnrolmentToken marks the token as used by usedBy, a token can only ever be consumed once
+func ConsumeEnrolmentToken(token, usedBy string) (EnrolmentToken, error) {
+	var t EnrolmentToken
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		// Single conditional update so two clients racing with the same token cant both win
+		res := tx.Model(&EnrolmentToken{}).
+			Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", hashToken(token), now).
+			Updates(map[string]interface{}{"used_at": now, "used_by": usedBy})
+		if res.Error != nil {
+			return res.Error
+		}
+
+		if res.RowsAffected != 1 {
+			return ErrInvalidEnrolmentToken
+		}
+
+		return tx.Where("token_hash = ?", hashToken(token)).First(&t).Error
+	})
+
+	return t, err
+}
+
+// ReleaseEnrolmentToken undoes ConsumeEnrolmentToken when the key that used it could not be enrolled, so the token can be used again
+func ReleaseEnrolmentToken(token, usedBy string) error {
+	return db.Model(&EnrolmentToken{}).
+		Where("token_hash = ? AND used_by = ?", hashToken(token), usedBy).
+		Updates(map[string]interface{}{"used_at": nil, "used_by": ""}).Error
+}
+
+// HasPendingEnrolments returns true if any unused and unexpired tokens exist
+func HasPendingEnrolments() bool {
+	var count int64
+	if err := db.Model(&EnrolmentToken{}).Where("used_at IS NULL AND expires_at > ?", time.Now()).Count(&count).Error; err != nil {
+		return false
+	}
+
+	return count > 0
+}
+
+func ListEnrolmentTokens() ([]EnrolmentToken, error) {
+	var tokens []EnrolmentToken
+	if err := db.Order("created_at").Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// RevokeEnrolmentTokens removes every unused token for the named link
+func RevokeEnrolmentTokens(name string) error {
+	return db.Where("name = ? AND used_at IS NULL", name).Delete(&EnrolmentToken{}).Error
+}
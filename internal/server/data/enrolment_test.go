@@ -0,0 +1,99 @@
+package data
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEnrolmentTokens(t *testing.T) {
+	if err := LoadDatabase(filepath.Join(t.TempDir(), "data.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	if HasPendingEnrolments() {
+		t.Fatal("new database should have no pending enrolments")
+	}
+
+	token, err := CreateEnrolmentToken("test", "jim", "comment", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !HasPendingEnrolments() {
+		t.Fatal("minted token should be pending")
+	}
+
+	tokens, err := ListEnrolmentTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tokens) != 1 || tokens[0].TokenHash == token {
+		t.Fatal("token should be stored only as its hash")
+	}
+
+	if _, err := ConsumeEnrolmentToken("not the token", "aa"); !errors.Is(err, ErrInvalidEnrolmentToken) {
+		t.Fatalf("wrong token was accepted: %v", err)
+	}
+
+	used, err := ConsumeEnrolmentToken(token, "aa")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if used.Owners != "jim" || used.Comment != "comment" || used.UsedBy != "aa" || used.UsedAt == nil {
+		t.Fatalf("consumed token has unexpected details: %+v", used)
+	}
+
+	if _, err := ConsumeEnrolmentToken(token, "bb"); !errors.Is(err, ErrInvalidEnrolmentToken) {
+		t.Fatalf("token was replayed: %v", err)
+	}
+
+	if err := ReleaseEnrolmentToken(token, "bb"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ConsumeEnrolmentToken(token, "bb"); !errors.Is(err, ErrInvalidEnrolmentToken) {
+		t.Fatal("token was released by a key that did not use it")
+	}
+
+	if err := ReleaseEnrolmentToken(token, "aa"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !HasPendingEnrolments() {
+		t.Fatal("released token should be pending again")
+	}
+
+	if _, err := ConsumeEnrolmentToken(token, "bb"); err != nil {
+		t.Fatal("released token could not be used again: ", err)
+	}
+
+	if HasPendingEnrolments() {
+		t.Fatal("consumed token should not be pending")
+	}
+
+	expired, err := CreateEnrolmentToken("expired", "", "", -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ConsumeEnrolmentToken(expired, "cc"); !errors.Is(err, ErrInvalidEnrolmentToken) {
+		t.Fatalf("expired token was accepted: %v", err)
+	}
+
+	revoked, err := CreateEnrolmentToken("revoked", "", "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RevokeEnrolmentTokens("revoked"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ConsumeEnrolmentToken(revoked, "dd"); !errors.Is(err, ErrInvalidEnrolmentToken) {
+		t.Fatalf("revoked token was accepted: %v", err)
+	}
+}
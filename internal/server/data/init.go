@@ -17,7 +17,7 @@ func LoadDatabase(path string) (err error) {
 	}
 
 	// AutoMigrate will create the table if it does not exist, or update it if it has changed
-	err = db.AutoMigrate(&Webhook{}, &Download{})
+	err = db.AutoMigrate(&Webhook{}, &Download{}, &Traffic{}, &MFA{}, &EnrolmentToken{}, &Listener{})
 	if err != nil {
 		return err
 	}
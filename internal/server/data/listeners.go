@@ -0,0 +1,45 @@
+package data
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Listener is a server listener added at runtime, options are kept in the same form as the listen command takes them
+type Listener struct {
+	gorm.Model
+
+	Address        string `gorm:"uniqueIndex"`
+	Protocols      string
+	Logins         string
+	TrustedProxies string
+}
+
+func SaveListener(l Listener) error {
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "address"}},
+		DoUpdates: clause.AssignmentColumns([]string{"protocols", "logins", "trusted_proxies", "updated_at"}),
+	}).Create(&l).Error
+}
+
+func DeleteListener(address string) error {
+	res := db.Unscoped().Where("address = ?", address).Delete(&Listener{})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func ListListeners() ([]Listener, error) {
+	var listeners []Listener
+	if err := db.Order("address").Find(&listeners).Error; err != nil {
+		return nil, err
+	}
+
+	return listeners, nil
+}
@@ -0,0 +1,57 @@
+package data
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type MFA struct {
+	gorm.Model
+
+	// The username, or key:<sha256 fingerprint> for administrators as their keys can log in under any name
+	Username string `gorm:"uniqueIndex"`
+	Secret   string
+}
+
+func SetMFASecret(username, secret string) error {
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "username"}},
+		DoUpdates: clause.AssignmentColumns([]string{"secret", "updated_at"}),
+	}).Create(&MFA{Username: username, Secret: secret}).Error
+}
+
+func GetMFASecret(username string) (string, error) {
+	// Find rather than First, as not being enrolled is normal and First logs every miss
+	var m []MFA
+	if err := db.Where("username = ?", username).Limit(1).Find(&m).Error; err != nil {
+		return "", err
+	}
+
+	if len(m) == 0 {
+		return "", gorm.ErrRecordNotFound
+	}
+
+	return m[0].Secret, nil
+}
+
+func DeleteMFA(username string) error {
+	res := db.Unscoped().Where("username = ?", username).Delete(&MFA{})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func ListMFA() ([]MFA, error) {
+	var enrolled []MFA
+	if err := db.Order("username").Find(&enrolled).Error; err != nil {
+		return nil, err
+	}
+
+	return enrolled, nil
+}
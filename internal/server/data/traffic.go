@@ -0,0 +1,56 @@
+package data
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Traffic is the daily aggregate of bytes moved through the server for a single client, operator or proxy
+type Traffic struct {
+	Day  string `gorm:"uniqueIndex:idx_traffic_day_subject"`
+	Kind string `gorm:"uniqueIndex:idx_traffic_day_subject"`
+	Name string `gorm:"uniqueIndex:idx_traffic_day_subject"`
+
+	// Hostname or other human readable label for Name
+	Description string
+
+	// Relative to the server, BytesIn is what was received from the subject and BytesOut is what was sent to it
+	BytesIn  int64
+	BytesOut int64
+}
+
+func AddTraffic(day, kind, name, description string, in, out int64) error {
+	record := Traffic{
+		Day:         day,
+		Kind:        kind,
+		Name:        name,
+		Description: description,
+		BytesIn:     in,
+		BytesOut:    out,
+	}
+
+	return db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "day"}, {Name: "kind"}, {Name: "name"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"bytes_in":    gorm.Expr("bytes_in + ?", in),
+			"bytes_out":   gorm.Expr("bytes_out + ?", out),
+			"description": description,
+		}),
+	}).Create(&record).Error
+}
+
+// ListTraffic returns all daily aggregates on or after the since date (YYYY-MM-DD), empty since returns everything
+func ListTraffic(since string) ([]Traffic, error) {
+	var records []Traffic
+
+	query := db.Order("day asc, kind asc, name asc")
+	if since != "" {
+		query = query.Where("day >= ?", since)
+	}
+
+	if err := query.Find(&records).Error; err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"golang.org/x/crypto/ssh"
+)
+
+// enrolmentChallenge asks an unknown key for an enrolment token over keyboard-interactive authentication while tokens are outstanding.
+// Only once a token has been consumed and the key added to authorized_controllee_keys does the connection get any permissions, which authorized then supplies.
+// If the key cannot be added the token is released again
+func enrolmentChallenge(key ssh.PublicKey, authorizedControlleeKeysPath string, authorized func() (*ssh.Permissions, error)) error {
+	return &ssh.PartialSuccessError{
+		Next: ssh.ServerAuthCallbacks{
+			KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+				answers, err := client(conn.User(), "", []string{"Enrolment token: "}, []bool{false})
+				if err != nil {
+					return nil, err
+				}
+
+				fingerprint := internal.FingerprintSHA1Hex(key)
+				if len(answers) != 1 {
+					return nil, fmt.Errorf("client (%s) failed enrolment: expected a single token", fingerprint)
+				}
+
+				token, err := data.ConsumeEnrolmentToken(answers[0], fingerprint)
+				if err != nil {
+					return nil, fmt.Errorf("client (%s) failed enrolment: %s", fingerprint, err)
+				}
+
+				if err := authorizeControllee(authorizedControlleeKeysPath, key, token.Owners, token.Comment); err != nil {
+					if releaseErr := data.ReleaseEnrolmentToken(answers[0], fingerprint); releaseErr != nil {
+						log.Printf("Unable to release enrolment token from link %q after failing to enrol %s: %s", token.Name, fingerprint, releaseErr)
+					}
+
+					return nil, fmt.Errorf("unable to save enrolled key: %s", err)
+				}
+
+				log.Printf("Enrolled new client %s (%s) using token from link %q", strconv.QuoteToGraphic(conn.User()), fingerprint, token.Name)
+
+				return authorized()
+			},
+		},
+	}
+}
+
+func authorizeControllee(path string, publicKey ssh.PublicKey, owners, comment string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(fmt.Sprintf("%s %s %s\n", "owner="+strconv.Quote(owners), strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))), comment))
+	return err
+}
@@ -1,16 +1,16 @@
 package handlers
 
 import (
-	"io"
 	"os"
 	"path"
 
+	"github.com/NHAS/reverse_ssh/internal/server/traffic"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
 	"golang.org/x/crypto/ssh"
 )
 
-func Download(dataDir string) func(_ string, _ *users.User, newChannel ssh.NewChannel, log logger.Logger) {
+func Download(dataDir, clientId string) func(_ string, _ *users.User, newChannel ssh.NewChannel, log logger.Logger) {
 	return func(_ string, _ *users.User, newChannel ssh.NewChannel, log logger.Logger) {
 		downloadPath := path.Join("/", string(newChannel.ExtraData()))
 		//Has to be done in two steps, doing Join("./downloads/", path) leads to path traversal (thanks go)
@@ -40,7 +40,7 @@ func Download(dataDir string) func(_ string, _ *users.User, newChannel ssh.NewCh
 		defer c.Close()
 		go ssh.DiscardRequests(r)
 
-		_, err = io.Copy(c, f)
+		_, err = traffic.Copy(c, f, traffic.ToClient, traffic.GetClient(clientId), nil)
 		if err != nil {
 			log.Warning("failed to copy to remote client: %s", err)
 			return
@@ -9,6 +9,7 @@ import (
 
 	"github.com/NHAS/reverse_ssh/internal"
 	"github.com/NHAS/reverse_ssh/internal/server/multiplexer"
+	"github.com/NHAS/reverse_ssh/internal/server/traffic"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
 	"golang.org/x/crypto/ssh"
@@ -122,7 +123,8 @@ func ServerPortForward(clientId string) func(_ string, _ *users.User, newChannel
 		currentRemoteForwards[clientId] = net.JoinHostPort(drtMsg.Raddr, fmt.Sprintf("%d", drtMsg.Rport))
 		currentRemoteForwardsLck.Unlock()
 
-		multiplexer.ServerMultiplexer.QueueConn(channelToConn(connection, drtMsg))
+		// Whoever connects through the forwarded port isnt known yet, so only the client is credited
+		multiplexer.ServerMultiplexer.QueueConn(traffic.Conn(channelToConn(connection, drtMsg), traffic.GetClient(clientId), nil))
 
 	}
 }
@@ -3,11 +3,11 @@ package handlers
 import (
 	"encoding/binary"
 	"fmt"
-	"io"
 	"net"
 	"strconv"
 
 	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/traffic"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
 	"golang.org/x/crypto/ssh"
@@ -51,10 +51,14 @@ func LocalForward(_ string, user *users.User, newChannel ssh.NewChannel, log log
 		return
 	}
 
-	var target ssh.Conn
+	var (
+		target   ssh.Conn
+		targetId string
+	)
 	//Horrible way of getting the first element of a map in go
 	for k := range foundClients {
 		target = foundClients[k]
+		targetId = k
 		break
 	}
 
@@ -74,9 +78,12 @@ func LocalForward(_ string, user *users.User, newChannel ssh.NewChannel, log log
 	defer connection.Close()
 	go ssh.DiscardRequests(requests)
 
+	clientCounter := traffic.GetClient(targetId)
+	operatorCounter := traffic.Operator(user.Username())
+
 	go func() {
-		io.Copy(connection, targetConnection)
+		traffic.Copy(connection, targetConnection, traffic.FromClient, clientCounter, operatorCounter)
 		connection.Close()
 	}()
-	io.Copy(targetConnection, connection)
+	traffic.Copy(targetConnection, connection, traffic.ToClient, clientCounter, operatorCounter)
 }
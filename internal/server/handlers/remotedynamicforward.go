@@ -2,12 +2,12 @@ package handlers
 
 import (
 	"fmt"
-	"io"
 	"net"
 	"strconv"
 	"strings"
 
 	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/traffic"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
 	"golang.org/x/crypto/ssh"
 )
@@ -16,6 +16,11 @@ import (
 // This is so when on a machine with strict av that has a regular ssh client you can do `ssh -R port rssh.server` and get a proxiable port into the network
 func RemoteDynamicForward(sshConn ssh.Conn, reqs <-chan *ssh.Request, log logger.Logger) {
 	defer sshConn.Close()
+
+	counterName := sshConn.User() + "@" + sshConn.RemoteAddr().String()
+	counter := traffic.RegisterProxy(counterName, string(sshConn.ClientVersion()))
+	defer traffic.RemoveProxy(counterName)
+
 	clientClosed := make(chan bool)
 	for r := range reqs {
 
@@ -34,14 +39,18 @@ func RemoteDynamicForward(sshConn ssh.Conn, reqs <-chan *ssh.Request, log logger
 				}
 
 				// Ignore rf.BindAddr, helps us mitigate malicious clients
-				l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", rf.BindPort))
+				forwardAddress := fmt.Sprintf("127.0.0.1:%d", rf.BindPort)
+				l, err := net.Listen("tcp", forwardAddress)
 				if err != nil {
 					log.Warning("failed to listen for remote forward request: %s", err)
 					req.Reply(false, []byte("Unable to open remote forward"))
 					return
 				}
 
-				log.Info("Opened remote forward port on server: 127.0.0.1:%d", rf.BindPort)
+				log.Info("Opened remote forward port on server: %s", forwardAddress)
+
+				forwardCounter := traffic.RegisterForward(forwardAddress, counter)
+				defer traffic.RemoveForward(forwardAddress)
 
 				go func() {
 					<-clientClosed
@@ -60,7 +69,7 @@ func RemoteDynamicForward(sshConn ssh.Conn, reqs <-chan *ssh.Request, log logger
 						}
 						return
 					}
-					go handleData(rf, proxyCon, sshConn)
+					go handleData(rf, proxyCon, sshConn, forwardCounter)
 				}
 
 			}(r)
@@ -81,7 +90,7 @@ func RemoteDynamicForward(sshConn ssh.Conn, reqs <-chan *ssh.Request, log logger
 
 }
 
-func handleData(rf internal.RemoteForwardRequest, proxyCon net.Conn, sshConn ssh.Conn) error {
+func handleData(rf internal.RemoteForwardRequest, proxyCon net.Conn, sshConn ssh.Conn, counter *traffic.Counter) error {
 
 	originatorAddress := proxyCon.LocalAddr().String()
 	var originatorPort uint32
@@ -122,13 +131,13 @@ func handleData(rf internal.RemoteForwardRequest, proxyCon net.Conn, sshConn ssh
 		defer destination.Close()
 		defer proxyCon.Close()
 
-		io.Copy(destination, proxyCon)
+		traffic.Copy(destination, proxyCon, traffic.ToClient, counter, nil)
 	}()
 	go func() {
 		defer destination.Close()
 		defer proxyCon.Close()
 
-		io.Copy(proxyCon, destination)
+		traffic.Copy(proxyCon, destination, traffic.FromClient, counter, nil)
 
 	}()
 
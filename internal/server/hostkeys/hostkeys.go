@@ -0,0 +1,252 @@
+package hostkeys
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"golang.org/x/crypto/ssh"
+)
+
+// The server presents one host key per algorithm, so rotation is done in two stages.
+// Rotate creates a next key that connected clients are told about while the server keeps presenting the current one,
+// once the overlap is over the next key becomes current and the old key is retired.
+var (
+	lck sync.RWMutex
+
+	// Path to the current key, next and retired keys are stored alongside it
+	path    string
+	current ssh.Signer
+
+	next       ssh.Signer
+	activateAt time.Time
+
+	onActivate func(ssh.Signer)
+)
+
+type Key struct {
+	State       string
+	Fingerprint string
+	ActivateAt  time.Time
+}
+
+func nextPath() string {
+	return path + ".next"
+}
+
+func activatePath() string {
+	return path + ".next.activate"
+}
+
+// Init sets the current key loaded from keyPath, and loads any rotation that was in progress when the server last stopped
+func Init(keyPath string, currentKey ssh.Signer, activated func(ssh.Signer)) error {
+	lck.Lock()
+	defer lck.Unlock()
+
+	path = keyPath
+	current = currentKey
+	onActivate = activated
+
+	nextBytes, err := os.ReadFile(nextPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	next, err = ssh.ParsePrivateKey(nextBytes)
+	if err != nil {
+		return fmt.Errorf("unable to parse next host key %s: %w", nextPath(), err)
+	}
+
+	activateBytes, err := os.ReadFile(activatePath())
+	if err != nil {
+		return fmt.Errorf("next host key exists without an activation time: %w", err)
+	}
+
+	unix, err := strconv.ParseInt(strings.TrimSpace(string(activateBytes)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid activation time in %s: %w", activatePath(), err)
+	}
+
+	activateAt = time.Unix(unix, 0)
+
+	log.Printf("Host key rotation in progress, %s will replace the current key at %s", internal.FingerprintSHA256Hex(next.PublicKey()), activateAt.Format(time.RFC3339))
+
+	return nil
+}
+
+func Current() ssh.Signer {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	return current
+}
+
+func List() []Key {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	keys := []Key{{State: "current", Fingerprint: internal.FingerprintSHA256Hex(current.PublicKey())}}
+	if next != nil {
+		keys = append(keys, Key{State: "next", Fingerprint: internal.FingerprintSHA256Hex(next.PublicKey()), ActivateAt: activateAt})
+	}
+
+	return keys
+}
+
+// Rotate generates the next host key, which replaces the current key after overlap
+func Rotate(overlap time.Duration) (ssh.PublicKey, error) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	if next != nil {
+		return nil, errors.New("a rotation is already in progress, activate or cancel it first")
+	}
+
+	privateKeyPem, err := internal.GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(privateKeyPem)
+	if err != nil {
+		return nil, err
+	}
+
+	when := time.Now().Add(overlap)
+
+	if err := os.WriteFile(activatePath(), []byte(strconv.FormatInt(when.Unix(), 10)), 0600); err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(nextPath(), privateKeyPem, 0600); err != nil {
+		os.Remove(activatePath())
+		return nil, err
+	}
+
+	next = signer
+	activateAt = when
+
+	return signer.PublicKey(), nil
+}
+
+// Cancel discards the next key
+func Cancel() error {
+	lck.Lock()
+	defer lck.Unlock()
+
+	if next == nil {
+		return errors.New("no rotation in progress")
+	}
+
+	if err := os.Remove(nextPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	os.Remove(activatePath())
+
+	next = nil
+	activateAt = time.Time{}
+
+	return nil
+}
+
+// Activate ends the overlap immediately, the next key becomes current and the old key is kept on disk as retired
+func Activate() error {
+	lck.Lock()
+
+	if next == nil {
+		lck.Unlock()
+		return errors.New("no rotation in progress")
+	}
+
+	retiredPath := fmt.Sprintf("%s.retired.%d", path, time.Now().Unix())
+	if err := os.Rename(path, retiredPath); err != nil {
+		lck.Unlock()
+		return fmt.Errorf("unable to retire current host key: %w", err)
+	}
+
+	if err := os.Rename(nextPath(), path); err != nil {
+		// Put things back the way they were so the server still starts with a valid key
+		os.Rename(retiredPath, path)
+		lck.Unlock()
+		return fmt.Errorf("unable to activate next host key: %w", err)
+	}
+	os.Remove(activatePath())
+
+	log.Printf("Host key rotated, %s retired to %s, now using %s", internal.FingerprintSHA256Hex(current.PublicKey()), retiredPath, internal.FingerprintSHA256Hex(next.PublicKey()))
+
+	current = next
+	next = nil
+	activateAt = time.Time{}
+
+	activated := current
+	callback := onActivate
+	lck.Unlock()
+
+	if callback != nil {
+		callback(activated)
+	}
+
+	return nil
+}
+
+// Start activates the next key once its overlap has passed
+func Start() {
+	for range time.Tick(time.Minute) {
+		lck.RLock()
+		due := next != nil && time.Now().After(activateAt)
+		lck.RUnlock()
+
+		if due {
+			if err := Activate(); err != nil {
+				log.Println("Scheduled host key rotation failed: ", err)
+			}
+		}
+	}
+}
+
+// Announce tells a connected client about the next key, signed by the current key over this connections session id.
+// Returns false if no rotation is in progress, or the client did not accept the key
+func Announce(conn ssh.Conn) (bool, error) {
+	lck.RLock()
+	if next == nil {
+		lck.RUnlock()
+		return false, nil
+	}
+
+	newKey := next.PublicKey().Marshal()
+	when := activateAt
+	signer := current
+	lck.RUnlock()
+
+	sig, err := signer.Sign(rand.Reader, append(append([]byte{}, conn.SessionID()...), newKey...))
+	if err != nil {
+		return false, err
+	}
+
+	announcement := internal.HostKeyAnnouncement{
+		NewKey:     newKey,
+		ActivateAt: uint64(when.Unix()),
+		Signature:  ssh.Marshal(sig),
+	}
+
+	accepted, reply, err := conn.SendRequest("hostkey-rotate-rssh@golang.org", true, ssh.Marshal(announcement))
+	if err != nil {
+		return false, err
+	}
+
+	if !accepted && len(reply) > 0 {
+		return false, errors.New(string(reply))
+	}
+
+	return accepted, nil
+}
@@ -0,0 +1,69 @@
+package hostkeys
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRotation(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "id_ed25519")
+
+	pem, err := internal.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(keyPath, pem, 0600)
+
+	original, _ := ssh.ParsePrivateKey(pem)
+
+	var activated ssh.Signer
+	if err := Init(keyPath, original, func(s ssh.Signer) { activated = s }); err != nil {
+		t.Fatal(err)
+	}
+
+	newKey, err := Rotate(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Rotate(time.Hour); err == nil {
+		t.Fatal("second rotation should be refused while one is in progress")
+	}
+
+	if Current() != original {
+		t.Fatal("current key should not change until activation")
+	}
+
+	// A restart part way through should pick the rotation back up
+	if err := Init(keyPath, original, func(s ssh.Signer) { activated = s }); err != nil {
+		t.Fatal(err)
+	}
+
+	if l := List(); len(l) != 2 || l[1].Fingerprint != internal.FingerprintSHA256Hex(newKey) {
+		t.Fatalf("expected next key to be reloaded, got %+v", l)
+	}
+
+	if err := Activate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if activated == nil || string(Current().PublicKey().Marshal()) != string(newKey.Marshal()) {
+		t.Fatal("next key should now be current")
+	}
+
+	onDisk, _ := os.ReadFile(keyPath)
+	if s, err := ssh.ParsePrivateKey(onDisk); err != nil || string(s.PublicKey().Marshal()) != string(newKey.Marshal()) {
+		t.Fatal("new key should be saved as the current key")
+	}
+
+	retired, _ := filepath.Glob(keyPath + ".retired.*")
+	if len(retired) != 1 {
+		t.Fatalf("expected the old key to be retired, got %v", retired)
+	}
+}
@@ -0,0 +1,220 @@
+package mfa
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/pkg/totp"
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+)
+
+// When set administrators (privilege 5) cannot log in without an enrolled second factor, on by default as their keys can log in as anyone
+var RequireForAdmins = true
+
+// Unconfirmed enrolments expire after this long
+const enrolmentTimeout = 10 * time.Minute
+
+type pending struct {
+	secret  string
+	expires time.Time
+}
+
+var (
+	lck sync.Mutex
+
+	// identity to the last time step a code was accepted for, so a code cannot be replayed within its window
+	lastUsed = map[string]int64{}
+
+	enrolments = map[string]pending{}
+)
+
+// Identity is what a second factor is stored under. Administrators keys can log in with any username, so their
+// second factor follows the key they authenticated with rather than the name they picked
+func Identity(username string, key ssh.PublicKey, admin bool) string {
+	if !admin {
+		return username
+	}
+
+	return KeyIdentity(key)
+}
+
+// KeyIdentity names a key, certificates are named by the key they certify so reissuing one keeps the second factor
+func KeyIdentity(key ssh.PublicKey) string {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+
+	return "key:" + internal.FingerprintSHA256Hex(key)
+}
+
+func Enrolled(identity string) (bool, error) {
+	_, err := data.GetMFASecret(identity)
+	if err == nil {
+		return true, nil
+	}
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+
+	return false, err
+}
+
+// Required decides whether an identity must complete a second factor, returns an error if it must but cannot
+func Required(identity string, admin bool) (bool, error) {
+	enrolled, err := Enrolled(identity)
+	if err != nil {
+		return false, fmt.Errorf("unable to check second factor enrolment: %s", err)
+	}
+
+	if !enrolled && admin && RequireForAdmins {
+		return false, fmt.Errorf("administrator key %s has not enrolled a second factor, and one is required (enrol with the server --enrol-mfa option)", identity)
+	}
+
+	return enrolled, nil
+}
+
+// Validate checks a code for an enrolled identity, each code is only accepted once
+func Validate(identity, code string) error {
+	secret, err := data.GetMFASecret(identity)
+	if err != nil {
+		return errors.New("no second factor enrolled")
+	}
+
+	step, ok := totp.Validate(secret, code, time.Now(), 1)
+	if !ok {
+		return errors.New("invalid verification code")
+	}
+
+	lck.Lock()
+	defer lck.Unlock()
+
+	if last, ok := lastUsed[identity]; ok && step <= last {
+		return errors.New("verification code has already been used")
+	}
+
+	lastUsed[identity] = step
+
+	return nil
+}
+
+// Challenge asks the client for a code over keyboard-interactive authentication
+func Challenge(username, identity string, client ssh.KeyboardInteractiveChallenge) error {
+	answers, err := client(username, "", []string{"Verification code: "}, []bool{false})
+	if err != nil {
+		return err
+	}
+
+	if len(answers) != 1 {
+		return errors.New("expected a single verification code")
+	}
+
+	return Validate(identity, answers[0])
+}
+
+// BeginEnrolment generates a new secret for identity, it is not used for logins until confirmed with a valid code
+func BeginEnrolment(identity string) (secret string, uri string, err error) {
+	secret, err = totp.GenerateSecret()
+	if err != nil {
+		return "", "", err
+	}
+
+	lck.Lock()
+	enrolments[identity] = pending{secret: secret, expires: time.Now().Add(enrolmentTimeout)}
+	lck.Unlock()
+
+	issuer := "rssh"
+	if internal.ConsoleLabel != "" {
+		issuer = strings.ReplaceAll(internal.ConsoleLabel, ":", "")
+	}
+
+	return secret, totp.ProvisioningURI(issuer, identity, secret), nil
+}
+
+// ConfirmEnrolment stores the pending secret if code is valid for it, replacing any existing secret
+func ConfirmEnrolment(identity, code string) error {
+	lck.Lock()
+	p, ok := enrolments[identity]
+	if ok && time.Now().After(p.expires) {
+		delete(enrolments, identity)
+		ok = false
+	}
+	lck.Unlock()
+
+	if !ok {
+		return errors.New("no pending enrolment, start one with --enrol")
+	}
+
+	step, valid := totp.Validate(p.secret, code, time.Now(), 1)
+	if !valid {
+		return errors.New("invalid verification code, check the time on your device is correct")
+	}
+
+	if err := data.SetMFASecret(identity, p.secret); err != nil {
+		return err
+	}
+
+	lck.Lock()
+	delete(enrolments, identity)
+	lastUsed[identity] = step
+	lck.Unlock()
+
+	return nil
+}
+
+func Disable(identity string) error {
+	if err := data.DeleteMFA(identity); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("%q has not enrolled a second factor", identity)
+		}
+		return err
+	}
+
+	lck.Lock()
+	delete(lastUsed, identity)
+	lck.Unlock()
+
+	return nil
+}
+
+// ParseIdentity turns what an operator typed into an identity, a public key (or a file holding one) is named by its
+// fingerprint, anything else is taken as a username or an identity listed by 'mfa -l'
+func ParseIdentity(s string) string {
+	if keyBytes, err := os.ReadFile(s); err == nil {
+		s = string(keyBytes)
+	}
+
+	if key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s)); err == nil {
+		return KeyIdentity(key)
+	}
+
+	return strings.TrimSpace(s)
+}
+
+// EnrolInteractive enrols identity by showing the secret on out and reading the confirmation code from in, it is how
+// the first administrator enrols as logging in to do it would need the second factor they dont have yet
+func EnrolInteractive(identity string, in io.Reader, out io.Writer) error {
+	secret, uri, err := BeginEnrolment(identity)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Enrolling %s, add this to your authenticator app:\n\n%s\n\nOr enter the secret manually: %s\n\n", identity, uri, secret)
+	fmt.Fprint(out, "Verification code: ")
+
+	code, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	return ConfirmEnrolment(identity, strings.TrimSpace(code))
+}
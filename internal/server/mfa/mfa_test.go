@@ -0,0 +1,103 @@
+package mfa
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestIdentity(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := signer.PublicKey()
+	keyIdentity := KeyIdentity(key)
+
+	if Identity("jim", key, false) != "jim" {
+		t.Fatal("users second factors should follow their username")
+	}
+
+	// Administrators keys can log in under any name, so the name must not change which second factor is asked for
+	if Identity("jim", key, true) != keyIdentity || Identity("someone-else", key, true) != keyIdentity {
+		t.Fatal("administrators second factors should follow their key")
+	}
+
+	cert := &ssh.Certificate{Key: key, CertType: ssh.UserCert, ValidPrincipals: []string{"jim"}}
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		t.Fatal(err)
+	}
+
+	if Identity("jim", cert, true) != keyIdentity {
+		t.Fatal("certificates should be identified by the key they certify")
+	}
+
+	authorizedKey := string(ssh.MarshalAuthorizedKey(key))
+	if ParseIdentity(authorizedKey) != keyIdentity {
+		t.Fatal("public key was not turned into its identity")
+	}
+
+	path := filepath.Join(t.TempDir(), "id_ed25519.pub")
+	if err := os.WriteFile(path, []byte(authorizedKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if ParseIdentity(path) != keyIdentity {
+		t.Fatal("public key file was not turned into its identity")
+	}
+
+	if ParseIdentity("jim") != "jim" || ParseIdentity(keyIdentity) != keyIdentity {
+		t.Fatal("usernames and identities should be used as given")
+	}
+}
+
+func TestRequiredUnenrolledAdmin(t *testing.T) {
+	if err := data.LoadDatabase(filepath.Join(t.TempDir(), "data.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity := Identity("jim", signer.PublicKey(), true)
+
+	// By default an administrator key alone is not enough, a stolen key should not give full control
+	if _, err := Required(identity, true); err == nil {
+		t.Fatal("administrator without a second factor should be refused by default")
+	}
+
+	if required, err := Required("jim", false); err != nil || required {
+		t.Fatal("requiring administrators to have a second factor should not affect users: ", err)
+	}
+
+	// With --allow-admin-without-mfa an administrator that has not enrolled logs in with their key alone
+	RequireForAdmins = false
+	defer func() { RequireForAdmins = true }()
+
+	required, err := Required(identity, true)
+	if err != nil {
+		t.Fatal("administrator without a second factor should be let in when allowed: ", err)
+	}
+
+	if required {
+		t.Fatal("administrator without a second factor should not be asked for a code")
+	}
+}
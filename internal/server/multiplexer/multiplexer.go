@@ -1,5 +1,65 @@
 package multiplexer
 
-import "github.com/NHAS/reverse_ssh/pkg/mux"
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/NHAS/reverse_ssh/pkg/mux"
+	"github.com/NHAS/reverse_ssh/pkg/mux/protocols"
+)
 
 var ServerMultiplexer *mux.Multiplexer
+
+// Options for the initial listener
+var (
+	// Load balancers allowed to send PROXY protocol headers
+	TrustedProxies    []*net.IPNet
+	ListenerProtocols []protocols.Type
+	ListenerLogins    []string
+)
+
+// Connection limits and handshake timeouts applied across every listener
+var Limits mux.Limits
+
+// UDP address to accept QUIC connections on, in addition to the listen address
+var QUICAddress string
+
+// Kinds of login a listener can be restricted to
+var LoginKinds = []string{"operators", "controllees", "proxies"}
+
+// LoginKind maps the type of an authenticated ssh connection to the kind of login it is
+func LoginKind(connectionType string) string {
+	switch connectionType {
+	case "user":
+		return "operators"
+	case "client", "enrol":
+		return "controllees"
+	case "proxy":
+		return "proxies"
+	}
+
+	return connectionType
+}
+
+// ParseLogins takes a comma separated list of login kinds
+func ParseLogins(s string) ([]string, error) {
+	var result []string
+	for _, kind := range strings.Split(s, ",") {
+		kind = strings.ToLower(strings.TrimSpace(kind))
+		if kind == "" {
+			continue
+		}
+
+		if !slices.Contains(LoginKinds, kind) {
+			return nil, fmt.Errorf("unknown login kind %q, valid kinds are %s", kind, strings.Join(LoginKinds, ", "))
+		}
+
+		if !slices.Contains(result, kind) {
+			result = append(result, kind)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,58 @@
+package multiplexer
+
+import (
+	"errors"
+	"log"
+
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/pkg/mux"
+)
+
+// ParseListenerOptions takes the comma separated forms used by the listen command and the database
+func ParseListenerOptions(trustedProxies, allowedProtocols, logins string) (opts mux.ListenerOptions, err error) {
+	opts.TrustedProxies, err = mux.ParseCIDRs(trustedProxies)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.Protocols, err = mux.ParseProtocols(allowedProtocols)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.Logins, err = ParseLogins(logins)
+	if err != nil {
+		return opts, err
+	}
+
+	return opts, nil
+}
+
+// RestoreListeners starts every listener saved in the database, failures are logged so one bad address doesnt stop the rest
+func RestoreListeners() error {
+	if ServerMultiplexer == nil {
+		return errors.New("multiplexer has not been started")
+	}
+
+	listeners, err := data.ListListeners()
+	if err != nil {
+		return err
+	}
+
+	for _, l := range listeners {
+		opts, err := ParseListenerOptions(l.TrustedProxies, l.Protocols, l.Logins)
+		if err != nil {
+			log.Printf("Unable to restore listener %s, invalid options: %s", l.Address, err)
+			continue
+		}
+
+		if err := ServerMultiplexer.StartListenerWithOptions("tcp", l.Address, opts); err != nil {
+			log.Printf("Unable to restore listener %s: %s", l.Address, err)
+			continue
+		}
+
+		log.Printf("Restored listener %s %s", l.Address, opts)
+	}
+
+	return nil
+}
@@ -0,0 +1,28 @@
+package observers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/pkg/observer"
+)
+
+type BanEvent struct {
+	IP        string
+	Usernames []string
+	Failures  int
+	Until     time.Time
+	Timestamp time.Time
+}
+
+func (b BanEvent) Summary() string {
+	return fmt.Sprintf("%s banned until %s after %d failed logins (%s)", b.IP, b.Until.Format("2006/01/02 15:04:05"), b.Failures, strings.Join(b.Usernames, ", "))
+}
+
+func (b BanEvent) Json() ([]byte, error) {
+	return json.Marshal(b)
+}
+
+var Bans = observer.New[BanEvent]()
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/NHAS/reverse_ssh/pkg/mux"
+)
+
+// Path of a unix socket operators can log in through, empty disables it
+var OperatorSocket string
+
+// Unix socket peers have no address, so connections report the socket path instead
+type operatorSocketConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *operatorSocketConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+type operatorSocketListener struct {
+	net.Listener
+	path string
+}
+
+func (l *operatorSocketListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &operatorSocketConn{Conn: c, addr: &net.UnixAddr{Name: l.path, Net: "unix"}}
+
+	return mux.WithOptions(conn, mux.ListenerOptions{Logins: []string{"operators"}}), nil
+}
+
+func (l *operatorSocketListener) Close() error {
+	err := l.Listener.Close()
+	os.Remove(l.path)
+
+	return err
+}
+
+// ListenOperatorSocket creates the socket only the owner of the server can use, clients and proxies are refused on it
+func ListenOperatorSocket(path string) (net.Listener, error) {
+	// Left behind if the server was killed
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s already exists and is not a socket", path)
+		}
+
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("unable to remove stale socket %s: %s", path, err)
+		}
+	}
+
+	// Created in a directory only we can enter and moved into place once restricted, so there is never a moment anyone else can connect
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".rssh-socket-")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create private directory for %s: %s", path, err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := net.Listen("unix", filepath.Join(dir, "s"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Its path changes below, so it is removed by Close instead
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := os.Chmod(filepath.Join(dir, "s"), 0600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("unable to restrict permissions on %s: %s", path, err)
+	}
+
+	if err := os.Rename(filepath.Join(dir, "s"), path); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("unable to move socket to %s: %s", path, err)
+	}
+
+	return &operatorSocketListener{Listener: l, path: path}, nil
+}
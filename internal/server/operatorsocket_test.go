@@ -0,0 +1,106 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/NHAS/reverse_ssh/pkg/mux"
+)
+
+func TestOperatorSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rssh.sock")
+
+	l, err := ListenOperatorSocket(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected a socket only the owner can use, got %s", info.Mode())
+	}
+
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Fatalf("expected only the socket to be left in its directory, got %d entries", len(entries))
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+
+	client, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	c, ok := <-accepted
+	if !ok {
+		t.Fatal("connection was not accepted")
+	}
+	defer c.Close()
+
+	if c.RemoteAddr().Network() != "unix" || c.RemoteAddr().String() != path {
+		t.Fatalf("expected the socket path as the remote address, got %s %s", c.RemoteAddr().Network(), c.RemoteAddr())
+	}
+
+	opts := mux.OptionsFor(c)
+	if !opts.AllowsLogin("operators") || opts.AllowsLogin("controllees") || opts.AllowsLogin("proxies") {
+		t.Fatalf("operator socket should only allow operators: %+v", opts)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatal("socket was not removed on close")
+	}
+}
+
+func TestOperatorSocketStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rssh.sock")
+
+	// As left behind by a server that was killed
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := ListenOperatorSocket(path)
+	if err != nil {
+		t.Fatalf("stale socket was not replaced: %s", err)
+	}
+	l.Close()
+}
+
+func TestOperatorSocketNotSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rssh.sock")
+
+	if err := os.WriteFile(path, []byte("important"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if l, err := ListenOperatorSocket(path); err == nil {
+		l.Close()
+		t.Fatal("expected a file that is not a socket to be refused")
+	}
+
+	if contents, err := os.ReadFile(path); err != nil || string(contents) != "important" {
+		t.Fatal("file that is not a socket was changed")
+	}
+}
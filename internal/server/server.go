@@ -1,17 +1,25 @@
 package server
 
 import (
+	"context"
 	"encoding/hex"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/bans"
 	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/hostkeys"
+	"github.com/NHAS/reverse_ssh/internal/server/mfa"
 	"github.com/NHAS/reverse_ssh/internal/server/multiplexer"
 	"github.com/NHAS/reverse_ssh/internal/server/tcp"
+	"github.com/NHAS/reverse_ssh/internal/server/tlsca"
+	"github.com/NHAS/reverse_ssh/internal/server/traffic"
 	"github.com/NHAS/reverse_ssh/internal/server/webhooks"
 	"github.com/NHAS/reverse_ssh/internal/server/webserver"
 	"github.com/NHAS/reverse_ssh/pkg/mux"
@@ -47,15 +55,27 @@ func CreateOrLoadServerKeys(privateKeyPath string) (ssh.Signer, error) {
 	return private, nil
 }
 
-func Run(addr, dataDir, connectBackAddress string, autogeneratedConnectBack bool, TLSCertPath, TLSKeyPath string, insecure, enabledDownloads, enabletTLS, openproxy bool, timeout int) {
+// Run starts the server and blocks until ctx is cancelled, it then stops accepting connections, saves traffic counters and returns
+func Run(ctx context.Context, addr, dataDir, connectBackAddress string, autogeneratedConnectBack bool, tlsCertificates []mux.TLSKeyPair, insecure, enabledDownloads, enabletTLS, openproxy bool, timeout int) {
 	c := mux.MultiplexerConfig{
-		Control:           true,
-		Downloads:         enabledDownloads,
-		TLS:               enabletTLS,
-		TLSCertPath:       TLSCertPath,
-		TLSKeyPath:        TLSKeyPath,
-		AutoTLSCommonName: connectBackAddress,
-		TcpKeepAlive:      timeout,
+		Control:            true,
+		Downloads:          enabledDownloads,
+		TLS:                enabletTLS,
+		TLSCertificates:    tlsCertificates,
+		AutoTLSCommonName:  connectBackAddress,
+		AutoTLSCertificate: tlsca.ServerCertificate,
+		AutoTLSCertPath:    filepath.Join(dataDir, "tls_auto.crt"),
+		AutoTLSKeyPath:     filepath.Join(dataDir, "tls_auto.key"),
+		TcpKeepAlive:       timeout,
+		ListenerOptions: mux.ListenerOptions{
+			TrustedProxies: multiplexer.TrustedProxies,
+			Protocols:      multiplexer.ListenerProtocols,
+			Logins:         multiplexer.ListenerLogins,
+		},
+		Limits: multiplexer.Limits,
+		ConnectionFilter: func(addr net.Addr) bool {
+			return !bans.IsBannedAddr(addr)
+		},
 		PollingAuthChecker: func(key string, addr net.Addr) bool {
 
 			authorizedKey, err := hex.DecodeString(key)
@@ -68,6 +88,10 @@ func Run(addr, dataDir, connectBackAddress string, autogeneratedConnectBack bool
 				return false
 			}
 
+			if IsTrustedCertificate(filepath.Join(dataDir, "trusted_controllee_ca_keys"), pubKey) {
+				return true
+			}
+
 			_, err = CheckAuth(filepath.Join(dataDir, "authorized_controllee_keys"), pubKey, getIP(addr.String()), insecure)
 			return err == nil
 
@@ -77,7 +101,20 @@ func Run(addr, dataDir, connectBackAddress string, autogeneratedConnectBack bool
 	privateKeyPath := filepath.Join(dataDir, "id_ed25519")
 
 	log.Println("Version: ", internal.Version)
-	var err error
+
+	err := tlsca.Init(dataDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if enabletTLS || multiplexer.QUICAddress != "" {
+		log.Println("TLS CA public key pin: ", internal.TLSPublicKeyPinHex(tlsca.Certificate()))
+	}
+
+	if tlsca.RequireClientCerts {
+		c.TLSClientCAs = tlsca.Pool()
+	}
+
 	multiplexer.ServerMultiplexer, err = mux.ListenWithConfig("tcp", addr, c)
 	if err != nil {
 		log.Fatalf("Failed to listen on %s (%s)", addr, err)
@@ -86,6 +123,16 @@ func Run(addr, dataDir, connectBackAddress string, autogeneratedConnectBack bool
 
 	log.Printf("Listening on %s\n", addr)
 
+	if multiplexer.QUICAddress != "" {
+		// Protocol restrictions and PROXY headers only apply to TCP, so just the logins carry over
+		err = multiplexer.ServerMultiplexer.StartListenerWithOptions("udp", mux.QUICScheme+multiplexer.QUICAddress, mux.ListenerOptions{Logins: multiplexer.ListenerLogins})
+		if err != nil {
+			log.Fatalf("Failed to listen for QUIC on %s (%s)", multiplexer.QUICAddress, err)
+		}
+
+		log.Printf("Listening for QUIC on %s\n", multiplexer.QUICAddress)
+	}
+
 	private, err := CreateOrLoadServerKeys(privateKeyPath)
 	if err != nil {
 		log.Fatal(err)
@@ -95,6 +142,15 @@ func Run(addr, dataDir, connectBackAddress string, autogeneratedConnectBack bool
 
 	log.Println("Server key fingerprint: ", internal.FingerprintSHA256Hex(private.PublicKey()))
 
+	err = hostkeys.Init(privateKeyPath, private, func(newKey ssh.Signer) {
+		if enabledDownloads {
+			webserver.SetDefaultFingerprint(newKey.PublicKey())
+		}
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if enabledDownloads {
 		if len(connectBackAddress) == 0 {
 			connectBackAddress = addr
@@ -108,7 +164,44 @@ func Run(addr, dataDir, connectBackAddress string, autogeneratedConnectBack bool
 		log.Fatal(err)
 	}
 
+	if err := multiplexer.RestoreListeners(); err != nil {
+		log.Println("Unable to restore listeners: ", err)
+	}
+
+	if mfa.RequireForAdmins {
+		if enrolled, err := data.ListMFA(); err == nil && !slices.ContainsFunc(enrolled, func(m data.MFA) bool { return strings.HasPrefix(m.Username, "key:") }) {
+			log.Println("WARNING: no administrator keys have enrolled a second factor so administrators cannot log in, enrol one with --enrol-mfa <public key> or start with --allow-admin-without-mfa")
+		}
+	}
+
 	go webhooks.StartWebhooks()
+	go traffic.Start()
+	go hostkeys.Start()
+	go bans.Start()
+
+	sshListeners := []net.Listener{multiplexer.ServerMultiplexer.ControlRequests()}
+	if OperatorSocket != "" {
+		socket, err := ListenOperatorSocket(OperatorSocket)
+		if err != nil {
+			log.Fatalf("Failed to listen on operator socket %s (%s)", OperatorSocket, err)
+		}
+		defer socket.Close()
+
+		log.Printf("Operators can connect on %s\n", OperatorSocket)
+		sshListeners = append(sshListeners, socket)
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		// Stops StartSSHServer accepting connections, so the cleanup below and the deferred closing of the multiplexer and operator socket run
+		sshListeners[0].Close()
+	}()
+
+	StartSSHServer(sshListeners, private, insecure, openproxy, dataDir, timeout)
+
+	log.Println("Shutting down")
 
-	StartSSHServer(multiplexer.ServerMultiplexer.ControlRequests(), private, insecure, openproxy, dataDir, timeout)
+	// Traffic is only written to the database every minute, so write what has been counted since
+	traffic.Flush()
 }
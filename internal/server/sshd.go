@@ -14,10 +14,17 @@ import (
 	"time"
 
 	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/bans"
+	"github.com/NHAS/reverse_ssh/internal/server/data"
 	"github.com/NHAS/reverse_ssh/internal/server/handlers"
+	"github.com/NHAS/reverse_ssh/internal/server/hostkeys"
+	"github.com/NHAS/reverse_ssh/internal/server/mfa"
+	"github.com/NHAS/reverse_ssh/internal/server/multiplexer"
 	"github.com/NHAS/reverse_ssh/internal/server/observers"
+	"github.com/NHAS/reverse_ssh/internal/server/traffic"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"github.com/NHAS/reverse_ssh/pkg/mux"
 	"github.com/fatih/color"
 	"golang.org/x/crypto/ssh"
 )
@@ -28,6 +35,9 @@ type Options struct {
 	Comment   string
 
 	Owners []string
+
+	// Only used for certificate authorities, certificates with any of these principals are given administrator privileges
+	AdminPrincipals []string
 }
 
 func readPubKeys(path string) (m map[string]Options, err error) {
@@ -63,6 +73,8 @@ func readPubKeys(path string) (m map[string]Options, err error) {
 					opts.DenyList = append(opts.DenyList, deny...)
 				case "owner":
 					opts.Owners = ParseOwnerDirective(parts[1])
+				case "admin-principals":
+					opts.AdminPrincipals = ParseOwnerDirective(parts[1])
 				}
 
 			}
@@ -245,11 +257,13 @@ func isDirEmpty(name string) bool {
 	return false
 }
 
-func StartSSHServer(sshListener net.Listener, privateKey ssh.Signer, insecure, openproxy bool, dataDir string, timeout int) {
+func StartSSHServer(sshListeners []net.Listener, privateKey ssh.Signer, insecure, openproxy bool, dataDir string, timeout int) {
 	//Taken from the server example, authorized keys are required for controllers
 	adminAuthorizedKeysPath := filepath.Join(dataDir, "authorized_keys")
 	authorizedControlleeKeysPath := filepath.Join(dataDir, "authorized_controllee_keys")
 	authorizedProxyKeysPath := filepath.Join(dataDir, "authorized_proxy_keys")
+	userCAKeysPath := filepath.Join(dataDir, "trusted_user_ca_keys")
+	controlleeCAKeysPath := filepath.Join(dataDir, "trusted_controllee_ca_keys")
 
 	downloadsDir := filepath.Join(dataDir, "downloads")
 	if _, err := os.Stat(downloadsDir); err != nil && os.IsNotExist(err) {
@@ -267,85 +281,202 @@ func StartSSHServer(sshListener net.Listener, privateKey ssh.Signer, insecure, o
 		log.Println("WARNING: authorized_keys file does not exist in server directory, and no user keys are registered. You will not be able to log in to this server!")
 	}
 
-	config := &ssh.ServerConfig{
-		ServerVersion: "SSH-2.0-OpenSSH_8.0",
-		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	checkKey := func(conn ssh.ConnMetadata, key ssh.PublicKey, remoteIp net.IP, isUntrustWorthy bool) (*ssh.Permissions, error) {
+		// Check administrator keys first, they can impersonate users
+		perm, err := CheckAuth(adminAuthorizedKeysPath, key, remoteIp, false)
+		if err == nil && !isUntrustWorthy {
+			perm.Extensions["type"] = "user"
+			perm.Extensions["privilege"] = "5"
+
+			return perm, err
+		}
+		if err != ErrKeyNotInList {
+			err = fmt.Errorf("admin with supplied username (%s) denied login: %s", strconv.QuoteToGraphic(conn.User()), err)
+			if isUntrustWorthy {
+				err = fmt.Errorf("admin (%s) denied login: cannot connect admins via pivoted server port (may result in allow list bypass)", strconv.QuoteToGraphic(conn.User()))
+			}
+			return nil, err
+		}
+
+		// Stop path traversal
+		authorisedKeysPath := filepath.Join(usersKeysDir, filepath.Join("/", filepath.Clean(conn.User())))
+		perm, err = CheckAuth(authorisedKeysPath, key, remoteIp, false)
+		if err == nil && !isUntrustWorthy {
+			perm.Extensions["type"] = "user"
+			perm.Extensions["privilege"] = "0"
+
+			return perm, err
+		}
+
+		if err != ErrKeyNotInList {
+			err = fmt.Errorf("user (%s) denied login: %s", strconv.QuoteToGraphic(conn.User()), err)
+			if isUntrustWorthy {
+				err = fmt.Errorf("user (%s) denied login: cannot connect users via pivoted server port (may result in allow list bypass)", strconv.QuoteToGraphic(conn.User()))
+			}
+
+			return nil, err
+		}
+
+		perm, err = checkUserCertificate(userCAKeysPath, conn, key, remoteIp)
+		if err == nil && !isUntrustWorthy {
+			return perm, err
+		}
+
+		if err != ErrKeyNotInList {
+			err = fmt.Errorf("user (%s) denied certificate login: %s", strconv.QuoteToGraphic(conn.User()), err)
+			if isUntrustWorthy {
+				err = fmt.Errorf("user (%s) denied certificate login: cannot connect users via pivoted server port (may result in allow list bypass)", strconv.QuoteToGraphic(conn.User()))
+			}
+
+			return nil, err
+		}
+
+		// not going to check isUntrustWorthy down here as these are often the reason we're pivoting into a place anyway
+
+		//If insecure mode, then any unknown client will be connected as a controllable client.
+		//The server effectively ignores channel requests from controllable clients.
+		perms, err := CheckAuth(authorizedControlleeKeysPath, key, remoteIp, insecure)
+		if err == nil {
+			perms.Extensions["type"] = "client"
+			return perms, err
+		}
+
+		if err != ErrKeyNotInList {
+
+			return nil, fmt.Errorf("client was denied login: %s", err)
+		}
+
+		perms, _, err = CheckCertificate(controlleeCAKeysPath, conn, key, remoteIp)
+		if err == nil {
+			perms.Extensions["type"] = "client"
+			return perms, err
+		}
+
+		if err != ErrKeyNotInList {
+			return nil, fmt.Errorf("client was denied certificate login: %s", err)
+		}
+
+		perms, err = CheckAuth(authorizedProxyKeysPath, key, remoteIp, insecure || openproxy)
+		if err == nil {
+
+			perms.Extensions["type"] = "proxy"
+			return perms, err
+		}
+
+		if err != ErrKeyNotInList {
+			return nil, fmt.Errorf("proxy was denied login: %s", err)
+		}
+
+		if data.HasPendingEnrolments() {
+			// Unknown keys get no permissions, only the chance to present an enrolment token, see enrolmentChallenge
+			return &ssh.Permissions{
+				Extensions: map[string]string{
+					"type": "enrol",
+				},
+			}, nil
+		}
+
+		return nil, fmt.Errorf("not authorized %q, potentially you might want to enable --insecure mode", conn.User())
+	}
+
+	// Each listener may only allow some kinds of login, so the callback is made per connection with the options of the listener it arrived on
+	publicKeyCallback := func(options mux.ListenerOptions) func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		return func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
 
 			remoteIp := getIP(conn.RemoteAddr().String())
 			// from forwradserverport.go, effectively when pivoting and exposing the server port we have to just trust whatever structure the client gives us for our remote/local addresses,
 			// we dont want someone being able to bypass ip allow lists, so mark it as untrusted
 			isUntrustWorthy := conn.RemoteAddr().Network() == "remote_forward_tcp"
 
+			// The operator socket is only reachable by whoever can open it, so it is treated as loopback and never banned
+			isLocalSocket := conn.RemoteAddr().Network() == "unix"
+			if isLocalSocket {
+				remoteIp = net.IPv4(127, 0, 0, 1)
+			}
+
 			if remoteIp == nil {
 				return nil, fmt.Errorf("not authorized %q, could not parse IP address %s", conn.User(), conn.RemoteAddr())
 			}
 
-			// Check administrator keys first, they can impersonate users
-			perm, err := CheckAuth(adminAuthorizedKeysPath, key, remoteIp, false)
-			if err == nil && !isUntrustWorthy {
-				perm.Extensions["type"] = "user"
-				perm.Extensions["privilege"] = "5"
+			// Refused before a second factor or enrolment token is asked for, so a listener that doesnt allow a kind of login says nothing
+			// about whether its credentials are valid
+			allowed := func(perms *ssh.Permissions) error {
+				if kind := multiplexer.LoginKind(perms.Extensions["type"]); !options.AllowsLogin(kind) {
+					return fmt.Errorf("not authorized %q, %s logins are not allowed on the listener at %s", conn.User(), kind, conn.LocalAddr())
+				}
 
-				return perm, err
+				return nil
 			}
-			if err != ErrKeyNotInList {
-				err = fmt.Errorf("admin with supplied username (%s) denied login: %s", strconv.QuoteToGraphic(conn.User()), err)
-				if isUntrustWorthy {
-					err = fmt.Errorf("admin (%s) denied login: cannot connect admins via pivoted server port (may result in allow list bypass)", strconv.QuoteToGraphic(conn.User()))
+
+			// Addresses of pivoted connections are supplied by the client, so they cant be banned or count towards a ban
+			if isUntrustWorthy {
+				perms, err := checkKey(conn, key, remoteIp, isUntrustWorthy)
+				if err == nil {
+					err = allowed(perms)
 				}
-				return nil, err
-			}
 
-			// Stop path traversal
-			authorisedKeysPath := filepath.Join(usersKeysDir, filepath.Join("/", filepath.Clean(conn.User())))
-			perm, err = CheckAuth(authorisedKeysPath, key, remoteIp, false)
-			if err == nil && !isUntrustWorthy {
-				perm.Extensions["type"] = "user"
-				perm.Extensions["privilege"] = "0"
+				if err == nil && perms.Extensions["type"] == "enrol" {
+					return nil, enrolmentChallenge(key, authorizedControlleeKeysPath, func() (*ssh.Permissions, error) {
+						return checkKey(conn, key, remoteIp, isUntrustWorthy)
+					})
+				}
 
-				return perm, err
+				return perms, err
 			}
 
-			if err != ErrKeyNotInList {
-				err = fmt.Errorf("user (%s) denied login: %s", strconv.QuoteToGraphic(conn.User()), err)
-				if isUntrustWorthy {
-					err = fmt.Errorf("user (%s) denied login: cannot connect users via pivoted server port (may result in allow list bypass)", strconv.QuoteToGraphic(conn.User()))
-				}
+			if !isLocalSocket && bans.IsBanned(remoteIp) {
+				return nil, fmt.Errorf("not authorized %q, %s is temporarily banned", conn.User(), remoteIp)
+			}
 
+			// Failures and successes are counted once per connection in acceptConn, not per key offered
+			perms, err := checkKey(conn, key, remoteIp, isUntrustWorthy)
+			if err != nil {
 				return nil, err
 			}
 
-			// not going to check isUntrustWorthy down here as these are often the reason we're pivoting into a place anyway
-
-			//If insecure mode, then any unknown client will be connected as a controllable client.
-			//The server effectively ignores channel requests from controllable clients.
-			perms, err := CheckAuth(authorizedControlleeKeysPath, key, remoteIp, insecure)
-			if err == nil {
-				perms.Extensions["type"] = "client"
-				return perms, err
+			if err := allowed(perms); err != nil {
+				return nil, err
 			}
 
-			if err != ErrKeyNotInList {
-
-				return nil, fmt.Errorf("client was denied login: %s", err)
+			if perms.Extensions["type"] == "enrol" {
+				return nil, enrolmentChallenge(key, authorizedControlleeKeysPath, func() (*ssh.Permissions, error) {
+					return checkKey(conn, key, remoteIp, isUntrustWorthy)
+				})
 			}
 
-			perms, err = CheckAuth(authorizedProxyKeysPath, key, remoteIp, insecure || openproxy)
-			if err == nil {
+			if perms.Extensions["type"] == "user" {
+				admin := perms.Extensions["privilege"] == "5"
+				identity := mfa.Identity(conn.User(), key, admin)
+				perms.Extensions["mfa-identity"] = identity
 
-				perms.Extensions["type"] = "proxy"
-				return perms, err
-			}
+				required, err := mfa.Required(identity, admin)
+				if err != nil {
+					return nil, fmt.Errorf("user (%s) denied login: %s", strconv.QuoteToGraphic(conn.User()), err)
+				}
 
-			if err != ErrKeyNotInList {
-				return nil, fmt.Errorf("proxy was denied login: %s", err)
+				if required {
+					// The key was fine, now the user must supply a code before they get their permissions
+					return nil, &ssh.PartialSuccessError{
+						Next: ssh.ServerAuthCallbacks{
+							KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+								if err := mfa.Challenge(conn.User(), identity, client); err != nil {
+									return nil, fmt.Errorf("user (%s) failed second factor: %s", strconv.QuoteToGraphic(conn.User()), err)
+								}
+
+								return perms, nil
+							},
+						},
+					}
+				}
 			}
 
-			return nil, fmt.Errorf("not authorized %q, potentially you might want to enable --insecure mode", conn.User())
-		},
+			return perms, nil
+		}
 	}
 
-	config.AddHostKey(privateKey)
+	config := &ssh.ServerConfig{
+		ServerVersion: "SSH-2.0-OpenSSH_8.0",
+	}
 
 	observers.ConnectionState.Register(func(c observers.ClientState) {
 		var arrowDirection = "<-"
@@ -365,16 +496,37 @@ func StartSSHServer(sshListener net.Listener, privateKey ssh.Signer, insecure, o
 
 	})
 
-	// Accept all connections
-	for {
-		conn, err := sshListener.Accept()
-		if err != nil {
-			log.Printf("Failed to accept incoming connection (%s)", err)
-			continue
+	acceptAll := func(sshListener net.Listener) {
+		for {
+			conn, err := sshListener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				log.Printf("Failed to accept incoming connection (%s)", err)
+				continue
+			}
+
+			// Host keys can be rotated while running, so each connection gets whichever key is current when it arrives
+			hostKey := hostkeys.Current()
+			if hostKey == nil {
+				hostKey = privateKey
+			}
+
+			connConfig := *config
+			connConfig.PublicKeyCallback = publicKeyCallback(mux.OptionsFor(conn))
+			connConfig.AddHostKey(hostKey)
+
+			go acceptConn(conn, &connConfig, timeout, dataDir)
 		}
+	}
 
-		go acceptConn(conn, config, timeout, dataDir)
+	for _, l := range sshListeners[1:] {
+		go acceptAll(l)
 	}
+
+	// Accept all connections
+	acceptAll(sshListeners[0])
 }
 
 func getIP(ip string) net.IP {
@@ -387,18 +539,67 @@ func getIP(ip string) net.IP {
 	return nil
 }
 
+// clientRequests handles global requests from controllable clients, which only tell the server about themselves
+func clientRequests(sshConn *ssh.ServerConn, reqs <-chan *ssh.Request, clientLog logger.Logger) {
+	for req := range reqs {
+		switch req.Type {
+		case "capabilities-rssh@golang.org":
+			var c internal.Capabilities
+			if err := ssh.Unmarshal(req.Payload, &c); err != nil {
+				clientLog.Warning("Client sent malformed capabilities: %s", err)
+				req.Reply(false, nil)
+				continue
+			}
+
+			users.SetCapabilities(sshConn, c)
+			req.Reply(true, nil)
+
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
 func acceptConn(c net.Conn, config *ssh.ServerConfig, timeout int, dataDir string) {
 
+	if c.RemoteAddr().Network() != "remote_forward_tcp" && bans.IsBannedAddr(c.RemoteAddr()) {
+		c.Close()
+		return
+	}
+
 	//Initially set the timeout high, so people who type in their ssh key password can actually use rssh
 	realConn := &internal.TimeoutConn{Conn: c, Timeout: time.Duration(timeout) * time.Minute}
 
+	// Pivoted connections supply their own address and the operator socket is local, so neither counts towards a ban
+	countsForBans := c.RemoteAddr().Network() != "remote_forward_tcp" && c.RemoteAddr().Network() != "unix"
+
+	// Each connection has its own copy of the config, so the name it tried to log in as can be kept for the ban log
+	var attemptedUser string
+	config.AuthLogCallback = func(conn ssh.ConnMetadata, method string, err error) {
+		attemptedUser = conn.User()
+	}
+
 	// Before use, a handshake must be performed on the incoming net.Conn.
 	sshConn, chans, reqs, err := ssh.NewServerConn(realConn, config)
 	if err != nil {
 		log.Printf("Failed to handshake (%s)", err.Error())
+
+		// However many keys or codes were tried, a connection that failed to log in counts once
+		var authErr *ssh.ServerAuthError
+		if countsForBans && errors.As(err, &authErr) && len(authErr.Errors) > 0 {
+			if ip := getIP(c.RemoteAddr().String()); ip != nil && bans.RecordFailure(ip, attemptedUser) {
+				log.Printf("Banned %s for %s after repeated failed logins", ip, bans.Duration)
+			}
+		}
 		return
 	}
 
+	if countsForBans {
+		if ip := getIP(c.RemoteAddr().String()); ip != nil {
+			bans.RecordSuccess(ip)
+		}
+	}
+
 	clientLog := logger.NewLog(sshConn.RemoteAddr().String())
 
 	if timeout > 0 {
@@ -458,16 +659,19 @@ func acceptConn(c net.Conn, config *ssh.ServerConfig, timeout int, dataDir strin
 			return
 		}
 
+		traffic.RegisterClient(id, username)
+
 		go func() {
-			go ssh.DiscardRequests(reqs)
+			go clientRequests(sshConn, reqs, clientLog)
 
 			err = registerChannelCallbacks("", nil, chans, clientLog, map[string]func(_ string, user *users.User, newChannel ssh.NewChannel, log logger.Logger){
-				"rssh-download":   handlers.Download(dataDir),
+				"rssh-download":   handlers.Download(dataDir, id),
 				"forwarded-tcpip": handlers.ServerPortForward(id),
 			})
 
 			clientLog.Info("SSH client disconnected")
 			users.DisassociateClient(id, sshConn)
+			traffic.RemoveClient(id)
 
 			observers.ConnectionState.Notify(observers.ClientState{
 				Status:    "disconnected",
@@ -481,6 +685,12 @@ func acceptConn(c net.Conn, config *ssh.ServerConfig, timeout int, dataDir strin
 
 		clientLog.Info("New controllable connection from %s with id %s", color.BlueString(username), color.YellowString(id))
 
+		go func() {
+			if _, err := hostkeys.Announce(sshConn); err != nil {
+				clientLog.Warning("Unable to announce next host key: %s", err)
+			}
+		}()
+
 		observers.ConnectionState.Notify(observers.ClientState{
 			Status:    "connected",
 			ID:        id,
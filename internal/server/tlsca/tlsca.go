@@ -0,0 +1,245 @@
+package tlsca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Require TLS connections to present a client certificate issued by the rssh CA
+var RequireClientCerts bool
+
+const caLifetime = 10 * 365 * 24 * time.Hour
+
+var (
+	lck sync.RWMutex
+
+	caCert *x509.Certificate
+	caKey  crypto.Signer
+)
+
+// Init loads the CA from dataDir, creating it on first use
+func Init(dataDir string) error {
+	lck.Lock()
+	defer lck.Unlock()
+
+	certPath := filepath.Join(dataDir, "tls_ca.crt")
+	keyPath := filepath.Join(dataDir, "tls_ca.key")
+
+	if _, err := os.Stat(certPath); os.IsNotExist(err) {
+		certPem, keyPem, err := generateCA()
+		if err != nil {
+			return fmt.Errorf("unable to generate tls ca: %s", err)
+		}
+
+		if err = os.WriteFile(keyPath, keyPem, 0600); err != nil {
+			return fmt.Errorf("unable to write tls ca key to disk: %s", err)
+		}
+
+		if err = os.WriteFile(certPath, certPem, 0600); err != nil {
+			return fmt.Errorf("unable to write tls ca certificate to disk: %s", err)
+		}
+	}
+
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load tls ca (%s): %s", certPath, err)
+	}
+
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return errors.New("tls ca key cannot sign")
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	if !cert.IsCA {
+		return fmt.Errorf("%s is not a ca certificate", certPath)
+	}
+
+	caCert = cert
+	caKey = signer
+
+	return nil
+}
+
+func generateCA() (certPem, keyPem []byte, err error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "rssh ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caLifetime),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyPem, err = encodeKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPem, nil
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func encodeKey(priv *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func get() (*x509.Certificate, crypto.Signer, error) {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	if caCert == nil {
+		return nil, nil, errors.New("tls ca has not been loaded")
+	}
+
+	return caCert, caKey, nil
+}
+
+// CertificatePEM returns the CA certificate for baking into clients
+func CertificatePEM() ([]byte, error) {
+	cert, _, err := get()
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), nil
+}
+
+// Certificate returns the parsed CA certificate, or nil if Init has not succeeded
+func Certificate() *x509.Certificate {
+	cert, _, _ := get()
+	return cert
+}
+
+func Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	if cert := Certificate(); cert != nil {
+		pool.AddCert(cert)
+	}
+
+	return pool
+}
+
+func issue(template *x509.Certificate) (der []byte, priv *ecdsa.PrivateKey, err error) {
+	ca, signer, err := get()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template.SerialNumber, err = newSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template.NotBefore = time.Now().Add(-time.Hour)
+	if template.NotAfter.After(ca.NotAfter) || template.NotAfter.IsZero() {
+		template.NotAfter = ca.NotAfter
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+
+	der, err = x509.CreateCertificate(rand.Reader, template, ca, priv.Public(), signer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return der, priv, nil
+}
+
+// ServerCertificate issues a certificate for address (host or host:port), the CA is included in the chain so clients can pin it
+func ServerCertificate(address string) (tls.Certificate, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: host},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else if host != "" {
+		template.DNSNames = []string{host}
+	}
+
+	der, priv, err := issue(template)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	ca, _, _ := get()
+
+	return tls.Certificate{
+		Certificate: [][]byte{der, ca.Raw},
+		PrivateKey:  priv,
+	}, nil
+}
+
+// IssueClientCertificate creates a certificate and key for a client, returned as a single PEM bundle
+func IssueClientCertificate(name string) ([]byte, error) {
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, priv, err := issue(template)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPem, err := encodeKey(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPem...), nil
+}
@@ -0,0 +1,67 @@
+package tlsca
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+)
+
+func TestInitReloadsCA(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := Init(dir); err != nil {
+		t.Fatal(err)
+	}
+	first := Certificate()
+
+	if err := Init(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if !first.Equal(Certificate()) {
+		t.Fatal("ca was regenerated instead of loaded")
+	}
+}
+
+func TestIssuedCertificatesVerify(t *testing.T) {
+	if err := Init(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := ServerCertificate("127.0.0.1:3232")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(server.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "127.0.0.1", Roots: Pool()}); err != nil {
+		t.Fatal("server certificate did not verify: ", err)
+	}
+
+	bundle, err := IssueClientCertificate("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := tls.X509KeyPair(bundle, bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err = x509.ParseCertificate(client.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: Pool(), KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Fatal("client certificate did not verify: ", err)
+	}
+
+	if leaf.Subject.CommonName != "test" {
+		t.Fatalf("unexpected common name: %q", leaf.Subject.CommonName)
+	}
+}
@@ -0,0 +1,167 @@
+package traffic
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Rule caps the throughput of every counter of Kind that matches Pattern
+type Rule struct {
+	Kind    string
+	Pattern string
+	Rate    uint64
+
+	// Who set the rule, only they or an administrator can replace or remove it
+	Owner string
+	// Set by an administrator, rules set by anyone else can only lower a limit never raise it, see limitFor
+	Admin bool
+
+	matches func(name string) bool
+}
+
+var (
+	rulesLck sync.RWMutex
+	// Ordered, when multiple administrator rules match the last one added wins
+	rules []Rule
+)
+
+var ErrNotRuleOwner = errors.New("limit was set by someone else, only they or an administrator can change it")
+
+// GlobMatcher matches counter names directly against the pattern, used for operators and forwards
+func GlobMatcher(pattern string) func(string) bool {
+	return func(name string) bool {
+		match, _ := filepath.Match(pattern, name)
+		return match
+	}
+}
+
+func limitFor(kind, name string) uint64 {
+	rulesLck.RLock()
+	applicable := make([]Rule, 0, len(rules))
+	for _, r := range rules {
+		if r.Kind == kind {
+			applicable = append(applicable, r)
+		}
+	}
+	rulesLck.RUnlock()
+
+	var limit uint64
+	for i := len(applicable) - 1; i >= 0; i-- {
+		if applicable[i].Admin && applicable[i].matches(name) {
+			limit = applicable[i].Rate
+			break
+		}
+	}
+
+	// Otherwise a user could lift a limit placed on them, or on a client they share, by adding a broader rule of their own
+	for _, r := range applicable {
+		if !r.Admin && (limit == 0 || r.Rate < limit) && r.matches(name) {
+			limit = r.Rate
+		}
+	}
+
+	return limit
+}
+
+// reapply recalculates the limit of every active counter of kind, live connections pick up the change on their next read
+func reapply(kind string) {
+	lck.RLock()
+	toUpdate := []*Counter{}
+	for k, c := range counters {
+		if k.kind == kind {
+			toUpdate = append(toUpdate, c)
+		}
+	}
+	lck.RUnlock()
+
+	for _, c := range toUpdate {
+		c.SetLimit(limitFor(kind, c.Name))
+	}
+}
+
+// SetLimit adds or replaces the rule for kind and pattern, and applies it to matching counters immediately.
+// An existing rule can only be replaced by its owner or an administrator
+func SetLimit(kind, pattern, owner string, admin bool, bytesPerSecond uint64, matches func(name string) bool) error {
+	rulesLck.Lock()
+	for i := range rules {
+		if rules[i].Kind == kind && rules[i].Pattern == pattern {
+			if rules[i].Owner != owner && !admin {
+				rulesLck.Unlock()
+				return ErrNotRuleOwner
+			}
+
+			rules = append(rules[:i], rules[i+1:]...)
+			break
+		}
+	}
+
+	rules = append(rules, Rule{
+		Kind:    kind,
+		Pattern: pattern,
+		Rate:    bytesPerSecond,
+		Owner:   owner,
+		Admin:   admin,
+		matches: matches,
+	})
+	rulesLck.Unlock()
+
+	reapply(kind)
+
+	return nil
+}
+
+// RemoveLimit deletes the rule for kind and pattern, only its owner or an administrator can. Returns false if no such rule existed
+func RemoveLimit(kind, pattern, owner string, admin bool) (bool, error) {
+	rulesLck.Lock()
+	found := false
+	for i := range rules {
+		if rules[i].Kind == kind && rules[i].Pattern == pattern {
+			if rules[i].Owner != owner && !admin {
+				rulesLck.Unlock()
+				return true, ErrNotRuleOwner
+			}
+
+			rules = append(rules[:i], rules[i+1:]...)
+			found = true
+			break
+		}
+	}
+	rulesLck.Unlock()
+
+	if found {
+		reapply(kind)
+	}
+
+	return found, nil
+}
+
+func Limits() []Rule {
+	rulesLck.RLock()
+	defer rulesLck.RUnlock()
+
+	return append([]Rule{}, rules...)
+}
+
+// ParseBytes parses sizes such as 512, 100KB, 1.5MB or 2G into bytes. Units are powers of 1024 and the B suffix is optional
+func ParseBytes(s string) (uint64, error) {
+	upper := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+
+	multiplier := uint64(1)
+	if len(upper) > 0 {
+		if i := strings.IndexByte("KMGT", upper[len(upper)-1]); i >= 0 {
+			upper = upper[:len(upper)-1]
+			multiplier = 1 << (10 * (i + 1))
+		}
+	}
+
+	value, err := strconv.ParseFloat(upper, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected a number with an optional K, M, G or T suffix", s)
+	}
+
+	return uint64(value * float64(multiplier)), nil
+}
@@ -0,0 +1,426 @@
+package traffic
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/pkg/ratelimit"
+)
+
+const (
+	ClientKind   = "client"
+	OperatorKind = "user"
+	ProxyKind    = "proxy"
+	ForwardKind  = "forward"
+)
+
+type Direction int
+
+const (
+	// Bytes travelling from the client (or proxy) towards the server
+	FromClient Direction = iota
+	// Bytes travelling from the server towards the client (or proxy)
+	ToClient
+)
+
+// How often the in-memory counters are written to the daily aggregates in the database
+const flushInterval = time.Minute
+
+// Writes a days bytes for a counter, replaced in tests
+var persist = data.AddTraffic
+
+// Counter tracks the bytes moved for a single client, operator or proxy.
+// All directions are relative to the server, so In is what the subject sent us and Out is what we sent it
+type Counter struct {
+	Kind        string
+	Name        string
+	Description string
+
+	// Bytes are also credited to, and throttled by, the parent. E.g a forward belongs to a proxy
+	parent *Counter
+
+	limit atomic.Pointer[ratelimit.Bucket]
+
+	in  atomic.Uint64
+	out atomic.Uint64
+
+	// Bytes per second calculated on the last tick
+	rateIn  atomic.Uint64
+	rateOut atomic.Uint64
+
+	// Only touched by the ticker goroutine, or while holding flushLck
+	lastIn, lastOut       uint64
+	flushedIn, flushedOut uint64
+}
+
+type Stats struct {
+	Kind        string
+	Name        string
+	Description string
+
+	In  uint64
+	Out uint64
+
+	RateIn  uint64
+	RateOut uint64
+
+	// Throughput cap in bytes per second, 0 is unlimited
+	Limit uint64
+}
+
+func (c *Counter) addIn(n int) {
+	for ; c != nil; c = c.parent {
+		c.in.Add(uint64(n))
+	}
+}
+
+func (c *Counter) addOut(n int) {
+	for ; c != nil; c = c.parent {
+		c.out.Add(uint64(n))
+	}
+}
+
+// wait blocks until n bytes are allowed by this counters limit and the limits of all its parents
+func (c *Counter) wait(n int) {
+	for ; c != nil; c = c.parent {
+		if b := c.limit.Load(); b != nil {
+			b.WaitN(n)
+		}
+	}
+}
+
+// SetLimit changes the throughput cap live, 0 removes it
+func (c *Counter) SetLimit(bytesPerSecond uint64) {
+	if c == nil {
+		return
+	}
+
+	if bytesPerSecond == 0 {
+		c.limit.Store(nil)
+		return
+	}
+
+	if b := c.limit.Load(); b != nil {
+		b.SetRate(bytesPerSecond)
+		return
+	}
+
+	c.limit.Store(ratelimit.NewBucket(bytesPerSecond))
+}
+
+func (c *Counter) Limit() uint64 {
+	if c == nil {
+		return 0
+	}
+
+	if b := c.limit.Load(); b != nil {
+		return b.Rate()
+	}
+
+	return 0
+}
+
+func (c *Counter) Stats() Stats {
+	if c == nil {
+		return Stats{}
+	}
+
+	return Stats{
+		Kind:        c.Kind,
+		Name:        c.Name,
+		Description: c.Description,
+		In:          c.in.Load(),
+		Out:         c.out.Load(),
+		RateIn:      c.rateIn.Load(),
+		RateOut:     c.rateOut.Load(),
+		Limit:       c.Limit(),
+	}
+}
+
+type key struct {
+	kind, name string
+}
+
+var (
+	lck      sync.RWMutex
+	counters = map[key]*Counter{}
+
+	// Counters that have been removed but still have bytes that havent been written to the database
+	retired []*Counter
+
+	// Serialises flushes, as the final flush on shutdown can race the periodic one
+	flushLck sync.Mutex
+)
+
+func register(kind, name, description string, parent *Counter) *Counter {
+	lck.Lock()
+
+	k := key{kind, name}
+	if c, ok := counters[k]; ok {
+		lck.Unlock()
+		return c
+	}
+
+	c := &Counter{Kind: kind, Name: name, Description: description, parent: parent}
+	counters[k] = c
+
+	lck.Unlock()
+
+	// Matching limits may call back into other packages, so must be done without holding the lock
+	c.SetLimit(limitFor(kind, name))
+
+	return c
+}
+
+func get(kind, name string) *Counter {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	return counters[key{kind, name}]
+}
+
+func remove(kind, name string) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	k := key{kind, name}
+	if c, ok := counters[k]; ok {
+		retired = append(retired, c)
+		delete(counters, k)
+	}
+}
+
+// RegisterClient creates the counter for a newly connected client
+func RegisterClient(id, hostname string) *Counter {
+	return register(ClientKind, id, hostname, nil)
+}
+
+// GetClient returns the counter for a connected client or nil if it is not known, a nil counter is safe to use
+func GetClient(id string) *Counter {
+	return get(ClientKind, id)
+}
+
+// RemoveClient stops tracking a disconnected client, any unwritten bytes are still persisted
+func RemoveClient(id string) {
+	remove(ClientKind, id)
+}
+
+// Operator returns the counter for an rssh user, creating it if required. Operator counters live for the lifetime of the server
+func Operator(username string) *Counter {
+	return register(OperatorKind, username, "", nil)
+}
+
+func RegisterProxy(name, description string) *Counter {
+	return register(ProxyKind, name, description, nil)
+}
+
+func RemoveProxy(name string) {
+	remove(ProxyKind, name)
+}
+
+// RegisterForward tracks a single port opened on the server by a proxy, its traffic also counts towards the proxy
+func RegisterForward(address string, proxy *Counter) *Counter {
+	description := ""
+	if proxy != nil {
+		description = proxy.Name
+	}
+
+	return register(ForwardKind, address, description, proxy)
+}
+
+func RemoveForward(address string) {
+	remove(ForwardKind, address)
+}
+
+// List returns a snapshot of all active counters of the specified kind, sorted by name
+func List(kind string) []Stats {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	var out []Stats
+	for k, c := range counters {
+		if k.kind == kind {
+			out = append(out, c.Stats())
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+
+	return out
+}
+
+type countingReader struct {
+	r   io.Reader
+	add func(int)
+}
+
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	if n > 0 {
+		cr.add(n)
+	}
+	return n, err
+}
+
+// accountant credits the bytes and then blocks until any limits allow them through.
+// Blocking after the read means the next read is delayed, so the sender is slowed down by ssh/tcp backpressure
+func accountant(dir Direction, client, operator *Counter) func(int) {
+	if dir == FromClient {
+		return func(n int) {
+			client.addIn(n)
+			operator.addOut(n)
+
+			client.wait(n)
+			operator.wait(n)
+		}
+	}
+
+	return func(n int) {
+		client.addOut(n)
+		operator.addIn(n)
+
+		client.wait(n)
+		operator.wait(n)
+	}
+}
+
+// Copy is io.Copy that credits every byte to the client and operator counters, either of which may be nil, and enforces their limits
+func Copy(dst io.Writer, src io.Reader, dir Direction, client, operator *Counter) (int64, error) {
+	return io.Copy(dst, &countingReader{r: src, add: accountant(dir, client, operator)})
+}
+
+type countingConn struct {
+	net.Conn
+
+	read, written func(int)
+}
+
+func (cc *countingConn) Read(b []byte) (int, error) {
+	n, err := cc.Conn.Read(b)
+	if n > 0 {
+		cc.read(n)
+	}
+	return n, err
+}
+
+func (cc *countingConn) Write(b []byte) (int, error) {
+	n, err := cc.Conn.Write(b)
+	if n > 0 {
+		cc.written(n)
+	}
+	return n, err
+}
+
+// Conn wraps a connection whose far end is the client, reads are counted as coming from the client and writes as going to it
+func Conn(c net.Conn, client, operator *Counter) net.Conn {
+	return &countingConn{
+		Conn:    c,
+		read:    accountant(FromClient, client, operator),
+		written: accountant(ToClient, client, operator),
+	}
+}
+
+func today() string {
+	return time.Now().Format("2006-01-02")
+}
+
+func tick() {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	for _, c := range counters {
+		in, out := c.in.Load(), c.out.Load()
+
+		c.rateIn.Store(in - c.lastIn)
+		c.rateOut.Store(out - c.lastOut)
+
+		c.lastIn, c.lastOut = in, out
+	}
+}
+
+// Flush writes any bytes counted since the last flush to the database. Counters that fail to be written keep their bytes for the next flush
+func Flush() {
+	flushLck.Lock()
+	defer flushLck.Unlock()
+
+	lck.Lock()
+	toFlush := make([]*Counter, 0, len(counters)+len(retired))
+	for _, c := range counters {
+		toFlush = append(toFlush, c)
+	}
+	toFlush = append(toFlush, retired...)
+	retired = nil
+	lck.Unlock()
+
+	var unwritten []*Counter
+
+	day := today()
+	for _, c := range toFlush {
+		in, out := c.in.Load(), c.out.Load()
+
+		deltaIn, deltaOut := in-c.flushedIn, out-c.flushedOut
+		if deltaIn == 0 && deltaOut == 0 {
+			continue
+		}
+
+		err := persist(day, c.Kind, c.Name, c.Description, int64(deltaIn), int64(deltaOut))
+		if err != nil {
+			log.Printf("unable to persist traffic for %s %s: %s", c.Kind, c.Name, err)
+			unwritten = append(unwritten, c)
+			continue
+		}
+
+		c.flushedIn, c.flushedOut = in, out
+	}
+
+	lck.Lock()
+	defer lck.Unlock()
+
+	// Active counters are picked up again next time, but removed counters would be forgotten
+	for _, c := range unwritten {
+		if counters[key{c.Kind, c.Name}] != c {
+			retired = append(retired, c)
+		}
+	}
+}
+
+// Start calculates throughput every second and periodically writes daily totals to the database, requires the database to be loaded
+func Start() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	lastFlush := time.Now()
+	for range ticker.C {
+		tick()
+
+		if time.Since(lastFlush) >= flushInterval {
+			Flush()
+			lastFlush = time.Now()
+		}
+	}
+}
+
+// FormatBytes turns a byte count into a short human readable string
+func FormatBytes(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.2f %cB", float64(b)/float64(div), "KMGTPE"[exp])
+}
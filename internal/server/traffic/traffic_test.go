@@ -0,0 +1,219 @@
+package traffic
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCopyDirection(t *testing.T) {
+	client := RegisterClient("test-copy", "host")
+	defer RemoveClient("test-copy")
+
+	operator := Operator("test-operator")
+
+	var out bytes.Buffer
+	if _, err := Copy(&out, strings.NewReader("hello"), FromClient, client, operator); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Copy(&out, strings.NewReader("hi"), ToClient, client, operator); err != nil {
+		t.Fatal(err)
+	}
+
+	c, o := client.Stats(), operator.Stats()
+	if c.In != 5 || c.Out != 2 {
+		t.Fatalf("client counted in %d out %d, expected in 5 out 2", c.In, c.Out)
+	}
+
+	if o.In != 2 || o.Out != 5 {
+		t.Fatalf("operator counted in %d out %d, expected in 2 out 5", o.In, o.Out)
+	}
+
+	// A nil counter (e.g a client that has already disconnected) must not stop the copy
+	if _, err := Copy(&out, strings.NewReader("abc"), ToClient, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.String() != "hellohiabc" {
+		t.Fatalf("copy did not pass through data correctly: %q", out.String())
+	}
+}
+
+func TestConn(t *testing.T) {
+	client := RegisterClient("test-conn", "host")
+	defer RemoveClient("test-conn")
+
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+
+	conn := Conn(p1, client, nil)
+
+	go p2.Write([]byte("1234"))
+	if _, err := conn.Read(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	go p2.Read(make([]byte, 3))
+	if _, err := conn.Write([]byte("123")); err != nil {
+		t.Fatal(err)
+	}
+
+	s := client.Stats()
+	if s.In != 4 || s.Out != 3 {
+		t.Fatalf("conn counted in %d out %d, expected in 4 out 3", s.In, s.Out)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := map[uint64]string{
+		0:               "0 B",
+		1023:            "1023 B",
+		1024:            "1.00 KB",
+		1536:            "1.50 KB",
+		5 * 1024 * 1024: "5.00 MB",
+	}
+
+	for in, expected := range tests {
+		if got := FormatBytes(in); got != expected {
+			t.Errorf("FormatBytes(%d) = %q, expected %q", in, got, expected)
+		}
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	tests := map[string]uint64{
+		"512":   512,
+		"100KB": 100 * 1024,
+		"100k":  100 * 1024,
+		"1.5MB": 1536 * 1024,
+		"2G":    2 * 1024 * 1024 * 1024,
+	}
+
+	for in, expected := range tests {
+		got, err := ParseBytes(in)
+		if err != nil {
+			t.Errorf("ParseBytes(%q) returned error: %s", in, err)
+			continue
+		}
+
+		if got != expected {
+			t.Errorf("ParseBytes(%q) = %d, expected %d", in, got, expected)
+		}
+	}
+
+	for _, invalid := range []string{"", "fast", "-1MB", "1XB"} {
+		if _, err := ParseBytes(invalid); err == nil {
+			t.Errorf("ParseBytes(%q) should have failed", invalid)
+		}
+	}
+}
+
+func TestLimitRules(t *testing.T) {
+	forward := RegisterForward("127.0.0.1:9999", nil)
+	defer RemoveForward("127.0.0.1:9999")
+
+	if err := SetLimit(ForwardKind, "127.0.0.1:*", "test", true, 1024, GlobMatcher("127.0.0.1:*")); err != nil {
+		t.Fatal(err)
+	}
+	if forward.Limit() != 1024 {
+		t.Fatalf("expected existing forward to be limited to 1024, got %d", forward.Limit())
+	}
+
+	// New counters pick up existing rules
+	other := RegisterForward("127.0.0.1:9998", nil)
+	defer RemoveForward("127.0.0.1:9998")
+	if other.Limit() != 1024 {
+		t.Fatalf("expected new forward to be limited to 1024, got %d", other.Limit())
+	}
+
+	if found, err := RemoveLimit(ForwardKind, "127.0.0.1:*", "test", true); !found || err != nil {
+		t.Fatalf("expected rule to be removed: %v", err)
+	}
+
+	if forward.Limit() != 0 {
+		t.Fatalf("expected limit to be removed, got %d", forward.Limit())
+	}
+}
+
+func TestLimitOwnership(t *testing.T) {
+	operator := Operator("jim")
+	defer remove(OperatorKind, "jim")
+
+	if err := SetLimit(OperatorKind, "j*", "admin", true, 1024, GlobMatcher("j*")); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveLimit(OperatorKind, "j*", "admin", true)
+
+	if err := SetLimit(OperatorKind, "j*", "jim", false, 4096, GlobMatcher("j*")); err != ErrNotRuleOwner {
+		t.Fatalf("non-owner replaced rule: %v", err)
+	}
+
+	if _, err := RemoveLimit(OperatorKind, "j*", "jim", false); err != ErrNotRuleOwner {
+		t.Fatalf("non-owner removed rule: %v", err)
+	}
+
+	// A broader or newer rule from a user must not lift the administrators limit
+	if err := SetLimit(OperatorKind, "jim", "jim", false, 4096, GlobMatcher("jim")); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveLimit(OperatorKind, "jim", "jim", false)
+
+	if operator.Limit() != 1024 {
+		t.Fatalf("user rule raised limit to %d", operator.Limit())
+	}
+
+	// But it can lower it
+	if err := SetLimit(OperatorKind, "jim", "jim", false, 512, GlobMatcher("jim")); err != nil {
+		t.Fatal(err)
+	}
+
+	if operator.Limit() != 512 {
+		t.Fatalf("expected user rule to lower limit to 512, got %d", operator.Limit())
+	}
+
+	// Administrators can replace anyones rule
+	if err := SetLimit(OperatorKind, "jim", "admin", true, 2048, GlobMatcher("jim")); err != nil {
+		t.Fatal(err)
+	}
+
+	if operator.Limit() != 2048 {
+		t.Fatalf("expected newest administrator rule to win, got %d", operator.Limit())
+	}
+}
+
+func TestFlushKeepsUnwrittenBytes(t *testing.T) {
+	defer func(p func(string, string, string, string, int64, int64) error) { persist = p }(persist)
+
+	persist = func(string, string, string, string, int64, int64) error {
+		return errors.New("database unavailable")
+	}
+
+	client := RegisterClient("test-flush", "host")
+	client.addIn(10)
+	client.addOut(20)
+
+	// Removed before a flush could write it, so only the retired list remembers these bytes
+	RemoveClient("test-flush")
+	Flush()
+
+	written := map[string][2]int64{}
+	persist = func(day, kind, name, description string, in, out int64) error {
+		written[name] = [2]int64{in, out}
+		return nil
+	}
+
+	Flush()
+	if written["test-flush"] != [2]int64{10, 20} {
+		t.Fatalf("bytes of a removed client were lost after a failed write: %v", written["test-flush"])
+	}
+
+	clear(written)
+	Flush()
+	if _, ok := written["test-flush"]; ok {
+		t.Fatal("bytes were written twice")
+	}
+}
@@ -24,8 +24,34 @@ var (
 	globalAutoComplete = trie.NewTrie()
 
 	PublicClientsAutoComplete = trie.NewTrie()
+
+	// Keyed by connection, as some commands only have that for the client
+	capabilities = map[ssh.Conn]internal.Capabilities{}
 )
 
+// SetCapabilities records what a client advertised after connecting
+func SetCapabilities(conn ssh.Conn, c internal.Capabilities) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	capabilities[conn] = c
+}
+
+// GetCapabilities returns what a client advertised, clients from before capabilities were advertised have none
+func GetCapabilities(conn ssh.Conn) (internal.Capabilities, bool) {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	c, ok := capabilities[conn]
+	return c, ok
+}
+
+// Supports reports whether a client handles the global request or channel type. Clients that advertised nothing are assumed to, and are left to refuse it themselves
+func Supports(conn ssh.Conn, name string) bool {
+	c, ok := GetCapabilities(conn)
+	return !ok || c.Supports(name)
+}
+
 func NormaliseHostname(hostname string) string {
 	hostname = strings.ToLower(hostname)
 
@@ -128,6 +154,7 @@ func DisassociateClient(uniqueId string, conn *ssh.ServerConn) {
 
 	delete(allClients, uniqueId)
 	delete(uniqueIdToAllAliases, uniqueId)
+	delete(capabilities, conn)
 
 }
 
@@ -162,3 +189,39 @@ func _disassociateFromOwners(uniqueId, owners string) {
 		}
 	}
 }
+
+// VisibleMatch reports whether the client is one username can see and it matches filter. It takes the username rather than
+// the User, so it can be kept in long lived rules, and looks at the single client rather than searching them all
+func VisibleMatch(username string, admin bool, filter, uniqueId string) bool {
+	return _visibleMatch(username, admin, true, filter, uniqueId)
+}
+
+// OwnedMatch is VisibleMatch without the clients shared with every user, for rules that would change how the client behaves for other users
+func OwnedMatch(username string, admin bool, filter, uniqueId string) bool {
+	return _visibleMatch(username, admin, false, filter, uniqueId)
+}
+
+func _visibleMatch(username string, admin, includePublic bool, filter, uniqueId string) bool {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	conn, ok := allClients[uniqueId]
+	if !ok {
+		return false
+	}
+
+	if !admin {
+		_, public := ownedByAll[uniqueId]
+
+		owned := false
+		if u, ok := users[username]; ok {
+			_, owned = u.clients[uniqueId]
+		}
+
+		if !(public && includePublic) && !owned {
+			return false
+		}
+	}
+
+	return _matches(filter, uniqueId, conn.RemoteAddr().String())
+}
@@ -39,6 +39,9 @@ type Connection struct {
 
 	// So we can capture details about who is currently using the rssh server
 	ConnectionDetails string
+
+	// What the second factor for this login is stored under, see mfa.Identity
+	MFAIdentity string
 }
 
 type User struct {
@@ -302,6 +305,7 @@ func _createOrGetUser(username string, serverConnection *ssh.ServerConn) (us *Us
 			serverConnection:  serverConnection,
 			ShellRequests:     make(<-chan *ssh.Request),
 			ConnectionDetails: makeConnectionDetailsString(serverConnection),
+			MFAIdentity:       serverConnection.Permissions.Extensions["mfa-identity"],
 		}
 
 		priv, err := strconv.Atoi(serverConnection.Permissions.Extensions["privilege"])
@@ -13,18 +13,27 @@ import (
 	"github.com/NHAS/reverse_ssh/internal/server/observers"
 )
 
+type event interface {
+	Json() ([]byte, error)
+	Summary() string
+}
+
 func StartWebhooks() {
 
-	messages := make(chan observers.ClientState)
+	messages := make(chan event)
 
 	observers.ConnectionState.Register(func(message observers.ClientState) {
 		messages <- message
 	})
 
+	observers.Bans.Register(func(message observers.BanEvent) {
+		messages <- message
+	})
+
 	go func() {
 		for msg := range messages {
 
-			go func(msg observers.ClientState) {
+			go func(msg event) {
 
 				fullBytes, err := msg.Json()
 				if err != nil {
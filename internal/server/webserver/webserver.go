@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/NHAS/reverse_ssh/internal"
@@ -20,15 +21,33 @@ import (
 
 var (
 	DefaultConnectBack string
-	defaultFingerPrint string
 	projectRoot        string
 	webserverOn        bool
+
+	// Changed by host key rotation while builds are reading it
+	fingerprintLck     sync.RWMutex
+	defaultFingerPrint string
 )
 
+// SetDefaultFingerprint changes the fingerprint baked into new clients, used when the server host key is rotated
+func SetDefaultFingerprint(publicKey ssh.PublicKey) {
+	fingerprintLck.Lock()
+	defer fingerprintLck.Unlock()
+
+	defaultFingerPrint = internal.FingerprintSHA256Hex(publicKey)
+}
+
+func defaultFingerprint() string {
+	fingerprintLck.RLock()
+	defer fingerprintLck.RUnlock()
+
+	return defaultFingerPrint
+}
+
 func Start(webListener net.Listener, connectBackAddress string, autogeneratedConnectBack bool, projRoot, dataDir string, publicKey ssh.PublicKey) {
 	projectRoot = projRoot
 	DefaultConnectBack = connectBackAddress
-	defaultFingerPrint = internal.FingerprintSHA256Hex(publicKey)
+	SetDefaultFingerprint(publicKey)
 
 	err := startBuildManager(filepath.Join(dataDir, "cache"))
 	if err != nil {
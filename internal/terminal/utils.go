@@ -281,8 +281,9 @@ func ParseLine(line string, cursorPosition int) (pl ParsedLine) {
 
 			if capture != nil {
 
+				// Repeated flags keep their values in the order they were given
 				if prev, ok := pl.Flags[capture.Value()]; ok {
-					capture.Args = append(capture.Args, prev.Args...)
+					capture.Args = append(append([]Argument{}, prev.Args...), capture.Args...)
 				}
 
 				pl.Flags[capture.Value()] = *capture
@@ -365,7 +366,7 @@ func ParseLine(line string, cursorPosition int) (pl ParsedLine) {
 
 	if capture != nil {
 		if prev, ok := pl.Flags[capture.Value()]; ok {
-			capture.Args = append(capture.Args, prev.Args...)
+			capture.Args = append(append([]Argument{}, prev.Args...), capture.Args...)
 		}
 		pl.Flags[capture.Value()] = *capture
 		pl.FlagsOrdered = append(pl.FlagsOrdered, *capture)
@@ -2,6 +2,7 @@ package terminal
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -96,6 +97,19 @@ func TestMixedArgs(t *testing.T) {
 
 }
 
+func TestRepeatedFlagOrder(t *testing.T) {
+	line := ParseLine("client -d first -d second --foreground -d third", 0)
+
+	d, err := line.GetArgsString("d")
+	if err != nil {
+		t.Fatalf("Did not expect to get an error here: %s", err)
+	}
+
+	if strings.Join(d, " ") != "first second third" {
+		t.Fatalf("Repeated flags should keep the order they were given in, got: %q", d)
+	}
+}
+
 func TestHelperFunctionsErrors(t *testing.T) {
 	line := ParseLine("lala --long_arg test -t a --zero -m", 0)
 
@@ -8,6 +8,9 @@ import (
 type bufferedConn struct {
 	prefix []byte
 	conn   net.Conn
+
+	// Overrides the underlying connections address, e.g when the client is behind a proxy
+	remoteAddr net.Addr
 }
 
 func (bc *bufferedConn) Read(b []byte) (n int, err error) {
@@ -43,6 +46,9 @@ func (bc *bufferedConn) LocalAddr() net.Addr {
 }
 
 func (bc *bufferedConn) RemoteAddr() net.Addr {
+	if bc.remoteAddr != nil {
+		return bc.remoteAddr
+	}
 	return bc.conn.RemoteAddr()
 }
 
@@ -0,0 +1,240 @@
+package mux
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+type TLSKeyPair struct {
+	CertPath, KeyPath string
+}
+
+type TLSCertificateInfo struct {
+	TLSKeyPair
+	Automatic bool
+	Leaf      *x509.Certificate
+}
+
+// How often certificate files are checked for changes, checks are done during handshakes so an idle server does no work
+var TLSReloadInterval = 10 * time.Second
+
+// Automatic certificates are replaced when they are this close to expiring
+const autoRenewBefore = 7 * 24 * time.Hour
+
+type loadedCertificate struct {
+	TLSKeyPair
+	cert    tls.Certificate
+	modTime time.Time
+}
+
+type certStore struct {
+	sync.RWMutex
+
+	pairs []TLSKeyPair
+
+	automatic      bool
+	autoCommonName string
+	autoGenerate   func(commonName string) (tls.Certificate, error)
+	autoPaths      TLSKeyPair
+
+	loaded    []loadedCertificate
+	lastCheck time.Time
+}
+
+func newCertStore(c MultiplexerConfig) (*certStore, error) {
+	s := &certStore{
+		pairs:          c.TLSCertificates,
+		autoCommonName: c.AutoTLSCommonName,
+		autoGenerate:   genX509KeyPair,
+		autoPaths:      TLSKeyPair{CertPath: c.AutoTLSCertPath, KeyPath: c.AutoTLSKeyPath},
+	}
+
+	if c.AutoTLSCertificate != nil {
+		s.autoGenerate = c.AutoTLSCertificate
+	}
+
+	if len(s.pairs) == 0 {
+		s.automatic = true
+
+		// Without somewhere to keep it the automatic certificate only lasts as long as the process
+		if s.autoPaths.CertPath == "" || s.autoPaths.KeyPath == "" {
+			cert, err := s.autoGenerate(s.autoCommonName)
+			if err != nil {
+				return nil, fmt.Errorf("TLS is enabled but generating certs/key failed: %s", err)
+			}
+
+			s.loaded = []loadedCertificate{{cert: cert}}
+			return s, nil
+		}
+
+		s.pairs = []TLSKeyPair{s.autoPaths}
+	}
+
+	return s, s.Reload()
+}
+
+// Non-threadsafe, must hold lock
+func (s *certStore) _renewAutomatic() error {
+	if existing, err := tls.LoadX509KeyPair(s.autoPaths.CertPath, s.autoPaths.KeyPath); err == nil && !s._needsRenewal(existing) {
+		return nil
+	}
+
+	cert, err := s.autoGenerate(s.autoCommonName)
+	if err != nil {
+		return fmt.Errorf("generating certs/key failed: %s", err)
+	}
+
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	var certPem []byte
+	for _, der := range cert.Certificate {
+		certPem = append(certPem, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	if err := os.WriteFile(s.autoPaths.KeyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		return err
+	}
+
+	return os.WriteFile(s.autoPaths.CertPath, certPem, 0600)
+}
+
+// Non-threadsafe, must hold lock
+func (s *certStore) _needsRenewal(cert tls.Certificate) bool {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return true
+	}
+
+	if time.Until(leaf.NotAfter) < autoRenewBefore {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(s.autoCommonName)
+	if err != nil {
+		host = s.autoCommonName
+	}
+
+	// The external address has changed since the certificate was made
+	return host != "" && leaf.VerifyHostname(host) != nil
+}
+
+func modTime(pair TLSKeyPair) (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{pair.CertPath, pair.KeyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+// Reload reads every certificate from disk, if any fail the previously loaded certificates are kept
+func (s *certStore) Reload() error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s._reload(true)
+}
+
+// Non-threadsafe, must hold lock
+func (s *certStore) _reload(force bool) error {
+	s.lastCheck = time.Now()
+
+	if s.automatic && s.autoPaths.CertPath != "" {
+		if err := s._renewAutomatic(); err != nil {
+			return fmt.Errorf("automatic certificate: %s", err)
+		}
+	}
+
+	if !force && len(s.loaded) == len(s.pairs) {
+		changed := false
+		for _, l := range s.loaded {
+			t, err := modTime(l.TLSKeyPair)
+			if err != nil || !t.Equal(l.modTime) {
+				changed = true
+				break
+			}
+		}
+
+		if !changed {
+			return nil
+		}
+	}
+
+	loaded := make([]loadedCertificate, 0, len(s.pairs))
+	for _, pair := range s.pairs {
+		t, err := modTime(pair)
+		if err != nil {
+			return fmt.Errorf("loading certs/key failed: %s, err: %s", pair.CertPath, err)
+		}
+
+		cert, err := tls.LoadX509KeyPair(pair.CertPath, pair.KeyPath)
+		if err != nil {
+			return fmt.Errorf("loading certs/key failed: %s, err: %s", pair.CertPath, err)
+		}
+
+		loaded = append(loaded, loadedCertificate{TLSKeyPair: pair, cert: cert, modTime: t})
+	}
+
+	s.loaded = loaded
+
+	return nil
+}
+
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.Lock()
+	if time.Since(s.lastCheck) > TLSReloadInterval && len(s.pairs) > 0 {
+		if err := s._reload(false); err != nil {
+			log.Println("Unable to reload TLS certificates, still using the previous ones: ", err)
+		}
+	}
+	loaded := s.loaded
+	s.Unlock()
+
+	if len(loaded) == 0 {
+		return nil, errors.New("no certificates loaded")
+	}
+
+	// Pick by SNI, falling back to the first certificate when nothing matches
+	for i := range loaded {
+		if hello.SupportsCertificate(&loaded[i].cert) == nil {
+			return &loaded[i].cert, nil
+		}
+	}
+
+	return &loaded[0].cert, nil
+}
+
+func (s *certStore) info() []TLSCertificateInfo {
+	s.RLock()
+	defer s.RUnlock()
+
+	var result []TLSCertificateInfo
+	for _, l := range s.loaded {
+		leaf, err := x509.ParseCertificate(l.cert.Certificate[0])
+		if err != nil {
+			continue
+		}
+
+		result = append(result, TLSCertificateInfo{TLSKeyPair: l.TLSKeyPair, Automatic: s.automatic, Leaf: leaf})
+	}
+
+	return result
+}
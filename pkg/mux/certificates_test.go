@@ -0,0 +1,111 @@
+package mux
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writePair(t *testing.T, dir, name string) TLSKeyPair {
+	cert, err := genX509KeyPair(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pair := TLSKeyPair{CertPath: filepath.Join(dir, name+".crt"), KeyPath: filepath.Join(dir, name+".key")}
+	if err := os.WriteFile(pair.KeyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(pair.CertPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return pair
+}
+
+func served(t *testing.T, s *certStore, sni string) *x509.Certificate {
+	cert, err := s.getCertificate(&tls.ClientHelloInfo{ServerName: sni, SignatureSchemes: []tls.SignatureScheme{tls.PSSWithSHA256, tls.PKCS1WithSHA256}, SupportedVersions: []uint16{tls.VersionTLS13}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return leaf
+}
+
+func TestCertStoreSNIAndReload(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := newCertStore(MultiplexerConfig{TLSCertificates: []TLSKeyPair{writePair(t, dir, "a.example.com"), writePair(t, dir, "b.example.com")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if leaf := served(t, s, "b.example.com"); leaf.Subject.CommonName != "b.example.com" {
+		t.Fatalf("wrong certificate for sni: %s", leaf.Subject.CommonName)
+	}
+
+	if leaf := served(t, s, "unknown.example.com"); leaf.Subject.CommonName != "a.example.com" {
+		t.Fatalf("first certificate should be the default: %s", leaf.Subject.CommonName)
+	}
+
+	before := served(t, s, "a.example.com")
+
+	// Renewal
+	pair := writePair(t, dir, "a.example.com")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(pair.CertPath, future, future)
+	s.lastCheck = time.Time{}
+
+	if after := served(t, s, "a.example.com"); after.Equal(before) {
+		t.Fatal("changed certificate was not reloaded")
+	}
+}
+
+func TestCertStoreKeepsAutomaticCertificate(t *testing.T) {
+	dir := t.TempDir()
+
+	c := MultiplexerConfig{
+		AutoTLSCommonName: "rssh.example.com:3232",
+		AutoTLSCertPath:   filepath.Join(dir, "auto.crt"),
+		AutoTLSKeyPath:    filepath.Join(dir, "auto.key"),
+	}
+
+	first, err := newCertStore(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := newCertStore(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !served(t, first, "").Equal(served(t, second, "")) {
+		t.Fatal("automatic certificate was regenerated on restart")
+	}
+
+	c.AutoTLSCommonName = "other.example.com:3232"
+	third, err := newCertStore(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if served(t, third, "").VerifyHostname("other.example.com") != nil {
+		t.Fatal("automatic certificate was not replaced when the address changed")
+	}
+}
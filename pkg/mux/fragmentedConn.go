@@ -4,8 +4,10 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -13,6 +15,18 @@ var ErrClosed = errors.New("fragment collector has been closed")
 
 const maxBuffer = 8096
 
+// How long a long polling GET is held open waiting for data, kept under common proxy idle timeouts
+var LongPollHold = 20 * time.Second
+
+// Short polling clients ask every 10 ms, so if they havent talked to us in 2 seconds they're dead
+const shortPollDeadline = 2 * time.Second
+
+// How long a resumable session is kept while its client retries failed requests
+var ResumeGrace = 30 * time.Second
+
+// Data sent to a resumable client is kept until acknowledged, past this writers are made to wait
+const maxUnacknowledged = 256 * 1024
+
 type fragmentedConnection struct {
 	done chan interface{}
 
@@ -22,7 +36,20 @@ type fragmentedConnection struct {
 	localAddr  net.Addr
 	remoteAddr net.Addr
 
-	isDead *time.Timer
+	isDead       *time.Timer
+	deadDeadline time.Duration
+
+	// Client holds a GET open until there is data for it, rather than asking every 10 ms
+	longPoll bool
+
+	// Requests carry byte offsets so failed ones can be retried without losing or repeating data
+	resumable bool
+	resumeLck sync.Mutex
+	// Bytes received from the client so far
+	received int64
+	// Bytes sent to the client that it hasnt acknowledged, starting at offset sentStart
+	sent      []byte
+	sentStart int64
 
 	onClose func()
 }
@@ -37,10 +64,11 @@ func NewFragmentCollector(localAddr net.Addr, remoteAddr net.Addr, onClosed func
 		localAddr:   localAddr,
 		remoteAddr:  remoteAddr,
 		onClose:     onClosed,
+
+		deadDeadline: shortPollDeadline,
 	}
 
-	// Since the polling rate for a client is 10 ms, if they havent talked to us in any sense in 2 seconds they're dead
-	fc.isDead = time.AfterFunc(2*time.Second, func() {
+	fc.isDead = time.AfterFunc(fc.deadDeadline, func() {
 		fc.Close()
 	})
 
@@ -55,8 +83,88 @@ func NewFragmentCollector(localAddr net.Addr, remoteAddr net.Addr, onClosed func
 	return fc, id, nil
 }
 
+// enableLongPoll must be called before the session is shared
+func (fc *fragmentedConnection) enableLongPoll() {
+	fc.longPoll = true
+	// The client is only quiet between one held GET finishing and the next starting
+	fc.deadDeadline = LongPollHold + 10*time.Second
+	fc.isDead.Reset(fc.deadDeadline)
+}
+
+// enableResume must be called before the session is shared, after enableLongPoll
+func (fc *fragmentedConnection) enableResume() {
+	fc.resumable = true
+	fc.deadDeadline += ResumeGrace
+	fc.isDead.Reset(fc.deadDeadline)
+}
+
+// upload adds data that starts at offset in the clients stream, anything already received from an earlier attempt is skipped
+func (fc *fragmentedConnection) upload(offset int64, data []byte) error {
+	fc.resumeLck.Lock()
+	defer fc.resumeLck.Unlock()
+
+	if offset > fc.received {
+		return fmt.Errorf("upload at offset %d would leave a gap, have received %d", offset, fc.received)
+	}
+
+	skip := fc.received - offset
+	if skip >= int64(len(data)) {
+		return nil
+	}
+
+	n, err := fc.readBuffer.Write(data[skip:])
+	fc.received += int64(n)
+
+	return err
+}
+
+// unacknowledged reports whether there is data past ack that has already been sent once, so a GET shouldnt wait
+func (fc *fragmentedConnection) unacknowledged(ack int64) bool {
+	fc.resumeLck.Lock()
+	defer fc.resumeLck.Unlock()
+
+	return fc.sentStart+int64(len(fc.sent)) > ack
+}
+
+// download returns everything from ack onwards, resending whatever the client didnt receive last time
+func (fc *fragmentedConnection) download(ack int64) ([]byte, error) {
+	fc.resumeLck.Lock()
+	defer fc.resumeLck.Unlock()
+
+	end := fc.sentStart + int64(len(fc.sent))
+	if ack < fc.sentStart || ack > end {
+		return nil, fmt.Errorf("client acknowledged offset %d, but %d to %d is all that can be sent", ack, fc.sentStart, end)
+	}
+
+	fc.sent = fc.sent[ack-fc.sentStart:]
+	fc.sentStart = ack
+
+	buf := make([]byte, maxBuffer)
+	for len(fc.sent) < maxUnacknowledged {
+		n, _ := fc.writeBuffer.Read(buf)
+		if n == 0 {
+			break
+		}
+		fc.sent = append(fc.sent, buf[:n]...)
+	}
+
+	return append([]byte(nil), fc.sent...), nil
+}
+
 func (fc *fragmentedConnection) IsAlive() {
-	fc.isDead.Reset(2 * time.Second)
+	fc.isDead.Reset(fc.deadDeadline)
+}
+
+// waitForData holds a long polling GET until there is something to send
+func (fc *fragmentedConnection) waitForData(cancel <-chan struct{}) {
+	if !fc.longPoll {
+		return
+	}
+
+	fc.writeBuffer.WaitForData(LongPollHold, cancel)
+
+	// Holding the request open counts as being alive
+	fc.IsAlive()
 }
 
 func (fc *fragmentedConnection) Read(b []byte) (n int, err error) {
@@ -0,0 +1,248 @@
+package mux
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Unlimited disables a count limit
+const Unlimited = -1
+
+// Limits protect the multiplexer from scanners and reconnect storms. Zero values use the defaults, counts can be set to Unlimited
+type Limits struct {
+	// Open connections across all listeners, including ones that have been handed off. Default unlimited
+	MaxConnections      int
+	MaxConnectionsPerIP int
+
+	// Connections still having their transports unwrapped. Defaults to 1000 in total and 100 per ip
+	MaxHandshakes      int
+	MaxHandshakesPerIP int
+
+	// Time allowed for the PROXY header, protocol detection, TLS and websocket negotiation. Defaults to 5 seconds
+	HandshakeTimeout time.Duration
+	// Time allowed for a consumer (e.g the ssh server) to take an unwrapped connection. Defaults to 2 seconds
+	HandoffTimeout time.Duration
+
+	// HTTP polling sessions held open at once. Defaults to 2000 in total and unlimited per ip
+	MaxPollingSessions      int
+	MaxPollingSessionsPerIP int
+}
+
+func (l Limits) withDefaults() Limits {
+	defaultCount := func(v *int, d int) {
+		if *v == 0 {
+			*v = d
+		}
+	}
+
+	defaultCount(&l.MaxConnections, Unlimited)
+	defaultCount(&l.MaxConnectionsPerIP, Unlimited)
+	defaultCount(&l.MaxHandshakes, 1000)
+	defaultCount(&l.MaxHandshakesPerIP, 100)
+	defaultCount(&l.MaxPollingSessions, 2000)
+	defaultCount(&l.MaxPollingSessionsPerIP, Unlimited)
+
+	if l.HandshakeTimeout <= 0 {
+		l.HandshakeTimeout = 5 * time.Second
+	}
+
+	if l.HandoffTimeout <= 0 {
+		l.HandoffTimeout = 2 * time.Second
+	}
+
+	return l
+}
+
+func withinLimit(current, limit int) bool {
+	return limit < 0 || current < limit
+}
+
+// Drops counts connections closed by the multiplexer before reaching a consumer, by reason
+type Drops struct {
+	ConnectionLimit      uint64
+	ConnectionLimitPerIP uint64
+	HandshakeLimit       uint64
+	HandshakeLimitPerIP  uint64
+	HandshakeTimeout     uint64
+	HandoffTimeout       uint64
+	PollingLimit         uint64
+	PollingLimitPerIP    uint64
+	Filtered             uint64
+	Failed               uint64
+}
+
+type dropCounters struct {
+	connectionLimit, connectionLimitPerIP atomic.Uint64
+	handshakeLimit, handshakeLimitPerIP   atomic.Uint64
+	handshakeTimeout, handoffTimeout      atomic.Uint64
+	pollingLimit, pollingLimitPerIP       atomic.Uint64
+	filtered, failed                      atomic.Uint64
+}
+
+func (d *dropCounters) snapshot() Drops {
+	return Drops{
+		ConnectionLimit:      d.connectionLimit.Load(),
+		ConnectionLimitPerIP: d.connectionLimitPerIP.Load(),
+		HandshakeLimit:       d.handshakeLimit.Load(),
+		HandshakeLimitPerIP:  d.handshakeLimitPerIP.Load(),
+		HandshakeTimeout:     d.handshakeTimeout.Load(),
+		HandoffTimeout:       d.handoffTimeout.Load(),
+		PollingLimit:         d.pollingLimit.Load(),
+		PollingLimitPerIP:    d.pollingLimitPerIP.Load(),
+		Filtered:             d.filtered.Load(),
+		Failed:               d.failed.Load(),
+	}
+}
+
+type Stats struct {
+	Limits Limits
+
+	Connections     int
+	Handshakes      int
+	PollingSessions int
+
+	Drops Drops
+}
+
+func (m *Multiplexer) Stats() Stats {
+	return Stats{
+		Limits:          m.limits,
+		Connections:     m.connections.count(),
+		Handshakes:      m.handshakes.count(),
+		PollingSessions: int(m.pollingSessions.Load()),
+		Drops:           m.drops.snapshot(),
+	}
+}
+
+type limitResult int
+
+const (
+	limitOk limitResult = iota
+	limitTotal
+	limitPerIP
+)
+
+// counter tracks how many of something are in use, in total and per ip
+type counter struct {
+	sync.Mutex
+
+	limit, perIP int
+
+	total int
+	byIP  map[string]int
+}
+
+func newCounter(limit, perIP int) *counter {
+	return &counter{limit: limit, perIP: perIP, byIP: map[string]int{}}
+}
+
+func ipKey(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
+
+// acquire takes a slot, an empty ip is only counted against the total
+func (c *counter) acquire(ip string) limitResult {
+	c.Lock()
+	defer c.Unlock()
+
+	if !withinLimit(c.total, c.limit) {
+		return limitTotal
+	}
+
+	if ip != "" {
+		if !withinLimit(c.byIP[ip], c.perIP) {
+			return limitPerIP
+		}
+		c.byIP[ip]++
+	}
+
+	c.total++
+
+	return limitOk
+}
+
+func (c *counter) release(ip string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.total--
+	if ip != "" {
+		c.byIP[ip]--
+		if c.byIP[ip] <= 0 {
+			delete(c.byIP, ip)
+		}
+	}
+}
+
+// assign moves a slot taken without an ip onto ip, used once the real address behind a proxy is known
+func (c *counter) assign(ip string) limitResult {
+	c.Lock()
+	defer c.Unlock()
+
+	if ip == "" {
+		return limitOk
+	}
+
+	if !withinLimit(c.byIP[ip], c.perIP) {
+		return limitPerIP
+	}
+	c.byIP[ip]++
+
+	return limitOk
+}
+
+func (c *counter) count() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.total
+}
+
+// countedConn gives back its connection slot when closed, whoever closes it
+type countedConn struct {
+	net.Conn
+
+	counter *counter
+
+	mu     sync.Mutex
+	ip     string
+	closed bool
+}
+
+func (c *countedConn) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		c.counter.release(c.ip)
+	}
+	c.mu.Unlock()
+
+	return c.Conn.Close()
+}
+
+func (c *countedConn) assign(ip string) limitResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed || c.ip != "" {
+		return limitOk
+	}
+
+	r := c.counter.assign(ip)
+	if r == limitOk {
+		c.ip = ip
+	}
+
+	return r
+}
@@ -0,0 +1,73 @@
+package mux
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnectionLimits(t *testing.T) {
+	m, err := ListenWithConfig("tcp", "127.0.0.1:0", MultiplexerConfig{
+		Control:            true,
+		PollingAuthChecker: func(string, net.Addr) bool { return false },
+		Limits: Limits{
+			MaxConnectionsPerIP: 2,
+			HandshakeTimeout:    500 * time.Millisecond,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	addr := m.listeners[m.GetListeners()[0]].Addr().String()
+
+	// Neither of these send anything, so both are held open until the handshake timeout
+	var held []net.Conn
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		held = append(held, c)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	refused, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refused.Close()
+
+	refused.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, err := refused.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatalf("connection over the per ip limit was not closed: %v", err)
+	}
+
+	if drops := m.Stats().Drops.ConnectionLimitPerIP; drops != 1 {
+		t.Fatalf("expected one per ip drop, got %d", drops)
+	}
+
+	for _, c := range held {
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := c.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+			t.Fatalf("silent connection was not closed by the handshake timeout: %v", err)
+		}
+	}
+
+	stats := m.Stats()
+	if stats.Drops.HandshakeTimeout != 2 {
+		t.Fatalf("expected two handshake timeouts, got %d", stats.Drops.HandshakeTimeout)
+	}
+
+	if stats.Connections != 0 || stats.Handshakes != 0 {
+		t.Fatalf("slots were not released: %d connections, %d handshakes", stats.Connections, stats.Handshakes)
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -1,12 +1,15 @@
 package mux
 
 import (
-	"errors"
+	"fmt"
 	"net"
 
 	"github.com/NHAS/reverse_ssh/pkg/mux/protocols"
 )
 
+// Wraps net.ErrClosed so accept loops can tell the multiplexer was closed
+var errClosedListener = fmt.Errorf("Accept on closed listener: %w", net.ErrClosed)
+
 type multiplexerListener struct {
 	addr        net.Addr
 	connections chan net.Conn
@@ -20,9 +23,15 @@ func newMultiplexerListener(addr net.Addr, protocol protocols.Type) *multiplexer
 
 func (ml *multiplexerListener) Accept() (net.Conn, error) {
 	if ml.closed {
-		return nil, errors.New("Accept on closed listener")
+		return nil, errClosedListener
+	}
+
+	conn, ok := <-ml.connections
+	if !ok {
+		return nil, errClosedListener
 	}
-	return <-ml.connections, nil
+
+	return conn, nil
 }
 
 // Close closes the listener.
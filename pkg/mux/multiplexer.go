@@ -16,6 +16,7 @@ import (
 	"net"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -32,14 +33,32 @@ type MultiplexerConfig struct {
 	TLS               bool
 	AutoTLSCommonName string
 
-	TLSCertPath string
-	TLSKeyPath  string
+	// Certificates are chosen by SNI, the first is used when nothing matches. Files are reloaded when they change
+	TLSCertificates []TLSKeyPair
+
+	// Optional, used instead of a self signed certificate when no TLSCertificates are set
+	AutoTLSCertificate func(commonName string) (tls.Certificate, error)
+	// Optional, where to keep the automatic certificate so it is reused across restarts
+	AutoTLSCertPath string
+	AutoTLSKeyPath  string
+
+	// Optional, if set TLS clients must present a certificate issued by one of these CAs
+	TLSClientCAs *x509.CertPool
 
 	TcpKeepAlive int
 
 	PollingAuthChecker func(key string, addr net.Addr) bool
 
+	// Optional, called with the remote address of every raw connection before any protocol detection. Returning false drops the connection
+	ConnectionFilter func(addr net.Addr) bool
+
+	// Options for the listener opened by ListenWithConfig
+	ListenerOptions ListenerOptions
+
+	Limits Limits
+
 	tlsConfig *tls.Config
+	certs     *certStore
 }
 
 // https://gist.github.com/shivakar/cd52b5594d4912fbeb46
@@ -62,6 +81,17 @@ func genX509KeyPair(AutoTLSCommonName string) (tls.Certificate, error) {
 			x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
 	}
 
+	host, _, err := net.SplitHostPort(AutoTLSCommonName)
+	if err != nil {
+		host = AutoTLSCommonName
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else if host != "" {
+		template.DNSNames = []string{host}
+	}
+
 	priv, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
 		return tls.Certificate{}, err
@@ -80,17 +110,38 @@ func genX509KeyPair(AutoTLSCommonName string) (tls.Certificate, error) {
 	return outCert, nil
 }
 
+var (
+	errFiltered = errors.New("connection filtered")
+	errLimited  = errors.New("connection limited")
+)
+
+type acceptedConn struct {
+	conn    net.Conn
+	options ListenerOptions
+}
+
 type Multiplexer struct {
 	sync.RWMutex
 	result         map[protocols.Type]*multiplexerListener
 	done           bool
 	listeners      map[string]net.Listener
-	newConnections chan net.Conn
+	options        map[string]ListenerOptions
+	newConnections chan acceptedConn
 
 	config MultiplexerConfig
+
+	limits          Limits
+	connections     *counter
+	handshakes      *counter
+	pollingSessions atomic.Int64
+	drops           dropCounters
 }
 
 func (m *Multiplexer) StartListener(network, address string) error {
+	return m.StartListenerWithOptions(network, address, ListenerOptions{})
+}
+
+func (m *Multiplexer) StartListenerWithOptions(network, address string, opts ListenerOptions) error {
 	m.Lock()
 	defer m.Unlock()
 
@@ -98,6 +149,10 @@ func (m *Multiplexer) StartListener(network, address string) error {
 		return errors.New("Address " + address + " already listening")
 	}
 
+	if strings.HasPrefix(address, QUICScheme) {
+		return m.startQUICListener(address, opts)
+	}
+
 	d := time.Duration(time.Duration(m.config.TcpKeepAlive) * time.Second)
 	if m.config.TcpKeepAlive == 0 {
 		d = time.Duration(-1)
@@ -113,6 +168,7 @@ func (m *Multiplexer) StartListener(network, address string) error {
 	}
 
 	m.listeners[address] = listener
+	m.options[address] = opts
 
 	go func(listen net.Listener) {
 		for {
@@ -123,6 +179,7 @@ func (m *Multiplexer) StartListener(network, address string) error {
 					m.Lock()
 
 					delete(m.listeners, address)
+					delete(m.options, address)
 
 					m.Unlock()
 					return
@@ -130,10 +187,41 @@ func (m *Multiplexer) StartListener(network, address string) error {
 				continue
 
 			}
+
+			// The real address of a proxied connection isnt known until the header is read, which is done off the accept loop
+			proxied := opts.trustsProxy(conn.RemoteAddr())
+			ip := ""
+			if !proxied {
+				if m.config.ConnectionFilter != nil && !m.config.ConnectionFilter(conn.RemoteAddr()) {
+					m.drops.filtered.Add(1)
+					conn.Close()
+					continue
+				}
+
+				ip = ipKey(conn.RemoteAddr())
+			}
+
+			switch m.connections.acquire(ip) {
+			case limitTotal:
+				m.drops.connectionLimit.Add(1)
+				conn.Close()
+				continue
+			case limitPerIP:
+				m.drops.connectionLimitPerIP.Add(1)
+				conn.Close()
+				continue
+			}
+
+			conn = &countedConn{Conn: conn, counter: m.connections, ip: ip}
+			if proxied {
+				conn = &proxyHeaderConn{Conn: conn}
+			}
+
 			go func() {
 				select {
-				case m.newConnections <- conn:
-				case <-time.After(2 * time.Second):
+				case m.newConnections <- acceptedConn{conn: conn, options: opts}:
+				case <-time.After(m.limits.HandoffTimeout):
+					m.drops.handoffTimeout.Add(1)
 					log.Println("Accepting new connection timed out")
 					conn.Close()
 				}
@@ -177,12 +265,16 @@ func (m *Multiplexer) collector(localAddr net.Addr) http.HandlerFunc {
 
 	cleanupConnection := func(id string, conn *fragmentedConnection) {
 		lck.Lock()
-		defer lck.Unlock()
-		if _, exists := connections[id]; exists {
+		_, exists := connections[id]
+		if exists {
 			delete(connections, id)
-			if conn != nil {
-				conn.Close()
-			}
+			m.pollingSessions.Store(int64(len(connections)))
+		}
+		lck.Unlock()
+
+		// Closing calls back in to here, so the lock cant be held
+		if exists && conn != nil {
+			conn.Close()
 		}
 	}
 
@@ -204,8 +296,9 @@ func (m *Multiplexer) collector(localAddr net.Addr) http.HandlerFunc {
 			if req.Method == http.MethodHead {
 				// Check to make sure the public key is within the authorised keys file and if so create an ID for the client connection
 
-				if len(connections) > 2000 {
-					log.Println("server has too many polling connections (", len(connections), " limit is 2k")
+				if !withinLimit(len(connections), m.limits.MaxPollingSessions) {
+					m.drops.pollingLimit.Add(1)
+					log.Println("server has too many polling connections (", len(connections), ") limit is", m.limits.MaxPollingSessions)
 					http.Error(w, "Server Error", http.StatusInternalServerError)
 					return
 				}
@@ -221,6 +314,22 @@ func (m *Multiplexer) collector(localAddr net.Addr) http.HandlerFunc {
 					return
 				}
 
+				if m.limits.MaxPollingSessionsPerIP >= 0 {
+					ip, fromIP := ipKey(realConn.RemoteAddr()), 0
+					for _, existing := range connections {
+						if ipKey(existing.RemoteAddr()) == ip {
+							fromIP++
+						}
+					}
+
+					if !withinLimit(fromIP, m.limits.MaxPollingSessionsPerIP) {
+						m.drops.pollingLimitPerIP.Add(1)
+						log.Println(ip, "has too many polling connections (", fromIP, ") limit is", m.limits.MaxPollingSessionsPerIP)
+						http.Error(w, "Server Error", http.StatusInternalServerError)
+						return
+					}
+				}
+
 				if !m.config.PollingAuthChecker(key, realConn.RemoteAddr()) {
 					log.Println("client connected but the key for starting a new polling session was wrong")
 					http.Error(w, "Bad Request", http.StatusBadRequest)
@@ -237,7 +346,25 @@ func (m *Multiplexer) collector(localAddr net.Addr) http.HandlerFunc {
 					return
 				}
 
+				// Older clients dont ask, and older servers dont answer, so both sides fall back to short polling
+				if req.URL.Query().Get("mode") == "longpoll" {
+					c.enableLongPoll()
+					http.SetCookie(w, &http.Cookie{
+						Name:  "MODE",
+						Value: "longpoll",
+					})
+				}
+
+				if req.URL.Query().Get("resume") == "1" {
+					c.enableResume()
+					http.SetCookie(w, &http.Cookie{
+						Name:  "RESUME",
+						Value: "1",
+					})
+				}
+
 				connections[id] = c
+				m.pollingSessions.Store(int64(len(connections)))
 				http.SetCookie(w, &http.Cookie{
 					Name:  "NID",
 					Value: id,
@@ -246,12 +373,13 @@ func (m *Multiplexer) collector(localAddr net.Addr) http.HandlerFunc {
 				l := m.result[protocols.C2]
 				select {
 				//Allow whatever we're multiplexing to apply backpressure if it cant accept things
-				case l.connections <- c:
-				case <-time.After(2 * time.Second):
-
-					log.Println(l.protocol, "Failed to accept new http connection within 2 seconds, closing connection (may indicate high resource usage)")
+				case l.connections <- &listenerConn{Conn: c, options: OptionsFor(realConn)}:
+				case <-time.After(m.limits.HandoffTimeout):
+					m.drops.handoffTimeout.Add(1)
+					log.Println(l.protocol, "Failed to accept new http connection within", m.limits.HandoffTimeout, "closing connection (may indicate high resource usage)")
 					c.Close()
 					delete(connections, id)
+					m.pollingSessions.Store(int64(len(connections)))
 					http.Error(w, "Server Error", http.StatusInternalServerError)
 					return
 				}
@@ -271,11 +399,18 @@ func (m *Multiplexer) collector(localAddr net.Addr) http.HandlerFunc {
 		// Reset last seen time.
 		c.IsAlive()
 
+		if c.resumable {
+			m.resumableRequest(w, req, id, c, cleanupConnection)
+			return
+		}
+
 		switch req.Method {
 
 		// Get any buffered/queued data
 		case http.MethodGet:
 
+			c.waitForData(req.Context().Done())
+
 			_, err := io.Copy(w, c.writeBuffer)
 			if err != nil {
 				if err == io.EOF {
@@ -300,6 +435,55 @@ func (m *Multiplexer) collector(localAddr net.Addr) http.HandlerFunc {
 	}
 }
 
+// resumableRequest handles GETs and POSTs for sessions that negotiated resuming.
+// Failed requests dont end the session, the client retries them with the same offsets
+func (m *Multiplexer) resumableRequest(w http.ResponseWriter, req *http.Request, id string, c *fragmentedConnection, cleanup func(string, *fragmentedConnection)) {
+	switch req.Method {
+	case http.MethodGet:
+		ack, err := strconv.ParseInt(req.URL.Query().Get("ack"), 10, 64)
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		if !c.unacknowledged(ack) {
+			c.waitForData(req.Context().Done())
+		}
+
+		data, err := c.download(ack)
+		if err != nil {
+			// The two sides disagree about what has been sent, the stream cant be repaired
+			log.Println("resumable polling session desynchronised: ", err)
+			cleanup(id, c)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		w.Write(data)
+
+	case http.MethodPost:
+		offset, err := strconv.ParseInt(req.URL.Query().Get("off"), 10, 64)
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		// Read it all first, a partial body is simply sent again
+		data, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxUnacknowledged))
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		if err := c.upload(offset, data); err != nil {
+			log.Println("resumable polling session desynchronised: ", err)
+			cleanup(id, c)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+	}
+}
+
 func (m *Multiplexer) StopListener(address string) error {
 	m.Lock()
 	defer m.Unlock()
@@ -312,6 +496,14 @@ func (m *Multiplexer) StopListener(address string) error {
 	return listener.Close()
 }
 
+func (m *Multiplexer) GetListenerOptions(address string) (ListenerOptions, bool) {
+	m.RLock()
+	defer m.RUnlock()
+
+	opts, ok := m.options[address]
+	return opts, ok
+}
+
 func (m *Multiplexer) GetListeners() []string {
 	m.RLock()
 	defer m.RUnlock()
@@ -328,7 +520,7 @@ func (m *Multiplexer) GetListeners() []string {
 
 func (m *Multiplexer) QueueConn(c net.Conn) error {
 	select {
-	case m.newConnections <- c:
+	case m.newConnections <- acceptedConn{conn: c}:
 		return nil
 	case <-time.After(250 * time.Millisecond):
 		return errors.New("too busy to queue connection")
@@ -339,16 +531,43 @@ func ListenWithConfig(network, address string, _c MultiplexerConfig) (*Multiplex
 
 	var m Multiplexer
 
-	m.newConnections = make(chan net.Conn)
+	m.newConnections = make(chan acceptedConn)
 	m.listeners = make(map[string]net.Listener)
+	m.options = make(map[string]ListenerOptions)
 	m.result = map[protocols.Type]*multiplexerListener{}
 	m.config = _c
+	m.limits = _c.Limits.withDefaults()
+	m.connections = newCounter(m.limits.MaxConnections, m.limits.MaxConnectionsPerIP)
+	m.handshakes = newCounter(m.limits.MaxHandshakes, m.limits.MaxHandshakesPerIP)
 
 	if _c.PollingAuthChecker == nil {
 		return nil, errors.New("no authentication method supplied for polling muxing, this may lead to extreme dos if not set. Must set it")
 	}
 
-	err := m.StartListener(network, address)
+	if m.config.TLS {
+		var err error
+		m.config.certs, err = newCertStore(m.config)
+		if err != nil {
+			return nil, err
+		}
+
+		m.config.tlsConfig = &tls.Config{
+			PreferServerCipherSuites: true,
+			CurvePreferences: []tls.CurveID{
+				tls.CurveP256,
+				tls.X25519, // Go 1.8 only
+			},
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: m.config.certs.getCertificate,
+		}
+
+		if m.config.TLSClientCAs != nil {
+			m.config.tlsConfig.ClientCAs = m.config.TLSClientCAs
+			m.config.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	err := m.StartListenerWithOptions(network, address, m.config.ListenerOptions)
 	if err != nil {
 		return nil, err
 	}
@@ -367,27 +586,62 @@ func ListenWithConfig(network, address string, _c MultiplexerConfig) (*Multiplex
 	// Starts the composer http server turns a bunch of posts/gets into a coherent connection
 	m.startHttpServer()
 
-	var waitingConnections int32
 	go func() {
-		for conn := range m.newConnections {
+		for accepted := range m.newConnections {
 
-			if atomic.LoadInt32(&waitingConnections) > 1000 {
-				conn.Close()
-				continue
+			// Proxied connections are only counted per ip once their header has been read
+			_, proxied := accepted.conn.(*proxyHeaderConn)
+			ip := ""
+			if !proxied {
+				ip = ipKey(accepted.conn.RemoteAddr())
 			}
 
-			//Atomic as other threads may be writing and reading while we do this
-			atomic.AddInt32(&waitingConnections, 1)
-			go func(conn net.Conn) {
+			switch m.handshakes.acquire(ip) {
+			case limitTotal:
+				m.drops.handshakeLimit.Add(1)
+				accepted.conn.Close()
+				continue
+			case limitPerIP:
+				m.drops.handshakeLimitPerIP.Add(1)
+				accepted.conn.Close()
+				continue
+			}
 
-				defer atomic.AddInt32(&waitingConnections, -1)
+			go func(accepted acceptedConn, ip string) {
+				defer func() {
+					m.handshakes.release(ip)
+				}()
+
+				start := time.Now()
+				raw := accepted.conn
+				raw.SetDeadline(start.Add(m.limits.HandshakeTimeout))
+
+				conn := accepted.conn
+				if proxied {
+					var err error
+					conn, ip, err = m.readProxied(conn.(*proxyHeaderConn))
+					if err != nil {
+						if err != errFiltered && err != errLimited {
+							m.drops.failed.Add(1)
+							log.Println("Multiplexing failed (proxy protocol): ", err)
+						}
+						return
+					}
+				}
 
-				newConnection, proto, err := m.unwrapTransports(conn)
+				newConnection, proto, err := m.unwrapTransports(conn, accepted.options)
 				if err != nil {
+					if time.Since(start) >= m.limits.HandshakeTimeout {
+						m.drops.handshakeTimeout.Add(1)
+					} else {
+						m.drops.failed.Add(1)
+					}
 					log.Println("Multiplexing failed (unwrapping): ", err)
 					return
 				}
 
+				raw.SetDeadline(time.Time{})
+
 				l, ok := m.result[proto]
 				if !ok {
 					newConnection.Close()
@@ -397,14 +651,14 @@ func ListenWithConfig(network, address string, _c MultiplexerConfig) (*Multiplex
 
 				select {
 				//Allow whatever we're multiplexing to apply backpressure if it cant accept things
-				case l.connections <- newConnection:
-				case <-time.After(2 * time.Second):
-
-					log.Println(l.protocol, "Failed to accept new connection within 2 seconds, closing connection (may indicate high resource usage)")
+				case l.connections <- &listenerConn{Conn: newConnection, options: accepted.options}:
+				case <-time.After(m.limits.HandoffTimeout):
+					m.drops.handoffTimeout.Add(1)
+					log.Println(l.protocol, "Failed to accept new connection within", m.limits.HandoffTimeout, "closing connection (may indicate high resource usage)")
 					newConnection.Close()
 				}
 
-			}(conn)
+			}(accepted, ip)
 
 		}
 	}()
@@ -412,6 +666,23 @@ func ListenWithConfig(network, address string, _c MultiplexerConfig) (*Multiplex
 	return &m, nil
 }
 
+// ReloadTLS rereads all certificates from disk immediately, rather than waiting for a change to be noticed
+func (m *Multiplexer) ReloadTLS() error {
+	if m.config.certs == nil {
+		return errors.New("TLS is not enabled")
+	}
+
+	return m.config.certs.Reload()
+}
+
+func (m *Multiplexer) TLSCertificates() []TLSCertificateInfo {
+	if m.config.certs == nil {
+		return nil
+	}
+
+	return m.config.certs.info()
+}
+
 func Listen(network, address string) (*Multiplexer, error) {
 	c := MultiplexerConfig{
 		Control:      true,
@@ -503,49 +774,52 @@ func (m *Multiplexer) getProtoListener(proto protocols.Type) net.Listener {
 	return ml
 }
 
-func (m *Multiplexer) unwrapTransports(conn net.Conn) (net.Conn, protocols.Type, error) {
-	conn.SetDeadline(time.Now().Add(2 * time.Second))
+// readProxied reads the PROXY header then applies the filter and per ip limits to the real address, which is returned as the handshake key.
+// The handshake slot must already be held
+func (m *Multiplexer) readProxied(p *proxyHeaderConn) (net.Conn, string, error) {
+	conn, err := readProxyHeader(p.Conn)
+	if err != nil {
+		p.Close()
+		return nil, "", fmt.Errorf("proxy protocol from %s: %s", p.RemoteAddr(), err)
+	}
+
+	if m.config.ConnectionFilter != nil && !m.config.ConnectionFilter(conn.RemoteAddr()) {
+		m.drops.filtered.Add(1)
+		conn.Close()
+		return nil, "", errFiltered
+	}
+
+	ip := ipKey(conn.RemoteAddr())
+	if c, ok := p.Conn.(*countedConn); ok && c.assign(ip) != limitOk {
+		m.drops.connectionLimitPerIP.Add(1)
+		conn.Close()
+		return nil, "", errLimited
+	}
+
+	if m.handshakes.assign(ip) != limitOk {
+		m.drops.handshakeLimitPerIP.Add(1)
+		conn.Close()
+		return nil, "", errLimited
+	}
 
+	return conn, ip, nil
+}
+
+func (m *Multiplexer) unwrapTransports(conn net.Conn, opts ListenerOptions) (net.Conn, protocols.Type, error) {
 	var proto protocols.Type
 	conn, proto, err := m.determineProtocol(conn)
 	if err != nil {
 		return nil, protocols.Invalid, fmt.Errorf("initial determination: %s", err)
 	}
 
-	conn.SetDeadline(time.Time{})
+	if !opts.allowsProtocol(proto) {
+		conn.Close()
+		return nil, protocols.Invalid, fmt.Errorf("%s from %s is not allowed on this listener", proto, conn.RemoteAddr())
+	}
 
 	// Unwrap any outer tls if required
 	if m.config.TLS && proto == "tls" {
 
-		if m.config.tlsConfig == nil {
-
-			tlsConfig := &tls.Config{
-				PreferServerCipherSuites: true,
-				CurvePreferences: []tls.CurveID{
-					tls.CurveP256,
-					tls.X25519, // Go 1.8 only
-				},
-				MinVersion: tls.VersionTLS12,
-			}
-
-			if m.config.TLSCertPath != "" {
-				cert, err := tls.LoadX509KeyPair(m.config.TLSCertPath, m.config.TLSKeyPath)
-				if err != nil {
-					return nil, protocols.Invalid, fmt.Errorf("TLS is enabled but loading certs/key failed: %s, err: %s", m.config.TLSCertPath, err)
-				}
-
-				tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
-			} else {
-				cert, err := genX509KeyPair(m.config.AutoTLSCommonName)
-				if err != nil {
-					return nil, protocols.Invalid, fmt.Errorf("TLS is enabled but generating certs/key failed: %s", err)
-				}
-				tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
-			}
-
-			m.config.tlsConfig = tlsConfig
-		}
-
 		// this is TLS so replace the connection
 		c := tls.Server(conn, m.config.tlsConfig)
 		err := c.Handshake()
@@ -560,11 +834,16 @@ func (m *Multiplexer) unwrapTransports(conn net.Conn) (net.Conn, protocols.Type,
 			return nil, protocols.Invalid, fmt.Errorf("error determining functional protocol: %s", err)
 		}
 
+		if !opts.allowsProtocol(proto) {
+			conn.Close()
+			return nil, protocols.Invalid, fmt.Errorf("%s over tls from %s is not allowed on this listener", proto, conn.RemoteAddr())
+		}
+
 	}
 
 	switch proto {
 	case protocols.Websockets:
-		return m.unwrapWebsockets(conn)
+		return m.unwrapWebsockets(conn, opts)
 	case protocols.HTTP:
 		// This will get passed off to a golang stdlib http server to do further unwrapping/feeding to the ssh component.
 		// Unlike the other connections this isnt a single stream, its multiple connections composed into one blob, so it has to be a lil non-standard
@@ -576,10 +855,11 @@ func (m *Multiplexer) unwrapTransports(conn net.Conn) (net.Conn, protocols.Type,
 		}
 	}
 
+	conn.Close()
 	return nil, protocols.Invalid, fmt.Errorf("after unwrapping transports, nothing useable was found: %s", proto)
 }
 
-func (m *Multiplexer) unwrapWebsockets(conn net.Conn) (net.Conn, protocols.Type, error) {
+func (m *Multiplexer) unwrapWebsockets(conn net.Conn, opts ListenerOptions) (net.Conn, protocols.Type, error) {
 	wsHttp := http.NewServeMux()
 	wsConnChan := make(chan net.Conn, 1)
 
@@ -622,9 +902,14 @@ func (m *Multiplexer) unwrapWebsockets(conn net.Conn) (net.Conn, protocols.Type,
 			return nil, protocols.Invalid, errors.New("after unwrapping websockets found another protocol to unwrap (not control channel or download), does not support infinite protocol nesting")
 		}
 
+		if !opts.allowsProtocol(proto) {
+			conn.Close()
+			return nil, protocols.Invalid, fmt.Errorf("%s over websockets from %s is not allowed on this listener", proto, conn.RemoteAddr())
+		}
+
 		return result, proto, nil
 
-	case <-time.After(2 * time.Second):
+	case <-time.After(m.limits.HandshakeTimeout):
 		conn.Close()
 		return nil, protocols.Invalid, errors.New("multiplexing failed: websockets took too long to negotiate")
 	}
@@ -0,0 +1,122 @@
+package mux
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/NHAS/reverse_ssh/pkg/mux/protocols"
+)
+
+type ListenerOptions struct {
+	// Connections from these networks must start with a PROXY protocol (v1 or v2) header, which replaces their remote address.
+	// Connections from anywhere else are treated as direct
+	TrustedProxies []*net.IPNet
+
+	// Protocols accepted on the listener, each layer must be allowed so wss needs both tls and ws. Empty allows everything
+	Protocols []protocols.Type
+
+	// Kinds of login consumers should accept from connections on this listener, the multiplexer doesnt enforce these. Empty allows everything
+	Logins []string
+}
+
+var protocolNames = map[string]protocols.Type{
+	"ssh":      protocols.C2,
+	"tls":      protocols.TLS,
+	"ws":       protocols.Websockets,
+	"http":     protocols.HTTP,
+	"polling":  protocols.HTTP,
+	"download": protocols.HTTPDownload,
+	"raw":      protocols.TCPDownload,
+}
+
+// ParseProtocols takes a comma separated list of ssh, tls, ws, http (polling), download and raw (download)
+func ParseProtocols(s string) ([]protocols.Type, error) {
+	var result []protocols.Type
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		p, ok := protocolNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown protocol %q, valid protocols are ssh, tls, ws, http, download and raw", name)
+		}
+
+		if !slices.Contains(result, p) {
+			result = append(result, p)
+		}
+	}
+
+	return result, nil
+}
+
+func (lo ListenerOptions) allowsProtocol(p protocols.Type) bool {
+	return len(lo.Protocols) == 0 || slices.Contains(lo.Protocols, p)
+}
+
+func (lo ListenerOptions) AllowsLogin(kind string) bool {
+	return len(lo.Logins) == 0 || slices.Contains(lo.Logins, kind)
+}
+
+func (lo ListenerOptions) trustsProxy(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, n := range lo.TrustedProxies {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (lo ListenerOptions) String() string {
+	var parts []string
+	if len(lo.Protocols) > 0 {
+		var names []string
+		for _, p := range lo.Protocols {
+			names = append(names, string(p))
+		}
+		parts = append(parts, "protocols="+strings.Join(names, ","))
+	}
+
+	if len(lo.Logins) > 0 {
+		parts = append(parts, "logins="+strings.Join(lo.Logins, ","))
+	}
+
+	if len(lo.TrustedProxies) > 0 {
+		var networks []string
+		for _, n := range lo.TrustedProxies {
+			networks = append(networks, n.String())
+		}
+		parts = append(parts, "proxy-protocol="+strings.Join(networks, ","))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// Carries the options of the listener a connection arrived on through to whatever consumes it
+type listenerConn struct {
+	net.Conn
+	options ListenerOptions
+}
+
+// WithOptions attaches options to a connection accepted outside the multiplexer, so consumers apply the same restrictions
+func WithOptions(conn net.Conn, opts ListenerOptions) net.Conn {
+	return &listenerConn{Conn: conn, options: opts}
+}
+
+// OptionsFor returns the options of the listener conn arrived on, connections that didnt come from a listener have no restrictions
+func OptionsFor(conn net.Conn) ListenerOptions {
+	if lc, ok := conn.(*listenerConn); ok {
+		return lc.options
+	}
+
+	return ListenerOptions{}
+}
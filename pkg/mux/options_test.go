@@ -0,0 +1,168 @@
+package mux
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/pkg/mux/protocols"
+	"golang.org/x/net/websocket"
+)
+
+func TestListenerRestrictions(t *testing.T) {
+	m, err := ListenWithConfig("tcp", "127.0.0.1:0", MultiplexerConfig{
+		Control:            true,
+		Downloads:          true,
+		PollingAuthChecker: func(string, net.Addr) bool { return false },
+		ListenerOptions:    ListenerOptions{Logins: []string{"operators"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	downloadsOnly, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloadsOnlyAddr := downloadsOnly.Addr().String()
+	downloadsOnly.Close()
+
+	if err := m.StartListenerWithOptions("tcp", downloadsOnlyAddr, ListenerOptions{Protocols: []protocols.Type{protocols.HTTPDownload}}); err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			c, err := m.ControlRequests().Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	dial := func(addr string) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+
+		c.Write([]byte("SSH-2.0-test\r\n"))
+		c.SetReadDeadline(time.Now().Add(3 * time.Second))
+		c.Read(make([]byte, 1))
+	}
+
+	go dial(downloadsOnlyAddr)
+	select {
+	case <-accepted:
+		t.Fatal("ssh was accepted on a download only listener")
+	case <-time.After(time.Second):
+	}
+
+	var main string
+	for _, l := range m.GetListeners() {
+		if l != downloadsOnlyAddr {
+			main = m.listeners[l].Addr().String()
+		}
+	}
+
+	go dial(main)
+	select {
+	case c := <-accepted:
+		opts := OptionsFor(c)
+		if !opts.AllowsLogin("operators") || opts.AllowsLogin("controllees") {
+			t.Fatalf("listener options were not carried with the connection: %+v", opts)
+		}
+		c.Close()
+	case <-time.After(3 * time.Second):
+		t.Fatal("ssh was not accepted on an unrestricted listener")
+	}
+}
+
+func TestListenerRestrictionsOverWebsockets(t *testing.T) {
+	m, err := ListenWithConfig("tcp", "127.0.0.1:0", MultiplexerConfig{
+		Control:            true,
+		Downloads:          true,
+		PollingAuthChecker: func(string, net.Addr) bool { return false },
+		ListenerOptions:    ListenerOptions{Protocols: []protocols.Type{protocols.Websockets, protocols.C2}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	addr := m.listeners[m.GetListeners()[0]].Addr().String()
+
+	accepted := make(chan net.Conn, 2)
+	for _, l := range []net.Listener{m.ControlRequests(), m.HTTPDownloadRequests()} {
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				accepted <- c
+			}
+		}()
+	}
+
+	dial := func(payload string) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+
+		config, err := websocket.NewConfig("ws://"+addr+"/ws", "ws://"+addr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		ws, err := websocket.NewClient(config, c)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ws.PayloadType = websocket.BinaryFrame
+
+		ws.Write([]byte(payload))
+		c.SetReadDeadline(time.Now().Add(3 * time.Second))
+		ws.Read(make([]byte, 1))
+	}
+
+	go dial("GET /file HTTP/1.1\r\nHost: test\r\n\r\n")
+	select {
+	case <-accepted:
+		t.Fatal("download over websockets was accepted on a listener that does not allow downloads")
+	case <-time.After(time.Second):
+	}
+
+	go dial("SSH-2.0-test\r\n")
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(3 * time.Second):
+		t.Fatal("ssh over websockets was not accepted on a listener that allows it")
+	}
+}
+
+func TestParseProtocols(t *testing.T) {
+	p, err := ParseProtocols("tls, ws,polling,http")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(p) != 3 {
+		t.Fatalf("expected duplicates to be removed: %v", p)
+	}
+
+	if _, err := ParseProtocols("gopher"); err == nil {
+		t.Fatal("unknown protocol was accepted")
+	}
+}
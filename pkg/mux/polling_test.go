@@ -0,0 +1,226 @@
+package mux
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLongPolling(t *testing.T) {
+	m, err := ListenWithConfig("tcp", "127.0.0.1:0", MultiplexerConfig{
+		Control:            true,
+		PollingAuthChecker: func(string, net.Addr) bool { return true },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	base := "http://" + m.listeners[m.GetListeners()[0]].Addr().String()
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	open := func(query string) (id string, longPoll bool, conn net.Conn) {
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			c, err := m.ControlRequests().Accept()
+			if err == nil {
+				accepted <- c
+			}
+		}()
+
+		resp, err := client.Head(base + "/push?key=00" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		for _, cookie := range resp.Cookies() {
+			switch cookie.Name {
+			case "NID":
+				id = cookie.Value
+			case "MODE":
+				longPoll = cookie.Value == "longpoll"
+			}
+		}
+
+		select {
+		case conn = <-accepted:
+		case <-time.After(3 * time.Second):
+			t.Fatal("session was not handed to the control listener")
+		}
+
+		return id, longPoll, conn
+	}
+
+	get := func(id string) (string, time.Duration) {
+		start := time.Now()
+		resp, err := client.Get(base + "/push/1?id=" + id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		return string(body), time.Since(start)
+	}
+
+	id, longPoll, legacy := open("")
+	defer legacy.Close()
+	if longPoll {
+		t.Fatal("server offered long polling to a client that did not ask for it")
+	}
+
+	if body, took := get(id); body != "" || took > time.Second {
+		t.Fatalf("short poll should return straight away with nothing, got %q after %s", body, took)
+	}
+
+	id, longPoll, conn := open("&mode=longpoll")
+	defer conn.Close()
+	if !longPoll {
+		t.Fatal("server did not agree to long polling")
+	}
+
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		conn.Write([]byte("hello"))
+	}()
+
+	body, took := get(id)
+	if body != "hello" {
+		t.Fatalf("expected the held request to return the write, got %q", body)
+	}
+
+	if took < 200*time.Millisecond {
+		t.Fatalf("long poll returned after %s, before there was any data", took)
+	}
+}
+
+func TestResumablePolling(t *testing.T) {
+	m, err := ListenWithConfig("tcp", "127.0.0.1:0", MultiplexerConfig{
+		Control:            true,
+		PollingAuthChecker: func(string, net.Addr) bool { return true },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	base := "http://" + m.listeners[m.GetListeners()[0]].Addr().String()
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := m.ControlRequests().Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+
+	resp, err := client.Head(base + "/push?key=00&resume=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	var id string
+	resumable := false
+	for _, cookie := range resp.Cookies() {
+		switch cookie.Name {
+		case "NID":
+			id = cookie.Value
+		case "RESUME":
+			resumable = cookie.Value == "1"
+		}
+	}
+
+	if !resumable {
+		t.Fatal("server did not agree to resuming")
+	}
+
+	var conn net.Conn
+	select {
+	case conn = <-accepted:
+	case <-time.After(3 * time.Second):
+		t.Fatal("session was not handed to the control listener")
+	}
+	defer conn.Close()
+
+	get := func(ack int) string {
+		resp, err := client.Get(base + "/push/1?id=" + id + "&ack=" + strconv.Itoa(ack))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	post := func(offset int, data string) {
+		resp, err := client.Post(base+"/push?id="+id+"&off="+strconv.Itoa(offset), "application/octet-stream", strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("upload at %d was refused: %d", offset, resp.StatusCode)
+		}
+	}
+
+	go conn.Write([]byte("hello"))
+	time.Sleep(100 * time.Millisecond)
+
+	if body := get(0); body != "hello" {
+		t.Fatalf("expected hello, got %q", body)
+	}
+
+	// Pretend that response never arrived, it must be sent again
+	if body := get(0); body != "hello" {
+		t.Fatalf("unacknowledged data was not resent, got %q", body)
+	}
+
+	go conn.Write([]byte(" world"))
+	time.Sleep(100 * time.Millisecond)
+
+	// Part of the first response made it
+	if body := get(2); body != "llo world" {
+		t.Fatalf("expected resend from the acknowledged offset, got %q", body)
+	}
+
+	// Retried and overlapping uploads must only be delivered once
+	post(0, "abc")
+	post(0, "abc")
+	post(1, "bcdef")
+
+	buf := make([]byte, 16)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _ := io.ReadAtLeast(conn, buf, 6)
+	if string(buf[:n]) != "abcdef" {
+		t.Fatalf("expected abcdef, got %q", buf[:n])
+	}
+
+	// A gap can never be repaired
+	resp, err = client.Post(base+"/push?id="+id+"&off=100", "application/octet-stream", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("upload leaving a gap was accepted: %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,175 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ParseCIDRs takes a comma separated list of networks, single ips are treated as /32 or /128
+func ParseCIDRs(s string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip or network: %q", part)
+			}
+
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, n)
+	}
+
+	return result, nil
+}
+
+// Marks a connection from a trusted proxy whose header hasnt been read yet
+type proxyHeaderConn struct {
+	net.Conn
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readProxyHeader consumes a PROXY protocol header and returns a connection reporting the original client address.
+// Reads are exact, so nothing after the header is lost
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	start := make([]byte, 6)
+	if _, err := io.ReadFull(conn, start); err != nil {
+		return nil, fmt.Errorf("failed to read proxy header: %s", err)
+	}
+
+	var (
+		src net.Addr
+		err error
+	)
+
+	switch {
+	case string(start) == "PROXY ":
+		src, err = readProxyV1(conn)
+	case bytes.Equal(start, proxyV2Signature[:6]):
+		src, err = readProxyV2(conn)
+	default:
+		return nil, errors.New("connection from trusted proxy did not start with a proxy protocol header")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// LOCAL or UNKNOWN connections, e.g health checks, keep the proxies address
+	if src == nil {
+		src = conn.RemoteAddr()
+	}
+
+	return &bufferedConn{conn: conn, remoteAddr: src}, nil
+}
+
+func readProxyV1(conn net.Conn) (net.Addr, error) {
+	// The whole line including "PROXY " is at most 107 bytes
+	line := make([]byte, 0, 101)
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, fmt.Errorf("failed to read proxy v1 header: %s", err)
+		}
+
+		line = append(line, b[0])
+		if b[0] == '\n' {
+			break
+		}
+
+		if len(line) == cap(line) {
+			return nil, errors.New("proxy v1 header too long")
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxy v1 header not terminated by CRLF")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) > 0 && fields[0] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, fmt.Errorf("malformed proxy v1 header: %q", strings.TrimSpace(string(line)))
+	}
+
+	ip := net.ParseIP(fields[1])
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed proxy v1 source address: %q %q", fields[1], fields[3])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(conn net.Conn) (net.Addr, error) {
+	// Remainder of the signature, version and command, family and protocol, length
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, fmt.Errorf("failed to read proxy v2 header: %s", err)
+	}
+
+	if !bytes.Equal(header[:6], proxyV2Signature[6:]) {
+		return nil, errors.New("invalid proxy v2 signature")
+	}
+
+	versionCommand, family := header[6], header[7]
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported proxy protocol version: %d", versionCommand>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[8:]))
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return nil, fmt.Errorf("failed to read proxy v2 addresses: %s", err)
+	}
+
+	switch versionCommand & 0xf {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported proxy v2 command: %d", versionCommand&0xf)
+	}
+
+	switch family >> 4 {
+	case 0x1: // AF_INET
+		if len(payload) < 12 {
+			return nil, errors.New("proxy v2 ipv4 addresses truncated")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, errors.New("proxy v2 ipv6 addresses truncated")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+
+	// Unix sockets and unspecified families carry nothing useful as a remote address
+	return nil, nil
+}
@@ -0,0 +1,85 @@
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func parseHeader(t *testing.T, header []byte) (net.Conn, error) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	go func() {
+		client.Write(append(header, []byte("SSH-2.0-test")...))
+	}()
+
+	return readProxyHeader(server)
+}
+
+func expectAddr(t *testing.T, header []byte, want string) {
+	conn, err := parseHeader(t, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conn.RemoteAddr().String() != want {
+		t.Fatalf("expected remote address %s got %s", want, conn.RemoteAddr())
+	}
+
+	rest := make([]byte, 12)
+	if _, err := io.ReadFull(conn, rest); err != nil || string(rest) != "SSH-2.0-test" {
+		t.Fatalf("data after the header was lost: %q %v", rest, err)
+	}
+}
+
+func TestProxyV1(t *testing.T) {
+	expectAddr(t, []byte("PROXY TCP4 192.0.2.10 198.51.100.1 51234 3232\r\n"), "192.0.2.10:51234")
+	expectAddr(t, []byte("PROXY TCP6 2001:db8::1 2001:db8::2 51234 3232\r\n"), "[2001:db8::1]:51234")
+	expectAddr(t, []byte("PROXY UNKNOWN\r\n"), "pipe")
+
+	if _, err := parseHeader(t, []byte("PROXY TCP4 nonsense\r\n")); err == nil {
+		t.Fatal("malformed header was accepted")
+	}
+}
+
+func TestProxyV2(t *testing.T) {
+	addresses := []byte{192, 0, 2, 10, 198, 51, 100, 1, 0, 0, 0x0c, 0xa0}
+	binary.BigEndian.PutUint16(addresses[8:], 51234)
+
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x21, 0x11, 0, byte(len(addresses)))
+	expectAddr(t, append(header, addresses...), "192.0.2.10:51234")
+
+	local := append([]byte{}, proxyV2Signature...)
+	local = append(local, 0x20, 0x00, 0, 0)
+	expectAddr(t, local, "pipe")
+}
+
+func TestProxyHeaderRequired(t *testing.T) {
+	if _, err := parseHeader(t, []byte("SSH-2.0-")); err == nil {
+		t.Fatal("connection without a header was accepted from a trusted proxy")
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := ParseCIDRs("10.0.0.0/8, 192.0.2.1,2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := ListenerOptions{TrustedProxies: nets}
+	for addr, trusted := range map[string]bool{"10.1.2.3": true, "192.0.2.1": true, "192.0.2.2": false, "2001:db8::5": true} {
+		if opts.trustsProxy(&net.TCPAddr{IP: net.ParseIP(addr)}) != trusted {
+			t.Fatalf("%s trusted should be %t", addr, trusted)
+		}
+	}
+
+	if _, err := ParseCIDRs("not-an-ip"); err == nil {
+		t.Fatal("invalid network was accepted")
+	}
+}
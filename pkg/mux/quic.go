@@ -0,0 +1,357 @@
+package mux
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/pkg/mux/protocols"
+	"golang.org/x/net/quic"
+)
+
+// QUICScheme prefixes listener addresses that should be started as QUIC (UDP) rather than TCP listeners
+const QUICScheme = "quic://"
+
+const (
+	quicALPN = "rssh"
+
+	// QUIC has its own keepalives, these keep NAT mappings open and notice dead peers without waiting on the ssh layer
+	quicKeepAlive   = 10 * time.Second
+	quicIdleTimeout = 60 * time.Second
+)
+
+func quicConfig(tlsConfig *tls.Config) *quic.Config {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.MinVersion = tls.VersionTLS13
+	tlsConfig.NextProtos = []string{quicALPN}
+
+	return &quic.Config{
+		TLSConfig:       tlsConfig,
+		KeepAlivePeriod: quicKeepAlive,
+		MaxIdleTimeout:  quicIdleTimeout,
+	}
+}
+
+// quicListener holds a listening UDP endpoint in the multiplexers listener map, streams are handed straight to the control listener so it never has anything to accept
+type quicListener struct {
+	endpoint *quic.Endpoint
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *quicListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		err = l.endpoint.Close(ctx)
+	})
+
+	return err
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return net.UDPAddrFromAddrPort(l.endpoint.LocalAddr())
+}
+
+// startQUICListener must be called with the multiplexer locked
+func (m *Multiplexer) startQUICListener(address string, opts ListenerOptions) error {
+	if len(opts.TrustedProxies) > 0 {
+		return errors.New("the PROXY protocol is not supported on QUIC listeners")
+	}
+
+	if !opts.allowsProtocol(protocols.C2) {
+		return errors.New("QUIC listeners only carry ssh, which the allowed protocols exclude")
+	}
+
+	// QUIC is always encrypted, so a certificate is needed even if TLS isnt enabled for the TCP listeners
+	if m.config.certs == nil {
+		var err error
+		m.config.certs, err = newCertStore(m.config)
+		if err != nil {
+			return err
+		}
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: m.config.certs.getCertificate,
+	}
+
+	if m.config.TLSClientCAs != nil {
+		tlsConfig.ClientCAs = m.config.TLSClientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	config := quicConfig(tlsConfig)
+	config.HandshakeTimeout = m.limits.HandshakeTimeout
+	// Makes clients prove they own their source address before the server sends anything large, so it cant be used to amplify spoofed traffic
+	config.RequireAddressValidation = true
+
+	endpoint, err := quic.Listen("udp", strings.TrimPrefix(address, QUICScheme), config)
+	if err != nil {
+		return err
+	}
+
+	listener := &quicListener{endpoint: endpoint, done: make(chan struct{})}
+
+	m.listeners[address] = listener
+	m.options[address] = opts
+
+	go func() {
+		for {
+			conn, err := endpoint.Accept(context.Background())
+			if err != nil {
+				listener.Close()
+
+				m.Lock()
+				if m.listeners[address] == listener {
+					delete(m.listeners, address)
+					delete(m.options, address)
+				}
+				m.Unlock()
+				return
+			}
+
+			go m.acceptQUIC(conn, opts)
+		}
+	}()
+
+	return nil
+}
+
+// acceptQUIC applies the same filtering and limits as the TCP accept loop and dispatcher, then waits for the client to open its stream
+func (m *Multiplexer) acceptQUIC(conn *quic.Conn, opts ListenerOptions) {
+	remote := net.UDPAddrFromAddrPort(conn.RemoteAddr())
+
+	if m.config.ConnectionFilter != nil && !m.config.ConnectionFilter(remote) {
+		m.drops.filtered.Add(1)
+		conn.Abort(nil)
+		return
+	}
+
+	ip := ipKey(remote)
+	switch m.connections.acquire(ip) {
+	case limitTotal:
+		m.drops.connectionLimit.Add(1)
+		conn.Abort(nil)
+		return
+	case limitPerIP:
+		m.drops.connectionLimitPerIP.Add(1)
+		conn.Abort(nil)
+		return
+	}
+
+	switch m.handshakes.acquire(ip) {
+	case limitTotal:
+		m.drops.handshakeLimit.Add(1)
+		m.connections.release(ip)
+		conn.Abort(nil)
+		return
+	case limitPerIP:
+		m.drops.handshakeLimitPerIP.Add(1)
+		m.connections.release(ip)
+		conn.Abort(nil)
+		return
+	}
+	defer m.handshakes.release(ip)
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.limits.HandshakeTimeout)
+	stream, err := conn.AcceptStream(ctx)
+	cancel()
+	if err != nil {
+		if ctx.Err() != nil {
+			m.drops.handshakeTimeout.Add(1)
+		} else {
+			m.drops.failed.Add(1)
+		}
+		m.connections.release(ip)
+		conn.Abort(nil)
+		log.Println("Multiplexing failed (quic stream): ", err)
+		return
+	}
+
+	newConnection := &countedConn{Conn: newQUICConn(conn, stream, nil), counter: m.connections, ip: ip}
+
+	l, ok := m.result[protocols.C2]
+	if !ok {
+		newConnection.Close()
+		log.Println("Multiplexing failed (final determination): ", protocols.C2)
+		return
+	}
+
+	select {
+	case l.connections <- &listenerConn{Conn: newConnection, options: opts}:
+	case <-time.After(m.limits.HandoffTimeout):
+		m.drops.handoffTimeout.Add(1)
+		log.Println(l.protocol, "Failed to accept new connection within", m.limits.HandoffTimeout, "closing connection (may indicate high resource usage)")
+		newConnection.Close()
+	}
+}
+
+// DialQUIC connects to a QUIC listener and opens the stream the ssh connection is carried on
+func DialQUIC(ctx context.Context, address string, tlsConfig *tls.Config) (net.Conn, error) {
+	endpoint, err := quic.Listen("udp", ":0", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := endpoint.Dial(ctx, "udp", address, quicConfig(tlsConfig))
+	if err != nil {
+		endpoint.Close(context.Background())
+		return nil, err
+	}
+
+	stream, err := conn.NewStream(ctx)
+	if err != nil {
+		conn.Abort(nil)
+		endpoint.Close(context.Background())
+		return nil, err
+	}
+
+	return newQUICConn(conn, stream, endpoint), nil
+}
+
+// quicConn makes a single QUIC stream look like a net.Conn
+type quicConn struct {
+	conn   *quic.Conn
+	stream *quic.Stream
+
+	// Only set on the client side, where each connection has its own endpoint
+	endpoint *quic.Endpoint
+
+	// Cancelled on close, so blocked reads and writes return
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu                          sync.Mutex
+	readDeadline, writeDeadline time.Time
+
+	closeOnce sync.Once
+}
+
+func newQUICConn(conn *quic.Conn, stream *quic.Stream, endpoint *quic.Endpoint) *quicConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &quicConn{
+		conn:     conn,
+		stream:   stream,
+		endpoint: endpoint,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// withDeadline must only be used from the goroutine doing the read or write, as stream contexts cant be changed concurrently with them
+func (c *quicConn) withDeadline(deadline *time.Time) (context.Context, context.CancelFunc) {
+	c.mu.Lock()
+	d := *deadline
+	c.mu.Unlock()
+
+	if d.IsZero() {
+		return c.ctx, func() {}
+	}
+
+	return context.WithDeadline(c.ctx, d)
+}
+
+func (c *quicConn) translateError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return os.ErrDeadlineExceeded
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return net.ErrClosed
+	}
+
+	return err
+}
+
+func (c *quicConn) Read(b []byte) (int, error) {
+	ctx, cancel := c.withDeadline(&c.readDeadline)
+	defer cancel()
+
+	c.stream.SetReadContext(ctx)
+	n, err := c.stream.Read(b)
+	return n, c.translateError(err)
+}
+
+func (c *quicConn) Write(b []byte) (int, error) {
+	ctx, cancel := c.withDeadline(&c.writeDeadline)
+	defer cancel()
+
+	c.stream.SetWriteContext(ctx)
+	n, err := c.stream.Write(b)
+	if err != nil {
+		return n, c.translateError(err)
+	}
+
+	// Streams buffer writes until flushed, ssh expects them to go out straight away
+	return n, c.translateError(c.stream.Flush())
+}
+
+func (c *quicConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.cancel()
+
+		c.stream.CloseWrite()
+		c.conn.Abort(nil)
+
+		if c.endpoint != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			c.endpoint.Close(ctx)
+			cancel()
+		}
+	})
+
+	return nil
+}
+
+func (c *quicConn) LocalAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(c.conn.LocalAddr())
+}
+
+func (c *quicConn) RemoteAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(c.conn.RemoteAddr())
+}
+
+func (c *quicConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	c.writeDeadline = t
+
+	return nil
+}
+
+func (c *quicConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+
+	return nil
+}
+
+func (c *quicConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeDeadline = t
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package mux
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQUICListener(t *testing.T) {
+	m, err := ListenWithConfig("tcp", "127.0.0.1:0", MultiplexerConfig{
+		Control:            true,
+		PollingAuthChecker: func(string, net.Addr) bool { return false },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	address := QUICScheme + "127.0.0.1:0"
+	if err := m.StartListener("udp", address); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.StartListenerWithOptions("udp", QUICScheme+"localhost:0", ListenerOptions{TrustedProxies: []*net.IPNet{{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}}}); err == nil || !strings.Contains(err.Error(), "PROXY") {
+		t.Fatal("quic listener accepted PROXY protocol options")
+	}
+
+	m.RLock()
+	udpAddr := m.listeners[address].Addr().String()
+	m.RUnlock()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := m.ControlRequests().Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	client, err := DialQUIC(ctx, udpAddr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, err := client.Write([]byte("SSH-2.0-test\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	var server net.Conn
+	select {
+	case server = <-accepted:
+	case <-time.After(3 * time.Second):
+		t.Fatal("quic stream was not handed to the control listener")
+	}
+	defer server.Close()
+
+	if _, ok := server.RemoteAddr().(*net.UDPAddr); !ok {
+		t.Fatalf("expected a udp remote address, got %T", server.RemoteAddr())
+	}
+
+	buf := make([]byte, 14)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "SSH-2.0-test\r\n" {
+		t.Fatalf("unexpected data from client %q: %v", buf, err)
+	}
+
+	if _, err := server.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadFull(client, buf[:4]); err != nil || string(buf[:4]) != "pong" {
+		t.Fatalf("unexpected data from server %q: %v", buf[:4], err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := client.Read(buf); !isTimeout(err) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+
+	if m.Stats().Connections != 1 {
+		t.Fatalf("quic connection was not counted: %d", m.Stats().Connections)
+	}
+}
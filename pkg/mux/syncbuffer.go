@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"io"
 	"sync"
+	"time"
 )
 
 type SyncBuffer struct {
@@ -16,6 +17,39 @@ type SyncBuffer struct {
 	maxLength int
 
 	isClosed bool
+
+	// Closed and replaced whenever data is written, so waiters cannot miss a write
+	dataReady chan struct{}
+}
+
+// Non-threadsafe, must hold lock
+func (sb *SyncBuffer) _wakeWaiters() {
+	close(sb.dataReady)
+	sb.dataReady = make(chan struct{})
+}
+
+// WaitForData blocks until the buffer has something to read, it is closed, timeout passes or cancel is closed
+func (sb *SyncBuffer) WaitForData(timeout time.Duration, cancel <-chan struct{}) bool {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	for {
+		sb.Lock()
+		if sb.bb.Len() > 0 || sb.isClosed {
+			sb.Unlock()
+			return sb.Len() > 0
+		}
+		ready := sb.dataReady
+		sb.Unlock()
+
+		select {
+		case <-ready:
+		case <-t.C:
+			return sb.Len() > 0
+		case <-cancel:
+			return sb.Len() > 0
+		}
+	}
 }
 
 // Read from the internal buffer, wait if the buffer is EOF until it is has something to return
@@ -72,6 +106,8 @@ func (sb *SyncBuffer) BlockingWrite(p []byte) (n int, err error) {
 	if err != nil {
 		return 0, err
 	}
+	sb._wakeWaiters()
+
 	for {
 
 		sb.rwait.Signal()
@@ -98,6 +134,8 @@ func (sb *SyncBuffer) Write(p []byte) (n int, err error) {
 		return 0, ErrClosed
 	}
 
+	defer sb._wakeWaiters()
+
 	return sb.bb.Write(p)
 }
 
@@ -132,6 +170,7 @@ func (sb *SyncBuffer) Close() error {
 
 	sb.rwait.Signal()
 	sb.wwait.Signal()
+	sb._wakeWaiters()
 
 	sb.bb.Reset()
 
@@ -144,6 +183,7 @@ func NewSyncBuffer(maxLength int) *SyncBuffer {
 		bb:        bytes.NewBuffer(nil),
 		isClosed:  false,
 		maxLength: maxLength,
+		dataReady: make(chan struct{}),
 	}
 
 	sb.rwait.L = &sb.Mutex
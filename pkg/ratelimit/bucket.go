@@ -0,0 +1,81 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket measured in bytes, it holds at most one second of tokens.
+// Callers may take more tokens than are available, the debt is paid off by sleeping so large reads are smoothed out rather than rejected
+type Bucket struct {
+	sync.Mutex
+
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(bytesPerSecond uint64) *Bucket {
+	return &Bucket{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// Non-threadsafe, must hold the lock
+func (b *Bucket) refill() {
+	now := time.Now()
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+
+	b.last = now
+}
+
+func (b *Bucket) Rate() uint64 {
+	b.Lock()
+	defer b.Unlock()
+
+	return uint64(b.rate)
+}
+
+// SetRate changes the rate of the bucket live, a rate of 0 disables limiting
+func (b *Bucket) SetRate(bytesPerSecond uint64) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill()
+	b.rate = float64(bytesPerSecond)
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
+
+// Reserve takes n tokens and returns how long the caller must wait before using them
+func (b *Bucket) Reserve(n int) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+
+	b.refill()
+	b.tokens -= float64(n)
+
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// WaitN blocks until n bytes are allowed through the bucket
+func (b *Bucket) WaitN(n int) {
+	if d := b.Reserve(n); d > 0 {
+		time.Sleep(d)
+	}
+}
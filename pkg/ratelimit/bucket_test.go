@@ -0,0 +1,39 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReserve(t *testing.T) {
+	b := NewBucket(1000)
+
+	if d := b.Reserve(1000); d != 0 {
+		t.Fatalf("full bucket should not require a wait, got %s", d)
+	}
+
+	d := b.Reserve(500)
+	if d < 450*time.Millisecond || d > 500*time.Millisecond {
+		t.Fatalf("taking 500 bytes from an empty 1000 B/s bucket should wait ~500ms, got %s", d)
+	}
+
+	// The debt from the previous reservation must be paid by the next caller too
+	d = b.Reserve(500)
+	if d < 950*time.Millisecond || d > time.Second {
+		t.Fatalf("second reservation should queue behind the first, expected ~1s got %s", d)
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	b := NewBucket(1000)
+	b.SetRate(0)
+
+	if d := b.Reserve(1 << 30); d != 0 {
+		t.Fatalf("a rate of 0 should never wait, got %s", d)
+	}
+
+	b.SetRate(10)
+	if b.Rate() != 10 {
+		t.Fatalf("expected rate to be updated to 10, got %d", b.Rate())
+	}
+}
@@ -0,0 +1,53 @@
+package totp
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B, SHA1 vectors truncated to 6 digits
+func TestCode(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+
+	for unix, expected := range vectors {
+		c, err := Code(secret, time.Unix(unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c != expected {
+			t.Fatalf("at %d expected %s got %s", unix, expected, c)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	previous, _ := Code(secret, now.Add(-Period*time.Second))
+
+	if step, ok := Validate(secret, previous, now, 1); !ok || step != Step(now)-1 {
+		t.Fatal("code from the previous step should be accepted with a skew of 1")
+	}
+
+	if _, ok := Validate(secret, previous, now, 0); ok {
+		t.Fatal("code from the previous step should not be accepted without skew")
+	}
+
+	if _, ok := Validate(secret, "12345", now, 1); ok {
+		t.Fatal("short codes should never validate")
+	}
+}